@@ -0,0 +1,58 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "check the configuration",
+}
+
+// configValidateCmd represents the config validate command
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "check the configured servers for problems",
+	Long: `Checks the configured servers, including those imported from the OpenSSH client configuration,
+and prints every problem found, one per line: loops of gateways, unknown gateways, servers configured more than once,
+missing addr, unsupported authentication methods, ports out of range and unset environment variables.
+Problems are also reported as warnings by the other commands.`,
+	Args: cobra.NoArgs,
+	RunE: configValidate,
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configValidateCmd)
+}
+
+// tiramolla config validate command
+func configValidate(cmd *cobra.Command, args []string) error {
+	if len(configProblems) == 0 {
+		fmt.Println("configuration is valid")
+		return nil
+	}
+
+	for _, problem := range configProblems {
+		fmt.Println(problem)
+	}
+	return fmt.Errorf("configuration is not valid")
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		config     string
+		sshConfig  string
+		expErr     bool
+		expPrinted string
+	}{
+		{
+			name:       "Valid",
+			config:     "servers:\n  - name: foo\n    addr: 1.1.1.1\n    authentication_method: agent\n    gateway: bar\n  - name: bar\n    addr: 2.2.2.2\n    port: 2222\n    authentication_method: password",
+			expPrinted: "configuration is valid\n",
+		},
+		{
+			name:       "GatewayLoop",
+			config:     "servers:\n  - name: foo\n    addr: 1.1.1.1\n    authentication_method: agent\n    gateway: bar\n  - name: bar\n    addr: 2.2.2.2\n    authentication_method: agent\n    gateway: foo",
+			expErr:     true,
+			expPrinted: "gateways of server bar loop: bar -> foo -> bar\n",
+		},
+		{
+			name:       "DuplicateServer",
+			config:     "servers:\n  - name: foo\n    addr: 1.1.1.1\n    authentication_method: agent\n  - name: foo\n    addr: 2.2.2.2\n    authentication_method: agent",
+			expErr:     true,
+			expPrinted: "server foo is configured more than once\n",
+		},
+		{
+			name:       "OverriddenSSHConfigServer",
+			config:     "servers:\n  - name: foo\n    addr: 1.1.1.1\n    authentication_method: agent",
+			sshConfig:  "Host foo\n  HostName 3.3.3.3\n",
+			expPrinted: "configuration is valid\n",
+		},
+		{
+			name: "SeveralProblems",
+			config: "servers:\n  - name: foo\n    port: 70000\n    authentication_method: agent\n    gateway: qux\n" +
+				"  - name: bar\n    addr: 2.2.2.2\n    authentication_method: hostbased\n    pass: $TEST_UNSET_PASS",
+			expErr: true,
+			expPrinted: "authentication method hostbased of server bar is not supported\n" +
+				"pass of server bar refers to unset environment variable TEST_UNSET_PASS\n" +
+				"server foo has no addr\n" +
+				"port 70000 of server foo is out of range 1-65535\n" +
+				"server qux, gateway of foo, is not known\n",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				t.Fatalf("error getting home directory: %v", err)
+			}
+			config := testCase.config
+			if testCase.sshConfig != "" {
+				sshConfig := filepath.Join(t.TempDir(), "config")
+				err = os.WriteFile(sshConfig, []byte(testCase.sshConfig), 0600)
+				if err != nil {
+					t.Fatalf("error creating test ssh config file: %v", err)
+				}
+				config += "\nssh_config: " + sshConfig
+			}
+			err, cleanup := testFileCreator(config, filepath.Join(home, ".tiramolla.yaml"))
+			if err != nil {
+				t.Fatalf("error creating test config file: %v", err)
+			}
+			t.Cleanup(cleanup)
+			initConfig()
+
+			origStdout := os.Stdout
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatalf("error creating pipe: %v", err)
+			}
+			os.Stdout = w
+			err = configValidate(&cobra.Command{}, nil)
+			w.Close()
+			os.Stdout = origStdout
+			printed, _ := io.ReadAll(r)
+			r.Close()
+
+			if testCase.expErr != (err != nil) {
+				t.Fatalf("expected error %t, got '%v'", testCase.expErr, err)
+			}
+			if string(printed) != testCase.expPrinted {
+				t.Fatalf("expected printed message '%s', got '%s'", testCase.expPrinted, printed)
+			}
+		})
+	}
+}
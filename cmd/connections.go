@@ -0,0 +1,211 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/kantonop/tiramolla/pkg/remote"
+
+	"github.com/spf13/cobra"
+)
+
+// written by 'connections serve' on its status pipe once the multiplexer is listening
+const muxReady = "ready\n"
+
+// connectionsCmd represents the connections command
+var connectionsCmd = &cobra.Command{
+	Use:   "connections",
+	Short: "manage multiplexed connections to servers",
+	Long: `Manages the connections kept open for servers with multiplex set.
+The first command connecting to such a server starts a multiplexer in the background,
+which keeps the chain to the server open and listens on a socket under $XDG_RUNTIME_DIR.
+Later commands attach to it instead of connecting to every hop again.
+A multiplexer stops once no command has been attached to it for multiplex_idle_timeout (default 10m).`,
+}
+
+// connectionsListCmd represents the connections list command
+var connectionsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "print the open multiplexed connections",
+	Args:  cobra.NoArgs,
+	RunE:  connectionsList,
+}
+
+// connectionsCloseCmd represents the connections close command
+var connectionsCloseCmd = &cobra.Command{
+	Use:   "close [serverName...]",
+	Short: "close the multiplexed connections to servers, or all of them",
+	RunE:  connectionsClose,
+}
+
+// connectionsServeCmd runs a multiplexer, it is started by the commands connecting to a server
+var connectionsServeCmd = &cobra.Command{
+	Use:    "serve serverName",
+	Args:   cobra.ExactArgs(1),
+	Hidden: true,
+	RunE:   connectionsServe,
+}
+
+func init() {
+	rootCmd.AddCommand(connectionsCmd)
+	connectionsCmd.AddCommand(connectionsListCmd)
+	connectionsCmd.AddCommand(connectionsCloseCmd)
+	connectionsCmd.AddCommand(connectionsServeCmd)
+
+	remote.StartMux = startMux
+}
+
+// tiramolla connections list command
+func connectionsList(cmd *cobra.Command, args []string) error {
+	muxes, err := remote.ListMux()
+	if err != nil {
+		return err
+	}
+	if len(muxes) == 0 {
+		fmt.Println("no connections are open")
+		return nil
+	}
+	for _, mux := range muxes {
+		fmt.Printf("%s (pid %d): %d attached, open since %s, idle timeout %s\n",
+			mux.Server, mux.PID, mux.Clients, mux.Started.Format("2006-01-02 15:04:05"), mux.IdleTimeout)
+	}
+	return nil
+}
+
+// tiramolla connections close command
+func connectionsClose(cmd *cobra.Command, args []string) error {
+	muxes, err := remote.ListMux()
+	if err != nil {
+		return err
+	}
+
+	// there may be several multiplexers of a server, if its configuration changed
+	closed := make(map[string]bool)
+	for _, mux := range muxes {
+		if len(args) > 0 && !contains(args, mux.Server) {
+			continue
+		}
+		err = remote.CloseMux(mux.Socket)
+		if err != nil {
+			return fmt.Errorf("closing connection to server %s failed with error: %v", mux.Server, err)
+		}
+		closed[mux.Server] = true
+	}
+	for _, name := range args {
+		if !closed[name] {
+			return fmt.Errorf("no connection to server %s is open, use 'tiramolla connections list' for the list of open connections", name)
+		}
+	}
+	return nil
+}
+
+// reports whether list contains s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// tiramolla connections serve command
+// the status of the multiplexer is written to file descriptor 3, where startMux reads it
+func connectionsServe(cmd *cobra.Command, args []string) error {
+	server, ok := servers[args[0]].(*remote.Server)
+	if !ok {
+		return fmt.Errorf("server %s is not in the list of known servers, use 'tiramolla show servers' for the list of available servers", args[0])
+	}
+	err := server.CreateServerChain(servers)
+	if err != nil {
+		return fmt.Errorf("creation of chain of servers to target server failed with error: %v", err)
+	}
+
+	status := os.NewFile(3, "status")
+	return server.ServeMux(cmd.Context(), func(err error) {
+		defer status.Close()
+		if err != nil {
+			fmt.Fprintln(status, err)
+			return
+		}
+		// the command that started the multiplexer returns once the status is closed,
+		// it is no longer attached to its terminal by then
+		err = detach()
+		if err != nil {
+			fmt.Fprintln(status, err)
+			return
+		}
+		fmt.Fprint(status, muxReady)
+	})
+}
+
+// starts the multiplexer of server in a new process running 'connections serve'
+// the process shares the terminal, to ask for passwords, until it is ready and keeps running in the background
+// it is killed if ctx is done before it is ready
+func startMux(ctx context.Context, server remote.Server) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	proc := exec.Command(exe, "connections", "serve", server.Name)
+	proc.Stdin, proc.Stdout, proc.Stderr = os.Stdin, os.Stdout, os.Stderr
+	proc.ExtraFiles = []*os.File{w}
+	err = proc.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			proc.Process.Kill()
+		case <-done:
+		}
+	}()
+	status, _ := io.ReadAll(r)
+	// once the watch is over, ctx being done no longer affects the process
+	close(done)
+	<-watched
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		proc.Process.Kill()
+		proc.Wait()
+		return ctxErr
+	}
+	if string(status) == muxReady {
+		return proc.Process.Release()
+	}
+	proc.Wait()
+	if msg := strings.TrimSpace(string(status)); msg != "" {
+		return fmt.Errorf("%s", msg)
+	}
+	return fmt.Errorf("multiplexer exited")
+}
@@ -0,0 +1,69 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestConnectionsList(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	origStdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("error creating pipe: %v", err)
+	}
+	os.Stdout = w
+	err = connectionsList(&cobra.Command{}, nil)
+	w.Close()
+	os.Stdout = origStdout
+	printed, _ := io.ReadAll(r)
+	r.Close()
+
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	if string(printed) != "no connections are open\n" {
+		t.Fatalf("expected printed message 'no connections are open', got '%s'", printed)
+	}
+}
+
+func TestConnectionsClose(t *testing.T) {
+	testCases := []struct {
+		name   string
+		args   []string
+		expErr bool
+	}{
+		{name: "All", args: nil},
+		{name: "NotOpen", args: []string{"foo"}, expErr: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+			err := connectionsClose(&cobra.Command{}, testCase.args)
+			if testCase.expErr != (err != nil) {
+				t.Fatalf("expected error %t, got '%v'", testCase.expErr, err)
+			}
+		})
+	}
+}
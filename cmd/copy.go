@@ -16,24 +16,58 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kantonop/tiramolla/pkg/remote"
 
 	"github.com/spf13/cobra"
 )
 
 var (
 	targetServer, mode string
+	recursive, resume  bool
+	progress, preserve bool
+	retries            int
+	// verify transfers with the checksum algorithm
+	verify   bool
+	checksum string
+	// delay before reconnecting to retry a failed transfer
+	retryDelay = 5 * time.Second
 )
 
 // copyCmd represents the copy command
 var copyCmd = &cobra.Command{
-	Use:   "copy /path/to/file /path/to/dest",
-	Short: "download or upload a file",
-	Long: `Downloads or uploads a file to or from a remote server.
+	Use:   "copy [server:]/path/to/file [[server:]/path/to/file...] [server:]/path/to/dest",
+	Short: "download or upload files",
+	Long: `Downloads or uploads files to or from a remote server.
 
 Use absolute paths to avoid unexpected behaviour.
-Downloading and uploading is set by the mode flag.`,
-	Args:    cobra.ExactArgs(2),
+Remote paths are given as server:/path, as with scp:
+'tiramolla copy server:/path/to/file /path/to/dest' downloads and
+'tiramolla copy /path/to/file server:/path/to/dest' uploads.
+Use ./path for local files whose name contains a colon.
+Files are copied between two servers with 'tiramolla copy server1:/path/to/file server2:/path/to/dest',
+streaming them from one server to the other without writing them to local disk.
+Alternatively, the server is set by the server flag and downloading or uploading by the mode flag,
+in which case all arguments are paths.
+Sources may be glob patterns, expanded on the remote server when downloading
+and locally when uploading. All files are copied over a single connection.
+Directories are copied along with their contents if the recursive flag is provided.
+With the resume flag, partial files at destination are continued instead of copied over
+if their checksum matches the start of the source, computed on the server by head and sha256sum,
+and failed transfers are retried over a new connection.
+With the verify flag, the checksums of copied files are compared with their source
+and files that do not match are removed from the destination. The checksum flag sets the algorithm.
+With the preserve flag, modes and times of files are kept, as with scp -p,
+along with their owners when copying as root or as a become_user that is root.
+On interrupt, the copy stops and removes the partial file, unless resuming,
+along with any staged files. A second interrupt exits immediately.`,
+	Args:    cobra.MinimumNArgs(2),
 	PreRunE: copyFlagsValidation,
 	RunE:    copyFile,
 }
@@ -41,53 +75,311 @@ Downloading and uploading is set by the mode flag.`,
 func init() {
 	rootCmd.AddCommand(copyCmd)
 
-	copyCmd.Flags().StringVar(&targetServer, "server", "", "target server")
-	copyCmd.MarkFlagRequired("server")
-	copyCmd.Flags().StringVar(&mode, "mode", "", "down or up")
-	copyCmd.MarkFlagRequired("mode")
+	copyCmd.Flags().StringVar(&targetServer, "server", "", "target server, instead of server:path arguments")
+	copyCmd.Flags().StringVar(&mode, "mode", "", "down or up, along with the server flag")
+	copyCmd.Flags().BoolVarP(&recursive, "recursive", "r", false, "copy directories recursively")
+	copyCmd.Flags().BoolVar(&resume, "resume", false, "continue partial transfers, reconnecting on failure")
+	copyCmd.Flags().IntVar(&retries, "retries", 3, "number of reconnections to resume a failed transfer")
+	copyCmd.Flags().BoolVarP(&preserve, "preserve", "p", false, "preserve modes, times and, as root, owners of files")
+	copyCmd.Flags().BoolVar(&progress, "progress", true, "report the progress of transfers")
+	copyCmd.Flags().BoolVar(&verify, "verify", false, "verify transfers with a checksum")
+	copyCmd.Flags().StringVar(&checksum, "checksum", remote.DefaultChecksum, "checksum algorithm of the verify flag: md5, sha1, sha256 or sha512")
 }
 
 // flags validation function
 // runs before main copy command
 func copyFlagsValidation(cmd *cobra.Command, args []string) error {
-	err := validateTargetServer()
+	if cmd.Flags().Changed("checksum") && !verify {
+		return fmt.Errorf("checksum flag is only used along with the verify flag")
+	}
+
+	// the server and mode flags are kept for backwards compatibility
+	if targetServer != "" || mode != "" {
+		if targetServer == "" {
+			return fmt.Errorf("server flag is required along with the mode flag")
+		}
+		err := validateTargetServer()
+		if err != nil {
+			return err
+		}
+
+		if mode != "down" && mode != "up" {
+			return fmt.Errorf("mode should be either 'down' or 'up'")
+		}
+		return nil
+	}
+
+	_, err := parseCopyArgs(args)
+	return err
+}
+
+// copyArgs holds the parsed arguments of a copy
+type copyArgs struct {
+	// down, up or between servers
+	mode string
+	// server of the sources if downloading or copying between servers, of the destination if uploading
+	server string
+	// server of the destination if copying between servers
+	target  string
+	sources []string
+	dest    string
+}
+
+// parses the sources and destination of a copy
+// with the server and mode flags, the arguments are paths as given,
+// otherwise the direction of the copy follows from which arguments are in server:path format
+func parseCopyArgs(args []string) (copyArgs, error) {
+	if len(args) < 2 {
+		return copyArgs{}, fmt.Errorf("at least one source and a destination are required")
+	}
+	last := len(args) - 1
+	if targetServer != "" || mode != "" {
+		return copyArgs{mode: mode, server: targetServer, sources: args[:last], dest: args[last]}, nil
+	}
+
+	var spec copyArgs
+	srcServer := ""
+	for i, arg := range args[:last] {
+		name, path, err := splitRemoteArg(arg)
+		if err != nil {
+			return copyArgs{}, err
+		}
+		if i > 0 && name != srcServer {
+			return copyArgs{}, fmt.Errorf("sources %s and %s are on different sides, all sources should be either local or on the same server", args[0], arg)
+		}
+		srcServer = name
+		spec.sources = append(spec.sources, path)
+	}
+	dstServer, dest, err := splitRemoteArg(args[last])
 	if err != nil {
-		return err
+		return copyArgs{}, err
 	}
+	spec.dest = dest
 
-	if mode != "down" && mode != "up" {
-		return fmt.Errorf("mode should be either 'down' or 'up'")
+	switch {
+	case srcServer == "" && dstServer == "":
+		return copyArgs{}, fmt.Errorf("neither the sources nor the destination are on a server, use 'server:/path' arguments or the server and mode flags")
+	case srcServer != "" && dstServer != "":
+		spec.mode, spec.server, spec.target = "between", srcServer, dstServer
+	case srcServer != "":
+		spec.mode, spec.server = "down", srcServer
+	default:
+		spec.mode, spec.server = "up", dstServer
 	}
+	return spec, nil
+}
 
-	return nil
+// splits a server:path argument into the name of the server and the path
+// the name is empty for local paths, which are returned as is
+// returns error if the argument can be either a local file or a path on a server,
+// or if it is in server:path format with an unknown server
+func splitRemoteArg(arg string) (name, path string, err error) {
+	i := strings.Index(arg, ":")
+	// a slash before the colon makes it a local path, as with scp
+	if i <= 0 || strings.Contains(arg[:i], "/") {
+		return "", arg, nil
+	}
+	name, path = arg[:i], arg[i+1:]
+
+	_, known := servers[name]
+	_, statErr := os.Stat(arg)
+	exists := statErr == nil
+	switch {
+	case known && exists:
+		return "", "", fmt.Errorf("%s is ambiguous, it is both a local file and a path on server %s, use ./%s for the local file", arg, name, arg)
+	case known:
+		return name, path, nil
+	case exists:
+		return "", arg, nil
+	}
+	return "", "", fmt.Errorf("server %s of %s not in list of known servers, use 'tiramolla show servers' for the list of available servers or ./%s for a local file", name, arg, arg)
 }
 
 // tiramolla copy command
 func copyFile(cmd *cobra.Command, args []string) error {
-	server := servers[targetServer]
-	// chain servers
-	err := server.CreateServerChain(servers)
+	spec, err := parseCopyArgs(args)
 	if err != nil {
-		return fmt.Errorf("creation of chain of servers to target server failed with error: %v", err)
+		return err
+	}
+	// the context is done on interrupt, see Execute
+	ctx := context.Background()
+	if cmd != nil && cmd.Context() != nil {
+		ctx = cmd.Context()
+	}
+	if spec.mode == "between" {
+		return copyBetweenServers(ctx, spec)
 	}
 
-	// Connect
-	err = server.Connect()
+	server := servers[spec.server]
+	err = connectServer(ctx, server)
 	if err != nil {
-		return fmt.Errorf("connect to server failed with error: %v", err)
+		return err
 	}
 	defer server.CloseClient()
 
 	// copy
+	opts := copyOptions()
+	sources, err := expandSources(server, spec.sources, spec.mode)
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		err = withRetries(ctx, []remote.ServerInterface{server}, func() error {
+			return transfer(ctx, server, source, spec.dest, spec.mode, opts)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copies the sources from one server to the other
+// the data passes through memory, nothing is written to local disk
+func copyBetweenServers(ctx context.Context, spec copyArgs) error {
+	src, dst := servers[spec.server], servers[spec.target]
+	connected := []remote.ServerInterface{src}
+	if spec.target != spec.server {
+		connected = append(connected, dst)
+	}
+	for _, server := range connected {
+		err := connectServer(ctx, server)
+		if err != nil {
+			return err
+		}
+		defer server.CloseClient()
+	}
+
+	opts := copyOptions()
+	sources, err := expandSources(src, spec.sources, spec.mode)
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		err = withRetries(ctx, connected, func() error {
+			err := src.CopyToContext(ctx, source, dst, spec.dest, opts...)
+			if err != nil {
+				return fmt.Errorf("copy failed with error: %v", err)
+			}
+			fmt.Println("copy completed")
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chains and connects server
+func connectServer(ctx context.Context, server remote.ServerInterface) error {
+	err := server.CreateServerChain(servers)
+	if err != nil {
+		return fmt.Errorf("creation of chain of servers to target server failed with error: %v", err)
+	}
+	err = server.ConnectContext(ctx)
+	if err != nil {
+		return fmt.Errorf("connect to server failed with error: %v", err)
+	}
+	return nil
+}
+
+// constructs the copy options from the flags
+func copyOptions() []remote.CopyOption {
+	var opts []remote.CopyOption
+	if recursive {
+		opts = append(opts, remote.WithRecursive())
+	}
+	if resume {
+		opts = append(opts, remote.WithResume())
+	}
+	if progress {
+		opts = append(opts, remote.WithProgress(newProgressReporter(os.Stderr).report))
+	}
+	if verify {
+		opts = append(opts, remote.WithVerify(checksum))
+	}
+	if preserve {
+		opts = append(opts, remote.WithPreserve())
+	}
+	return opts
+}
+
+// runs fn and, when resuming, retries it after a failure over a new connection to the whole chain of each server
+// there are no retries once ctx is done
+func withRetries(ctx context.Context, connected []remote.ServerInterface, fn func() error) error {
+	err := fn()
+	for attempt := 1; err != nil && resume && attempt <= retries && ctx.Err() == nil; attempt++ {
+		fmt.Fprintf(os.Stderr, "%v\nreconnecting to resume (attempt %d/%d)\n", err, attempt, retries)
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return err
+		}
+		err = reconnect(ctx, connected)
+		if err != nil {
+			continue
+		}
+		err = fn()
+	}
+	return err
+}
+
+// closes and reopens the connections to servers
+// all of them are closed first, so that the gateways they share are connected to again too
+func reconnect(ctx context.Context, connected []remote.ServerInterface) error {
+	for _, server := range connected {
+		server.CloseClient()
+	}
+	for _, server := range connected {
+		err := server.ConnectContext(ctx)
+		if err != nil {
+			return fmt.Errorf("connect to server failed with error: %v", err)
+		}
+	}
+	return nil
+}
+
+// expands the glob patterns among sources
+// patterns are expanded locally when uploading and on the server otherwise
+// returns error if a pattern matches no files
+func expandSources(server remote.ServerInterface, sources []string, mode string) ([]string, error) {
+	var expanded []string
+	for _, source := range sources {
+		if !strings.ContainsAny(source, "*?[") {
+			expanded = append(expanded, source)
+			continue
+		}
+
+		var matches []string
+		var err error
+		if mode == "up" {
+			matches, err = filepath.Glob(source)
+		} else {
+			matches, err = server.Glob(source)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("expansion of %s failed with error: %v", source, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files matching %s", source)
+		}
+		expanded = append(expanded, matches...)
+	}
+	return expanded, nil
+}
+
+// downloads or uploads file according to mode
+func transfer(ctx context.Context, server remote.ServerInterface, file, dest, mode string, opts []remote.CopyOption) error {
 	switch mode {
 	case "down":
-		err = server.Download(args[0], args[1])
+		err := server.DownloadContext(ctx, file, dest, opts...)
 		if err != nil {
 			return fmt.Errorf("download failed with error: %v", err)
 		}
 		fmt.Println("download completed")
 	case "up":
-		err = server.Upload(args[0], args[1])
+		err := server.UploadContext(ctx, file, dest, opts...)
 		if err != nil {
 			return fmt.Errorf("upload failed with error: %v", err)
 		}
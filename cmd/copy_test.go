@@ -16,12 +16,16 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"reflect"
 	"testing"
 
 	"github.com/kantonop/tiramolla/pkg/remote"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
 )
 
 var (
@@ -70,15 +74,26 @@ func TestValidateTargetServer(t *testing.T) {
 
 func TestCopyFlagsValidation(t *testing.T) {
 	testCases := []struct {
-		name    string
-		mode    string
-		servers map[string]remote.Server
-		expErr  error
+		name     string
+		mode     string
+		noServer bool
+		args     []string
+		servers  map[string]remote.Server
+		expErr   error
 	}{
 		{name: "Download", mode: "down", expErr: nil},
 		{name: "Upload", mode: "up", expErr: nil},
 		{name: "IncorrectMode", mode: "downAndUp", expErr: fmt.Errorf("download/upload mode error")},
 		{name: "UnknownServer", servers: make(map[string]remote.Server), expErr: fmt.Errorf("unknown server")},
+		{name: "MissingServer", mode: "down", noServer: true, expErr: fmt.Errorf("missing server")},
+		{name: "ModeWithoutServer", mode: "down", noServer: true, args: []string{"foo:/foo.txt", "/tmp"}, expErr: fmt.Errorf("mode without server")},
+		{name: "RemoteToRemote", noServer: true, args: []string{"foo:/foo.txt", "foo:/tmp"}, expErr: nil},
+		{name: "RemoteSource", noServer: true, args: []string{"foo:/foo.txt", "foo:/bar.txt", "/tmp"}, expErr: nil},
+		{name: "RemoteDestination", noServer: true, args: []string{"/foo.txt", "./bar.txt", "foo:/tmp"}, expErr: nil},
+		{name: "NoRemoteArgument", noServer: true, args: []string{"/foo.txt", "/tmp"}, expErr: fmt.Errorf("no remote argument")},
+		{name: "MixedSources", noServer: true, args: []string{"foo:/foo.txt", "/bar.txt", "/tmp"}, expErr: fmt.Errorf("mixed sources")},
+		{name: "UnknownServerArgument", noServer: true, args: []string{"bar:/foo.txt", "/tmp"}, expErr: fmt.Errorf("unknown server argument")},
+		{name: "MissingArguments", noServer: true, args: []string{"foo:/foo.txt"}, expErr: fmt.Errorf("missing arguments")},
 	}
 
 	for _, testCase := range testCases {
@@ -95,8 +110,63 @@ func TestCopyFlagsValidation(t *testing.T) {
 				}
 			}
 			mode = testCase.mode
-			err := copyFlagsValidation(cmd, args)
+			if testCase.noServer {
+				targetServer = ""
+			}
+			args := testCase.args
+			if args == nil {
+				args = []string{"fileSource", "fileDestination"}
+			}
+			err := copyFlagsValidation(copyCmd, args)
+
+			if (testCase.expErr == nil && err != nil) ||
+				(testCase.expErr != nil && err == nil) {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+		})
+	}
+}
+
+func TestCopyVerifyFlags(t *testing.T) {
+	testCases := []struct {
+		name        string
+		args        []string
+		expVerify   bool
+		expChecksum string
+		expArgs     []string
+		expErr      error
+	}{
+		{name: "Verify", args: []string{"--verify", "foo:/foo.txt", "/tmp"}, expVerify: true, expChecksum: "sha256", expArgs: []string{"foo:/foo.txt", "/tmp"}},
+		{name: "Checksum", args: []string{"--verify", "--checksum", "md5", "foo:/foo.txt", "/tmp"}, expVerify: true, expChecksum: "md5", expArgs: []string{"foo:/foo.txt", "/tmp"}},
+		{name: "ChecksumEquals", args: []string{"--verify", "--checksum=md5", "foo:/foo.txt", "/tmp"}, expVerify: true, expChecksum: "md5", expArgs: []string{"foo:/foo.txt", "/tmp"}},
+		{name: "VerifyAfterSources", args: []string{"foo:/foo.txt", "/tmp", "--verify"}, expVerify: true, expChecksum: "sha256", expArgs: []string{"foo:/foo.txt", "/tmp"}},
+		{name: "ChecksumWithoutVerify", args: []string{"--checksum", "md5", "foo:/foo.txt", "/tmp"}, expChecksum: "md5", expArgs: []string{"foo:/foo.txt", "/tmp"}, expErr: fmt.Errorf("checksum without verify")},
+	}
+
+	targetServer, mode = "", ""
+	servers = map[string]remote.ServerInterface{"foo": &remote.Server{Name: "foo"}}
+	reset := func() {
+		verify, checksum = false, remote.DefaultChecksum
+		copyCmd.Flags().Lookup("verify").Changed = false
+		copyCmd.Flags().Lookup("checksum").Changed = false
+	}
+	t.Cleanup(reset)
 
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			reset()
+			err := copyCmd.ParseFlags(testCase.args)
+			if err != nil {
+				t.Fatalf("error parsing flags: %v", err)
+			}
+			if verify != testCase.expVerify || checksum != testCase.expChecksum {
+				t.Fatalf("expected verify %v with %s, got %v with %s", testCase.expVerify, testCase.expChecksum, verify, checksum)
+			}
+			if !reflect.DeepEqual(copyCmd.Flags().Args(), testCase.expArgs) {
+				t.Fatalf("expected arguments %v, got %v", testCase.expArgs, copyCmd.Flags().Args())
+			}
+
+			err = copyFlagsValidation(copyCmd, copyCmd.Flags().Args())
 			if (testCase.expErr == nil && err != nil) ||
 				(testCase.expErr != nil && err == nil) {
 				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
@@ -112,6 +182,15 @@ type ServerMock struct {
 	closeClientErr       error
 	downloadErr          error
 	uploadErr            error
+	hostKey              ssh.PublicKey
+	fetchHostKeyErr      error
+	globMatches          []string
+	globErr              error
+	copyToErr            error
+	// number of transfers to fail before succeeding
+	transferFailures *int
+	// sources of the successful transfers
+	transferred *[]string
 }
 
 func (serverMock ServerMock) GetName() string {
@@ -126,24 +205,108 @@ func (serverMock ServerMock) Connect() error {
 	return serverMock.connectErr
 }
 
+func (serverMock ServerMock) ConnectContext(ctx context.Context) error {
+	return serverMock.Connect()
+}
+
 func (serverMock ServerMock) CloseClient() error {
 	return serverMock.closeClientErr
 }
 
-func (serverMock ServerMock) Download(file, dest string) error {
+func (serverMock ServerMock) Download(file, dest string, opts ...remote.CopyOption) error {
+	if serverMock.transferFailures != nil && *serverMock.transferFailures > 0 {
+		*serverMock.transferFailures--
+		return fmt.Errorf("transfer failure")
+	}
+	if serverMock.downloadErr == nil && serverMock.transferred != nil {
+		*serverMock.transferred = append(*serverMock.transferred, file)
+	}
 	return serverMock.downloadErr
 }
 
-func (serverMock ServerMock) Upload(file, dest string) error {
+func (serverMock ServerMock) DownloadContext(ctx context.Context, file, dest string, opts ...remote.CopyOption) error {
+	return serverMock.Download(file, dest, opts...)
+}
+
+func (serverMock ServerMock) Upload(file, dest string, opts ...remote.CopyOption) error {
+	if serverMock.transferFailures != nil && *serverMock.transferFailures > 0 {
+		*serverMock.transferFailures--
+		return fmt.Errorf("transfer failure")
+	}
+	if serverMock.uploadErr == nil && serverMock.transferred != nil {
+		*serverMock.transferred = append(*serverMock.transferred, file)
+	}
 	return serverMock.uploadErr
 }
 
+func (serverMock ServerMock) UploadContext(ctx context.Context, file, dest string, opts ...remote.CopyOption) error {
+	return serverMock.Upload(file, dest, opts...)
+}
+
+func (serverMock ServerMock) CopyTo(file string, target remote.ServerInterface, dest string, opts ...remote.CopyOption) error {
+	if serverMock.transferFailures != nil && *serverMock.transferFailures > 0 {
+		*serverMock.transferFailures--
+		return fmt.Errorf("transfer failure")
+	}
+	if serverMock.copyToErr == nil && serverMock.transferred != nil {
+		*serverMock.transferred = append(*serverMock.transferred, target.GetName()+":"+file)
+	}
+	return serverMock.copyToErr
+}
+
+func (serverMock ServerMock) CopyToContext(ctx context.Context, file string, target remote.ServerInterface, dest string, opts ...remote.CopyOption) error {
+	return serverMock.CopyTo(file, target, dest, opts...)
+}
+
+func (serverMock ServerMock) Glob(pattern string) ([]string, error) {
+	return serverMock.globMatches, serverMock.globErr
+}
+
+func (serverMock ServerMock) FetchHostKey() (ssh.PublicKey, error) {
+	return serverMock.hostKey, serverMock.fetchHostKeyErr
+}
+
+// sharedGatewayMock is a ServerMock reached through a gateway shared with other servers,
+// which is closed once none of them uses it
+type sharedGatewayMock struct {
+	ServerMock
+	gateway *gatewayMock
+}
+
+// gatewayMock counts the servers using a gateway and the connections to it
+type gatewayMock struct {
+	refs  int
+	dials int
+}
+
+func (serverMock sharedGatewayMock) Connect() error {
+	if serverMock.gateway.refs == 0 {
+		serverMock.gateway.dials++
+	}
+	serverMock.gateway.refs++
+	return nil
+}
+
+func (serverMock sharedGatewayMock) ConnectContext(ctx context.Context) error {
+	return serverMock.Connect()
+}
+
+func (serverMock sharedGatewayMock) CloseClient() error {
+	serverMock.gateway.refs--
+	return nil
+}
+
 func TestCopyFile(t *testing.T) {
 	testCases := []struct {
-		name    string
-		mode    string
-		servers map[string]ServerMock
-		expErr  error
+		name         string
+		mode         string
+		noServer     bool
+		args         []string
+		resume       bool
+		failures     int
+		servers      map[string]ServerMock
+		expTransfers []string
+		expErr       error
 	}{
 		{
 			name:    "ChainServersError",
@@ -179,16 +342,178 @@ func TestCopyFile(t *testing.T) {
 			servers: map[string]ServerMock{"foo": {}},
 			expErr:  nil,
 		},
+		{
+			name:     "FailureWithoutResume",
+			mode:     "down",
+			failures: 1,
+			servers:  map[string]ServerMock{"foo": {}},
+			expErr:   fmt.Errorf("FailureWithoutResume"),
+		},
+		{
+			name:     "ResumeAfterFailures",
+			mode:     "down",
+			resume:   true,
+			failures: 3,
+			servers:  map[string]ServerMock{"foo": {}},
+			expErr:   nil,
+		},
+		{
+			name:     "ResumeRetriesExhausted",
+			mode:     "up",
+			resume:   true,
+			failures: 4,
+			servers:  map[string]ServerMock{"foo": {}},
+			expErr:   fmt.Errorf("ResumeRetriesExhausted"),
+		},
+		{
+			name:         "MultipleSources",
+			mode:         "down",
+			args:         []string{"foo", "bar", "dest"},
+			servers:      map[string]ServerMock{"foo": {}},
+			expTransfers: []string{"foo", "bar"},
+			expErr:       nil,
+		},
+		{
+			name:         "RemoteGlob",
+			mode:         "down",
+			args:         []string{"/var/log/*.log", "qux", "dest"},
+			servers:      map[string]ServerMock{"foo": {globMatches: []string{"/var/log/foo.log", "/var/log/bar.log"}}},
+			expTransfers: []string{"/var/log/foo.log", "/var/log/bar.log", "qux"},
+			expErr:       nil,
+		},
+		{
+			name:    "RemoteGlobNoMatch",
+			mode:    "down",
+			args:    []string{"/var/log/*.log", "dest"},
+			servers: map[string]ServerMock{"foo": {}},
+			expErr:  fmt.Errorf("RemoteGlobNoMatch"),
+		},
+		{
+			name:    "RemoteGlobError",
+			mode:    "down",
+			args:    []string{"/var/log/*.log", "dest"},
+			servers: map[string]ServerMock{"foo": {globErr: fmt.Errorf("RemoteGlobError")}},
+			expErr:  fmt.Errorf("RemoteGlobError"),
+		},
+		{
+			name:         "LocalGlob",
+			mode:         "up",
+			args:         []string{"testdata/glob/*.txt", "dest"},
+			servers:      map[string]ServerMock{"foo": {globMatches: []string{"unexpected"}}},
+			expTransfers: []string{"testdata/glob/bar.txt", "testdata/glob/foo.txt"},
+			expErr:       nil,
+		},
+		{
+			name:    "LocalGlobNoMatch",
+			mode:    "up",
+			args:    []string{"testdata/glob/*.log", "dest"},
+			servers: map[string]ServerMock{"foo": {}},
+			expErr:  fmt.Errorf("LocalGlobNoMatch"),
+		},
+		{
+			name:         "ResumeMultipleSources",
+			mode:         "up",
+			args:         []string{"foo", "bar", "dest"},
+			resume:       true,
+			failures:     2,
+			servers:      map[string]ServerMock{"foo": {}},
+			expTransfers: []string{"foo", "bar"},
+			expErr:       nil,
+		},
+		{
+			name:         "ScpStyleDownload",
+			noServer:     true,
+			args:         []string{"foo:/var/log/foo.log", "foo:/var/log/*.gz", "/tmp"},
+			servers:      map[string]ServerMock{"foo": {globMatches: []string{"/var/log/foo.log.1.gz"}}},
+			expTransfers: []string{"/var/log/foo.log", "/var/log/foo.log.1.gz"},
+			expErr:       nil,
+		},
+		{
+			name:         "ScpStyleUpload",
+			noServer:     true,
+			args:         []string{"testdata/glob/*.txt", "foo:/tmp"},
+			servers:      map[string]ServerMock{"foo": {}},
+			expTransfers: []string{"testdata/glob/bar.txt", "testdata/glob/foo.txt"},
+			expErr:       nil,
+		},
+		{
+			name:     "ScpStyleLocalOnly",
+			noServer: true,
+			args:     []string{"testdata/glob/foo.txt", "/tmp"},
+			servers:  map[string]ServerMock{"foo": {}},
+			expErr:   fmt.Errorf("ScpStyleLocalOnly"),
+		},
+		{
+			name:         "RemoteToRemote",
+			noServer:     true,
+			args:         []string{"foo:/foo.txt", "bar:/tmp"},
+			servers:      map[string]ServerMock{"foo": {name: "foo"}, "bar": {name: "bar"}},
+			expTransfers: []string{"bar:/foo.txt"},
+			expErr:       nil,
+		},
+		{
+			name:         "RemoteToRemoteSameServer",
+			noServer:     true,
+			args:         []string{"foo:/foo.txt", "foo:/tmp"},
+			servers:      map[string]ServerMock{"foo": {name: "foo"}},
+			expTransfers: []string{"foo:/foo.txt"},
+			expErr:       nil,
+		},
+		{
+			name:         "RemoteToRemoteGlob",
+			noServer:     true,
+			args:         []string{"foo:/*.txt", "bar:/tmp"},
+			servers:      map[string]ServerMock{"foo": {name: "foo", globMatches: []string{"/bar.txt", "/foo.txt"}}, "bar": {name: "bar"}},
+			expTransfers: []string{"bar:/bar.txt", "bar:/foo.txt"},
+			expErr:       nil,
+		},
+		{
+			name:     "RemoteToRemoteConnectError",
+			noServer: true,
+			args:     []string{"foo:/foo.txt", "bar:/tmp"},
+			servers:  map[string]ServerMock{"foo": {name: "foo"}, "bar": {name: "bar", connectErr: fmt.Errorf("RemoteToRemoteConnectError")}},
+			expErr:   fmt.Errorf("RemoteToRemoteConnectError"),
+		},
+		{
+			name:     "RemoteToRemoteError",
+			noServer: true,
+			args:     []string{"foo:/foo.txt", "bar:/tmp"},
+			servers:  map[string]ServerMock{"foo": {name: "foo", copyToErr: fmt.Errorf("RemoteToRemoteError")}, "bar": {name: "bar"}},
+			expErr:   fmt.Errorf("RemoteToRemoteError"),
+		},
+		{
+			name:         "RemoteToRemoteResume",
+			noServer:     true,
+			args:         []string{"foo:/foo.txt", "bar:/tmp"},
+			resume:       true,
+			failures:     2,
+			servers:      map[string]ServerMock{"foo": {name: "foo"}, "bar": {name: "bar"}},
+			expTransfers: []string{"bar:/foo.txt"},
+			expErr:       nil,
+		},
 	}
 
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
 			targetServer = "foo"
+			if testCase.noServer {
+				targetServer = ""
+			}
 			args = []string{"fileSource", "fileDestination"}
+			if testCase.args != nil {
+				args = testCase.args
+			}
 			mode = testCase.mode
+			resume = testCase.resume
+			retries = 3
+			retryDelay = 0
 
+			var transferred []string
 			servers = make(map[string]remote.ServerInterface)
 			for key, val := range testCase.servers {
+				failures := testCase.failures
+				val.transferFailures = &failures
+				val.transferred = &transferred
 				servers[key] = val
 			}
 			err := copyFile(cmd, args)
@@ -197,6 +522,78 @@ func TestCopyFile(t *testing.T) {
 				(testCase.expErr != nil && err == nil) {
 				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
 			}
+			if testCase.expTransfers != nil && !reflect.DeepEqual(testCase.expTransfers, transferred) {
+				t.Fatalf("expected transfers '%v', got '%v'", testCase.expTransfers, transferred)
+			}
+		})
+	}
+}
+
+func TestReconnectSharedGateway(t *testing.T) {
+	gateway := &gatewayMock{}
+	connected := []remote.ServerInterface{
+		sharedGatewayMock{ServerMock: ServerMock{name: "foo"}, gateway: gateway},
+		sharedGatewayMock{ServerMock: ServerMock{name: "bar"}, gateway: gateway},
+	}
+	for _, server := range connected {
+		server.Connect()
+	}
+
+	// the gateway is connected to again, instead of being kept open by the other server
+	err := reconnect(context.Background(), connected)
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	if gateway.dials != 2 || gateway.refs != 2 {
+		t.Fatalf("expected 2 connections to the gateway used by 2 servers, got %d used by %d", gateway.dials, gateway.refs)
+	}
+}
+
+func TestSplitRemoteArg(t *testing.T) {
+	testCases := []struct {
+		name    string
+		arg     string
+		expName string
+		expPath string
+		expErr  error
+	}{
+		{name: "RemotePath", arg: "foo:/var/log/foo.log", expName: "foo", expPath: "/var/log/foo.log"},
+		{name: "RemoteRelativePath", arg: "foo:foo.log", expName: "foo", expPath: "foo.log"},
+		{name: "LocalPath", arg: "/var/log/foo.log", expName: "", expPath: "/var/log/foo.log"},
+		{name: "LocalPathWithColon", arg: "./foo:bar", expName: "", expPath: "./foo:bar"},
+		{name: "ExistingLocalFile", arg: "bar:qux", expName: "", expPath: "bar:qux"},
+		{name: "Ambiguous", arg: "foo:bar", expErr: fmt.Errorf("Ambiguous")},
+		{name: "UnknownServer", arg: "qux:/foo.log", expErr: fmt.Errorf("UnknownServer")},
+	}
+
+	servers = map[string]remote.ServerInterface{"foo": ServerMock{name: "foo"}}
+	// local files named like remote paths
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("error getting working directory: %v", err)
+	}
+	defer os.Chdir(dir)
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatalf("error changing working directory: %v", err)
+	}
+	for _, file := range []string{"foo:bar", "bar:qux"} {
+		err = os.WriteFile(file, nil, 0644)
+		if err != nil {
+			t.Fatalf("error writing test file: %v", err)
+		}
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			name, path, err := splitRemoteArg(testCase.arg)
+			if (testCase.expErr == nil && err != nil) ||
+				(testCase.expErr != nil && err == nil) {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			if name != testCase.expName || path != testCase.expPath {
+				t.Fatalf("expected '%s' '%s', got '%s' '%s'", testCase.expName, testCase.expPath, name, path)
+			}
 		})
 	}
 }
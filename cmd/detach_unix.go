@@ -0,0 +1,46 @@
+//go:build !windows
+
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// detaches the process from its terminal, starting a new session
+// and replacing its standard input, output and error with /dev/null
+func detach() error {
+	_, err := unix.Setsid()
+	if err != nil {
+		return err
+	}
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer null.Close()
+	for fd := 0; fd <= 2; fd++ {
+		err = unix.Dup2(int(null.Fd()), fd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+// fingerprintCmd represents the fingerprint command
+var fingerprintCmd = &cobra.Command{
+	Use:   "fingerprint serverName",
+	Short: "print the host key fingerprint of a server",
+	Long: `Connects to a server through its chain of gateways and prints the fingerprint and the public key of its host key.
+Either of them can be set as host_key of the server to pin its host key.
+The host key is the one the server presents by default, a fingerprint pins only that key,
+while with the public key the server is asked for a key of the same type.`,
+	Args: cobra.ExactArgs(1),
+	RunE: fingerprint,
+}
+
+func init() {
+	rootCmd.AddCommand(fingerprintCmd)
+}
+
+// tiramolla fingerprint command
+func fingerprint(cmd *cobra.Command, args []string) error {
+	server, ok := servers[args[0]]
+	if !ok {
+		return fmt.Errorf("server %s is not in the list of known servers, use 'tiramolla show servers' for the list of available servers", args[0])
+	}
+
+	// chain servers
+	err := server.CreateServerChain(servers)
+	if err != nil {
+		return fmt.Errorf("creation of chain of servers to target server failed with error: %v", err)
+	}
+
+	hostKey, err := server.FetchHostKey()
+	if err != nil {
+		return fmt.Errorf("fetching host key failed with error: %v", err)
+	}
+	fmt.Println(ssh.FingerprintSHA256(hostKey))
+	fmt.Println(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey))))
+	return nil
+}
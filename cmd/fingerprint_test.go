@@ -0,0 +1,110 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/kantonop/tiramolla/pkg/remote"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestFingerprint(t *testing.T) {
+	authorizedKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGbY0R2sCv4jcRTnvjRVZJp8gGtlUvTvH1yyHzgV9K9p"
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		t.Fatalf("error parsing test key: %v", err)
+	}
+
+	testCases := []struct {
+		name       string
+		args       []string
+		servers    map[string]ServerMock
+		expErr     error
+		expPrinted string
+	}{
+		{
+			name:    "UnknownServer",
+			args:    []string{"unknownServer"},
+			servers: map[string]ServerMock{"foo": {}},
+			expErr:  fmt.Errorf("unknownServer"),
+		},
+		{
+			name:    "ChainServersError",
+			args:    []string{"foo"},
+			servers: map[string]ServerMock{"foo": {createServerChainErr: fmt.Errorf("ChainServersError")}},
+			expErr:  fmt.Errorf("ChainServersError"),
+		},
+		{
+			name:    "FetchHostKeyError",
+			args:    []string{"foo"},
+			servers: map[string]ServerMock{"foo": {fetchHostKeyErr: fmt.Errorf("FetchHostKeyError")}},
+			expErr:  fmt.Errorf("FetchHostKeyError"),
+		},
+		{
+			name:       "FetchHostKeySuccess",
+			args:       []string{"foo"},
+			servers:    map[string]ServerMock{"foo": {hostKey: hostKey}},
+			expErr:     nil,
+			expPrinted: "SHA256:e9sytYWYZsM6iQsCc50+4HAahQYm/XyBf3Cb1/4LvPg\n" + authorizedKey + "\n",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			origStdout := os.Stdout
+
+			r, w, setupErr := os.Pipe()
+			if setupErr != nil {
+				t.Fatalf("FAILED: %s\ncouldn't create pipe", testCase.name)
+			}
+			os.Stdout = w
+
+			servers = make(map[string]remote.ServerInterface)
+			for key, val := range testCase.servers {
+				servers[key] = val
+			}
+			err := fingerprint(&cobra.Command{}, testCase.args)
+			w.Close()
+
+			printed, setupErr := io.ReadAll(r)
+			if setupErr != nil {
+				t.Fatalf("FAILED: %s\ncouldn't read from pipe", testCase.name)
+			}
+			r.Close()
+			os.Stdout = origStdout // restore original Stdout
+
+			if testCase.expErr != nil {
+				if err == nil {
+					t.Fatalf("FAILED: %s\nexpected error '%v', got '%v'", testCase.name, testCase.expErr, err)
+				}
+				return
+			}
+			if testCase.expErr == nil && err != nil {
+				t.Fatalf("FAILED: %s\nexpected error '%v', got '%v'", testCase.name, testCase.expErr, err)
+			}
+
+			if string(printed) != testCase.expPrinted {
+				t.Fatalf("FAILED: %s\nexpected printed message '%s', got '%s'", testCase.name, testCase.expPrinted, printed)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kantonop/tiramolla/pkg/remote"
+
+	"golang.org/x/term"
+)
+
+const (
+	// interval between redraws of the progress bar on terminals
+	barInterval = 100 * time.Millisecond
+	// interval between progress lines when not on a terminal
+	lineInterval = 5 * time.Second
+	// width of the bar, without the surrounding brackets
+	barWidth = 30
+)
+
+// progressReporter prints the progress of transfers to out
+// a live bar is drawn on terminals, lines are printed periodically otherwise
+type progressReporter struct {
+	out      io.Writer
+	tty      bool
+	interval time.Duration
+	last     time.Time
+}
+
+// constructs a progress reporter printing to out
+func newProgressReporter(out *os.File) *progressReporter {
+	tty := term.IsTerminal(int(out.Fd()))
+	interval := lineInterval
+	if tty {
+		interval = barInterval
+	}
+	return &progressReporter{out: out, tty: tty, interval: interval}
+}
+
+// report prints p, it is used as the progress function of transfers
+// the start and the completion of a transfer are always printed
+func (reporter *progressReporter) report(p remote.Progress) {
+	started := p.Transferred == p.Resumed
+	done := p.Transferred >= p.Total
+	if !started && !done && time.Since(reporter.last) < reporter.interval {
+		return
+	}
+	reporter.last = time.Now()
+
+	if !reporter.tty {
+		fmt.Fprintln(reporter.out, progressLine(p))
+		return
+	}
+	// redraw the bar in place, erasing the rest of the line
+	fmt.Fprintf(reporter.out, "\r%s\x1b[K", progressBar(p))
+	if done {
+		fmt.Fprintln(reporter.out)
+	}
+}
+
+// formats p as a line of text
+func progressLine(p remote.Progress) string {
+	return fmt.Sprintf("%s: %s / %s (%d%%), %s/s, ETA %s",
+		p.File, formatBytes(p.Transferred), formatBytes(p.Total), percent(p), formatBytes(int64(p.Rate())), formatETA(p))
+}
+
+// formats p as a progress bar
+func progressBar(p remote.Progress) string {
+	filled := percent(p) * barWidth / 100
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+	return fmt.Sprintf("%s [%s] %3d%% %s/%s %s/s ETA %s",
+		filepath.Base(p.File), bar, percent(p), formatBytes(p.Transferred), formatBytes(p.Total), formatBytes(int64(p.Rate())), formatETA(p))
+}
+
+// returns the percentage of p that is transferred
+func percent(p remote.Progress) int {
+	if p.Total <= 0 {
+		return 100
+	}
+	return int(p.Transferred * 100 / p.Total)
+}
+
+// formats the ETA of p, rounded to seconds
+func formatETA(p remote.Progress) string {
+	if p.Transferred >= p.Total {
+		return "0s"
+	}
+	eta := p.ETA()
+	if eta == 0 {
+		return "--"
+	}
+	return eta.Round(time.Second).String()
+}
+
+// formats n bytes in binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,120 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kantonop/tiramolla/pkg/remote"
+)
+
+func TestFormatBytes(t *testing.T) {
+	testCases := []struct {
+		name   string
+		n      int64
+		expOut string
+	}{
+		{name: "Bytes", n: 1023, expOut: "1023 B"},
+		{name: "KiB", n: 1536, expOut: "1.5 KiB"},
+		{name: "MiB", n: 27 * 1024 * 1024, expOut: "27.0 MiB"},
+		{name: "GiB", n: 3 * 1024 * 1024 * 1024, expOut: "3.0 GiB"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			out := formatBytes(testCase.n)
+			if testCase.expOut != out {
+				t.Fatalf("expected '%s', got '%s'", testCase.expOut, out)
+			}
+		})
+	}
+}
+
+func TestProgressFormat(t *testing.T) {
+	started := time.Now().Add(-10 * time.Second)
+	testCases := []struct {
+		name    string
+		p       remote.Progress
+		expLine string
+		expBar  string
+	}{
+		{
+			name:    "Started",
+			p:       remote.Progress{File: "/tmp/foo", Total: 2048, Started: time.Now()},
+			expLine: "/tmp/foo: 0 B / 2.0 KiB (0%), 0 B/s, ETA --",
+			expBar:  "foo [>                             ]   0% 0 B/2.0 KiB 0 B/s ETA --",
+		},
+		{
+			name:    "HalfWay",
+			p:       remote.Progress{File: "/tmp/foo", Transferred: 15 << 20, Total: 30 << 20, Started: started},
+			expLine: "/tmp/foo: 15.0 MiB / 30.0 MiB (50%), 1.5 MiB/s, ETA 10s",
+			expBar:  "foo [===============>              ]  50% 15.0 MiB/30.0 MiB 1.5 MiB/s ETA 10s",
+		},
+		{
+			name:    "Done",
+			p:       remote.Progress{File: "/tmp/foo", Transferred: 30 << 20, Total: 30 << 20, Started: started},
+			expLine: "/tmp/foo: 30.0 MiB / 30.0 MiB (100%), 3.0 MiB/s, ETA 0s",
+			expBar:  "foo [==============================] 100% 30.0 MiB/30.0 MiB 3.0 MiB/s ETA 0s",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			line := progressLine(testCase.p)
+			if testCase.expLine != line {
+				t.Fatalf("expected line '%s', got '%s'", testCase.expLine, line)
+			}
+			bar := progressBar(testCase.p)
+			if testCase.expBar != bar {
+				t.Fatalf("expected bar '%s', got '%s'", testCase.expBar, bar)
+			}
+		})
+	}
+}
+
+func TestProgressReport(t *testing.T) {
+	testCases := []struct {
+		name     string
+		tty      bool
+		expLines int
+		expOut   string
+	}{
+		// start and completion only, as updates come faster than the interval
+		{name: "Lines", tty: false, expLines: 2},
+		{name: "Bar", tty: true, expLines: 1, expOut: "\r"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var out bytes.Buffer
+			reporter := &progressReporter{out: &out, tty: testCase.tty, interval: time.Hour}
+			p := remote.Progress{File: "foo", Total: 100, Started: time.Now()}
+			for p.Transferred = 0; p.Transferred <= p.Total; p.Transferred += 10 {
+				reporter.report(p)
+			}
+
+			if lines := strings.Count(out.String(), "\n"); lines != testCase.expLines {
+				t.Fatalf("expected %d lines, got %d: '%s'", testCase.expLines, lines, out.String())
+			}
+			if !strings.Contains(out.String(), testCase.expOut) {
+				t.Fatalf("expected '%q' in output, got '%q'", testCase.expOut, out.String())
+			}
+		})
+	}
+}
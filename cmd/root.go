@@ -16,7 +16,14 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 
 	"github.com/kantonop/tiramolla/pkg/remote"
 
@@ -25,11 +32,18 @@ import (
 )
 
 type config struct {
-	Servers []remote.Server
+	Servers         []remote.Server
+	ImportSSHConfig bool   `mapstructure:"import_ssh_config"`
+	SSHConfig       string `mapstructure:"ssh_config"`
 }
 
+const defaultSSHConfig = ".ssh/config"
+
 var servers map[string]remote.ServerInterface
 
+// problems found in the configuration when loading it
+var configProblems []error
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "tiramolla",
@@ -39,13 +53,30 @@ var rootCmd = &cobra.Command{
 		// PersistentPreRun runs after args validation
 		// if an error occurs after args validation, don't show usage
 		cmd.SilenceUsage = true
+
+		// config validate reports the problems itself,
+		// the command starting a multiplexer has already reported them
+		if cmd != configValidateCmd && cmd != connectionsServeCmd {
+			for _, problem := range configProblems {
+				fmt.Fprintf(os.Stderr, "warning: %v\n", problem)
+			}
+		}
 	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// The context of the commands is done on SIGINT or SIGTERM, so that they stop and clean up,
+// a second signal terminates the process immediately.
 func Execute() {
-	err := rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := rootCmd.ExecuteContext(ctx)
 	if err != nil {
 		os.Exit(1)
 	}
@@ -74,7 +105,68 @@ func initConfig() {
 	conf := &config{}
 	err = viper.Unmarshal(conf)
 	cobra.CheckErr(err)
-	servers = serverListToMap(conf.Servers)
+	// servers of the OpenSSH client configuration come first
+	// so servers in the yaml file with the same name override them
+	serverList := conf.Servers
+	if conf.ImportSSHConfig || conf.SSHConfig != "" {
+		sshConfigServers, err := importSSHConfig(home, conf.SSHConfig)
+		cobra.CheckErr(err)
+		serverList = append(sshConfigServers, serverList...)
+	}
+
+	servers = serverListToMap(serverList)
+	configProblems = validateConfig(conf.Servers, servers)
+}
+
+// importSSHConfig reads the servers of the OpenSSH client configuration
+// sshConfig defaults to ~/.ssh/config if not set
+func importSSHConfig(home, sshConfig string) ([]remote.Server, error) {
+	if sshConfig == "" {
+		sshConfig = filepath.Join(home, defaultSSHConfig)
+	}
+	if sshConfig == "~" || strings.HasPrefix(sshConfig, "~/") {
+		sshConfig = filepath.Join(home, strings.TrimPrefix(sshConfig, "~"))
+	}
+
+	file, err := os.Open(sshConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error opening ssh config: %v", err)
+	}
+	defer file.Close()
+
+	sshConfigServers, err := remote.ServersFromSSHConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("error importing ssh config %s: %v", sshConfig, err)
+	}
+	return sshConfigServers, nil
+}
+
+// validateConfig checks the configured servers, servers of the yaml file in serverList and all servers by name
+// returns an error for every problem found
+// servers of the yaml file override those of the OpenSSH client configuration with the same name, but not each other
+func validateConfig(serverList []remote.Server, servers map[string]remote.ServerInterface) []error {
+	var errs []error
+
+	count := make(map[string]int)
+	for _, server := range serverList {
+		count[server.Name]++
+		if count[server.Name] == 2 {
+			errs = append(errs, fmt.Errorf("server %s is configured more than once", server.Name))
+		}
+	}
+
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if server, ok := servers[name].(*remote.Server); ok {
+			errs = append(errs, server.Validate()...)
+		}
+	}
+
+	return append(errs, remote.ValidateGateways(servers)...)
 }
 
 // serverListToMap constructs a map of server interfaces with their name as key
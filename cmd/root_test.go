@@ -21,6 +21,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/kantonop/tiramolla/pkg/remote"
 )
@@ -29,6 +30,7 @@ func TestInitConfig(t *testing.T) {
 	testCases := []struct {
 		name       string
 		config     string
+		sshConfig  string
 		expServers map[string]remote.Server
 	}{
 		{
@@ -46,6 +48,29 @@ func TestInitConfig(t *testing.T) {
 				"bar": {Name: "bar", Addr: "2.2.2.2"},
 			},
 		},
+		{
+			name:   "Multiplex",
+			config: "servers:\n  - name: foo\n    addr: 1.1.1.1\n    multiplex: true\n    multiplex_idle_timeout: 90s",
+			expServers: map[string]remote.Server{
+				"foo": {Name: "foo", Addr: "1.1.1.1", Multiplex: true, MultiplexIdleTimeout: 90 * time.Second},
+			},
+		},
+		{
+			name:   "TimeoutAndKeepalives",
+			config: "servers:\n  - name: foo\n    addr: 1.1.1.1\n    connect_timeout: 10s\n    keepalive_interval: 30s\n    keepalive_count_max: 5",
+			expServers: map[string]remote.Server{
+				"foo": {Name: "foo", Addr: "1.1.1.1", ConnectTimeout: 10 * time.Second, KeepaliveInterval: 30 * time.Second, KeepaliveCountMax: 5},
+			},
+		},
+		{
+			name:      "ImportSSHConfig",
+			config:    "servers:\n  - name: foo\n    addr: 1.1.1.1\n    gateway: bar",
+			sshConfig: "Host foo\n  HostName 3.3.3.3\nHost bar\n  HostName 2.2.2.2\n  User kantonop\n",
+			expServers: map[string]remote.Server{
+				"foo": {Name: "foo", Addr: "1.1.1.1", Gateway: "bar"},
+				"bar": {Name: "bar", Addr: "2.2.2.2", User: "kantonop", AuthenticationMethod: "agent"},
+			},
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -55,8 +80,17 @@ func TestInitConfig(t *testing.T) {
 			if err != nil {
 				t.Fatalf("error getting home directory: %v", err)
 			}
+			config := testCase.config
+			if testCase.sshConfig != "" {
+				sshConfig := filepath.Join(t.TempDir(), "config")
+				err = os.WriteFile(sshConfig, []byte(testCase.sshConfig), 0600)
+				if err != nil {
+					t.Fatalf("error creating test ssh config file: %v", err)
+				}
+				config += "\nssh_config: " + sshConfig
+			}
 			filename := filepath.Join(home, ".tiramolla.yaml")
-			err, cleanup := testFileCreator(testCase.config, filename)
+			err, cleanup := testFileCreator(config, filename)
 			if err != nil {
 				t.Fatalf("error creating test config file: %v", err)
 			}
@@ -0,0 +1,309 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// methods to switch to BecomeUser
+// any other method is a template of the command, where {user} is replaced by BecomeUser
+// and {cmd} by the command to run, both quoted for the shell
+const (
+	BecomeMethodSudo   = "sudo"
+	BecomeMethodSu     = "su"
+	BecomeMethodSudoSu = "sudo-su"
+	BecomeMethodDoas   = "doas"
+	BecomeMethodPbrun  = "pbrun"
+	BecomeMethodDzdo   = "dzdo"
+	// default method
+	BecomeMethodDefault = BecomeMethodSudoSu
+)
+
+const (
+	// prompt set for sudo and dzdo, so that it is recognized regardless of the locale
+	becomePrompt = "[tiramolla] become password: "
+	// printed before the output of a command run as BecomeUser,
+	// so that banners of login shells and password prompts are not mistaken for it
+	becomeOutputMarker = "--- tiramolla become output ---"
+)
+
+var (
+	// matches the prompt set for sudo and dzdo
+	becomePromptRe = regexp.MustCompile(regexp.QuoteMeta(becomePrompt) + `$`)
+	// matches the password prompts of other methods, e.g. "Password: " and "doas (user@host) password: "
+	passwordPromptRe = regexp.MustCompile(`(?i)password[^:\n]*:\s*$`)
+)
+
+// returns the command running cmd as BecomeUser with BecomeMethod
+// along with the password prompt to expect if BecomePass is set
+// without BecomePass, methods that can be run non-interactively are, so that they fail instead of waiting for a password
+// if stdinPass is set, BecomePass is read from standard input instead of a terminal,
+// which only sudo and dzdo support
+func (server Server) becomeCommand(cmd string, stdinPass bool) (string, *regexp.Regexp, error) {
+	user, quotedCmd := shellQuote(server.BecomeUser), shellQuote(cmd)
+	sudoFlags := "-n"
+	if server.BecomePass != "" {
+		sudoFlags = "-p " + shellQuote(becomePrompt)
+		if stdinPass {
+			sudoFlags = "-S " + sudoFlags
+		}
+	}
+	if stdinPass && server.BecomePass != "" {
+		switch server.BecomeMethod {
+		case "", BecomeMethodSudoSu, BecomeMethodSudo, BecomeMethodDzdo:
+		default:
+			return "", nil, fmt.Errorf("become method %s of server %s cannot read become_pass without a terminal, use %s, %s or %s",
+				server.BecomeMethod, server.Name, BecomeMethodSudoSu, BecomeMethodSudo, BecomeMethodDzdo)
+		}
+	}
+	doasFlags := "-n "
+	if server.BecomePass != "" {
+		doasFlags = ""
+	}
+
+	switch method := server.BecomeMethod; method {
+	case "", BecomeMethodSudoSu:
+		return fmt.Sprintf("sudo %s su - %s -c %s", sudoFlags, user, quotedCmd), becomePromptRe, nil
+	case BecomeMethodSudo:
+		return fmt.Sprintf("sudo %s -u %s -- sh -c %s", sudoFlags, user, quotedCmd), becomePromptRe, nil
+	case BecomeMethodDzdo:
+		return fmt.Sprintf("dzdo %s -u %s -- sh -c %s", sudoFlags, user, quotedCmd), becomePromptRe, nil
+	case BecomeMethodSu:
+		return fmt.Sprintf("su - %s -c %s", user, quotedCmd), passwordPromptRe, nil
+	case BecomeMethodDoas:
+		return fmt.Sprintf("doas %s-u %s sh -c %s", doasFlags, user, quotedCmd), passwordPromptRe, nil
+	case BecomeMethodPbrun:
+		return fmt.Sprintf("pbrun -u %s sh -c %s", user, quotedCmd), passwordPromptRe, nil
+	default:
+		if !strings.Contains(method, "{cmd}") {
+			return "", nil, fmt.Errorf("unknown become method %s of server %s, should be one of %s, %s, %s, %s, %s, %s or a template with {cmd}",
+				method, server.Name, BecomeMethodSudo, BecomeMethodSu, BecomeMethodSudoSu, BecomeMethodDoas, BecomeMethodPbrun, BecomeMethodDzdo)
+		}
+		replacer := strings.NewReplacer("{user}", user, "{cmd}", quotedCmd)
+		return replacer.Replace(method), passwordPromptRe, nil
+	}
+}
+
+// run cmd on Server and return its output
+// switch user to BecomeUser if set to run it
+// cmd is run by a shell, so any paths in it have to be quoted with shellQuote
+// errors include the standard error of the command
+func (server Server) runCommand(cmd string) ([]byte, error) {
+	if server.BecomeUser == "" {
+		return server.runSession(cmd)
+	}
+
+	becomeCmd, prompt, err := server.becomeCommand(fmt.Sprintf("printf '%%s\\n' %s; %s", shellQuote(becomeOutputMarker), cmd), false)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	if server.BecomePass != "" {
+		out, err = server.runWithPassword(becomeCmd, prompt)
+	} else {
+		out, err = server.runSession(becomeCmd)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error running command as %s: %v", server.BecomeUser, err)
+	}
+
+	// skip anything printed before the command, e.g. by a login shell
+	i := bytes.Index(out, []byte(becomeOutputMarker+"\n"))
+	if i < 0 {
+		return nil, fmt.Errorf("error running command as %s: no output from command", server.BecomeUser)
+	}
+	return out[i+len(becomeOutputMarker)+1:], nil
+}
+
+// run cmd in a new session and return its output
+// errors include the standard error of cmd
+func (server Server) runSession(cmd string) ([]byte, error) {
+	sess, err := server.client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("error spawning remote session: %v", err)
+	}
+	defer sess.Close()
+
+	var stdout, stderr bytes.Buffer
+	sess.Stdout = &stdout
+	sess.Stderr = &stderr
+	err = sess.Run(cmd)
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// run cmd in a new session with a PTY, answering the password prompt with BecomePass
+// some methods read the password from the terminal only and sudo may be configured to require one
+// the output of the PTY combines standard output and error and ends lines with \r\n, which are converted to \n
+func (server Server) runWithPassword(cmd string, prompt *regexp.Regexp) ([]byte, error) {
+	sess, err := server.client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("error spawning remote session: %v", err)
+	}
+	defer sess.Close()
+
+	// the password is not echoed back
+	modes := ssh.TerminalModes{ssh.ECHO: 0, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+	err = sess.RequestPty("xterm", 40, 200, modes)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting pty: %v", err)
+	}
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	answerer := &promptAnswerer{
+		stdin:  stdin,
+		prompt: prompt,
+		pass:   fromEnv(server.BecomePass),
+		// closing the session stops a command asking for the password again
+		wrongPass: func() { sess.Close() },
+	}
+	sess.Stdout = answerer
+	sess.Stderr = answerer
+
+	err = sess.Run(cmd)
+	out := bytes.ReplaceAll(answerer.output(), []byte("\r\n"), []byte("\n"))
+	if answerer.rejected() {
+		return nil, fmt.Errorf("become_pass of server %s was rejected", server.Name)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// promptAnswerer collects the output of a command
+// and writes the password to its input the first time the output ends with the prompt
+// if the prompt is shown again, the password is considered wrong
+// the prompt is no longer looked for once becomeOutputMarker is seen, as the output of the command may end like one
+type promptAnswerer struct {
+	stdin     io.Writer
+	prompt    *regexp.Regexp
+	pass      string
+	wrongPass func()
+	// closed once the marker is seen, if it is printed on another stream
+	started <-chan struct{}
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	answered bool
+	wrong    bool
+	marked   bool
+	// start of the output not yet searched for the prompt
+	scanned int
+}
+
+func (answerer *promptAnswerer) Write(p []byte) (int, error) {
+	answerer.mu.Lock()
+	defer answerer.mu.Unlock()
+
+	answerer.buf.Write(p)
+	if answerer.wrong || answerer.commandStarted() {
+		return len(p), nil
+	}
+	loc := answerer.prompt.FindIndex(answerer.buf.Bytes()[answerer.scanned:])
+	if loc == nil {
+		return len(p), nil
+	}
+	if answerer.answered {
+		answerer.wrong = true
+		answerer.wrongPass()
+		return len(p), nil
+	}
+
+	// the prompt is dropped from the output
+	answerer.buf.Truncate(answerer.scanned + loc[0])
+	answerer.scanned = answerer.buf.Len()
+	answerer.answered = true
+	_, err := io.WriteString(answerer.stdin, answerer.pass+"\n")
+	if err != nil {
+		return 0, fmt.Errorf("error writing password: %v", err)
+	}
+	return len(p), nil
+}
+
+// reports whether becomeOutputMarker has been seen, in the output or on another stream
+// lines of the output end with \r\n if it is read from a PTY
+func (answerer *promptAnswerer) commandStarted() bool {
+	if answerer.marked {
+		return true
+	}
+	select {
+	case <-answerer.started:
+		answerer.marked = true
+	default:
+		out := answerer.buf.Bytes()
+		answerer.marked = bytes.Contains(out, []byte(becomeOutputMarker+"\n")) || bytes.Contains(out, []byte(becomeOutputMarker+"\r\n"))
+	}
+	return answerer.marked
+}
+
+// returns the output so far
+func (answerer *promptAnswerer) output() []byte {
+	answerer.mu.Lock()
+	defer answerer.mu.Unlock()
+	return append([]byte{}, answerer.buf.Bytes()...)
+}
+
+// reports whether the password was asked for again
+func (answerer *promptAnswerer) rejected() bool {
+	answerer.mu.Lock()
+	defer answerer.mu.Unlock()
+	return answerer.wrong
+}
+
+// copy file to destination
+// switch user to BecomeUser to do the copy
+// if preserve is set, modes, times and, if possible, owners are kept
+func (server Server) copyAsBecomeUser(file, dest string, recursive, preserve bool) error {
+	// copy file on the same server as the BecomeUser
+	cp := "cp"
+	if recursive {
+		cp += " -r"
+	}
+	if preserve {
+		cp += " -p"
+	}
+	_, err := server.runCommand(fmt.Sprintf("%s -- %s %s", cp, shellQuote(file), shellQuote(dest)))
+	if err != nil {
+		return fmt.Errorf("error copying %s to %s: %v", file, dest, err)
+	}
+	return nil
+}
+
+// remove path and its contents
+// switch user to BecomeUser to do the removal
+func (server Server) removeAsBecomeUser(path string) error {
+	_, err := server.runCommand(fmt.Sprintf("rm -rf -- %s", shellQuote(path)))
+	return err
+}
@@ -0,0 +1,271 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBecomeMethods(t *testing.T) {
+	testCases := []struct {
+		name       string
+		method     string
+		serverPass string
+		becomePass string
+		expErr     error
+		expErrText string
+	}{
+		{name: "Default", method: ""},
+		{name: "Sudo", method: BecomeMethodSudo},
+		{name: "SudoSu", method: BecomeMethodSudoSu},
+		{name: "Doas", method: BecomeMethodDoas},
+		{name: "Dzdo", method: BecomeMethodDzdo},
+		{name: "Template", method: "sudo -u {user} -i sh -c {cmd}"},
+		{name: "SudoPassword", method: BecomeMethodSudo, serverPass: "secret", becomePass: "secret"},
+		{name: "SudoSuPassword", method: BecomeMethodSudoSu, serverPass: "secret", becomePass: "secret"},
+		{name: "SuPassword", method: BecomeMethodSu, serverPass: "secret", becomePass: "secret"},
+		{name: "DoasPassword", method: BecomeMethodDoas, serverPass: "secret", becomePass: "secret"},
+		{name: "PbrunPassword", method: BecomeMethodPbrun, serverPass: "secret", becomePass: "secret"},
+		{name: "DzdoPassword", method: BecomeMethodDzdo, serverPass: "secret", becomePass: "secret"},
+		{name: "TemplatePassword", method: "su {user} -c {cmd}", serverPass: "secret", becomePass: "secret"},
+		{name: "PasswordWithSpecialCharacters", method: BecomeMethodSudo, serverPass: `p@ss w'rd"$`, becomePass: `p@ss w'rd"$`},
+		{
+			name:       "WrongPassword",
+			method:     BecomeMethodSudo,
+			serverPass: "secret",
+			becomePass: "wrong",
+			expErr:     fmt.Errorf("WrongPassword"),
+			expErrText: "rejected",
+		},
+		{
+			name:       "MissingPassword",
+			method:     BecomeMethodSudo,
+			serverPass: "secret",
+			expErr:     fmt.Errorf("MissingPassword"),
+			expErrText: "a password is required",
+		},
+		{
+			name:       "UnknownMethod",
+			method:     "runas",
+			expErr:     fmt.Errorf("UnknownMethod"),
+			expErrText: "unknown become method",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newBecomeTestServer(t, "app", testCase.serverPass)
+			server.BecomeMethod = testCase.method
+			server.BecomePass = testCase.becomePass
+
+			out, err := server.runCommand("echo foo; echo bar >&2")
+			if testCase.expErr != nil {
+				if err == nil {
+					t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+				}
+				if !strings.Contains(err.Error(), testCase.expErrText) {
+					t.Fatalf("expected error containing '%s', got '%v'", testCase.expErrText, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			// standard error is part of the output only with a pty
+			expOut := "foo\n"
+			if testCase.becomePass != "" {
+				expOut = "foo\nbar\n"
+			}
+			if string(out) != expOut {
+				t.Fatalf("expected output '%q', got '%q'", expOut, out)
+			}
+		})
+	}
+}
+
+func TestBecomeOutputLikePrompt(t *testing.T) {
+	for _, method := range []string{BecomeMethodSu, BecomeMethodDoas, BecomeMethodPbrun, "su {user} -c {cmd}"} {
+		t.Run(method, func(t *testing.T) {
+			server := newBecomeTestServer(t, "app", "secret")
+			server.BecomeMethod = method
+			server.BecomePass = "secret"
+
+			// output of the command that ends like a password prompt is neither answered nor taken for a rejection
+			out, err := server.runCommand("printf 'Enter password: '; sleep 0.2; echo done")
+			if err != nil {
+				t.Fatalf("expected error '<nil>', got '%v'", err)
+			}
+			expOut := "Enter password: done\n"
+			if string(out) != expOut {
+				t.Fatalf("expected output '%q', got '%q'", expOut, out)
+			}
+		})
+	}
+}
+
+func TestPromptAnswererStarted(t *testing.T) {
+	var stdin bytes.Buffer
+	started := make(chan struct{})
+	answerer := &promptAnswerer{stdin: &stdin, prompt: passwordPromptRe, pass: "secret", wrongPass: func() {}, started: started}
+
+	answerer.Write([]byte("Password: "))
+	if stdin.String() != "secret\n" {
+		t.Fatalf("expected password written, got '%q'", stdin.String())
+	}
+
+	// once the marker is seen on the other stream, the output is not searched for the prompt
+	close(started)
+	answerer.Write([]byte("\nold password: "))
+	if answerer.rejected() || stdin.String() != "secret\n" {
+		t.Fatalf("expected output after the marker to be ignored, got rejected %v and input '%q'", answerer.rejected(), stdin.String())
+	}
+}
+
+func TestBecomeCommandError(t *testing.T) {
+	server := newBecomeTestServer(t, "app", "secret")
+	server.BecomeMethod = BecomeMethodSudo
+
+	// errors of commands include their standard error
+	src := t.TempDir()
+	err := server.copyAsBecomeUser(filepath.Join(src, "missing.txt"), t.TempDir(), false, false)
+	if err == nil || !strings.Contains(err.Error(), "No such file or directory") {
+		t.Fatalf("expected error with standard error of cp, got '%v'", err)
+	}
+
+	// files are copied with the password asked
+	testTreeCreator(t, src, map[string]string{"foo.txt": "foo"})
+	dest := t.TempDir()
+	err = server.Upload(filepath.Join(src, "foo.txt"), dest, WithVerify(""))
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	testTreeChecker(t, dest, map[string]string{"foo.txt": "foo"})
+}
+
+func TestStageAsBecomeUser(t *testing.T) {
+	server := newBecomeTestServer(t, "app", "")
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("error getting working directory: %v", err)
+	}
+	src := t.TempDir()
+	testTreeCreator(t, src, map[string]string{"foo/bar.sh": "bar"})
+	for _, path := range []string{"foo/bar.sh", "foo"} {
+		err := os.Chmod(filepath.Join(src, path), 0777)
+		if err != nil {
+			t.Fatalf("error changing mode: %v", err)
+		}
+	}
+
+	// staged copies are in a private directory and never readable, writable or executable by others
+	staged, cleanup, err := server.stageAsBecomeUser(filepath.Join(src, "foo"), true)
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	if filepath.Base(staged) != "foo" || strings.HasPrefix(staged, wd) {
+		t.Fatalf("expected copy of foo in a temporary directory, got %s", staged)
+	}
+	// the group bits show the mask of the ACL entry of the main user, which is read only
+	expModes := map[string]os.FileMode{filepath.Dir(staged): 0750, staged: 0750, filepath.Join(staged, "bar.sh"): 0750}
+	for path, mode := range expModes {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("error reading staged file: %v", err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Fatalf("expected mode %v of %s, got %v", mode, path, info.Mode().Perm())
+		}
+	}
+
+	cleanup()
+	_, err = os.Stat(filepath.Dir(staged))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected staging directory to be removed, got '%v'", err)
+	}
+
+	// nothing is staged if the copy fails
+	_, _, err = server.stageAsBecomeUser(filepath.Join(src, "missing"), false)
+	if err == nil {
+		t.Fatalf("expected error copying missing file, got '%v'", err)
+	}
+}
+
+func TestGrantReadCommand(t *testing.T) {
+	dir := t.TempDir()
+	testTreeCreator(t, dir, map[string]string{"foo/bar.txt": "bar"})
+	err := os.Chmod(filepath.Join(dir, "foo"), 0700)
+	if err != nil {
+		t.Fatalf("error changing mode: %v", err)
+	}
+	err = os.Chmod(filepath.Join(dir, "foo", "bar.txt"), 0600)
+	if err != nil {
+		t.Fatalf("error changing mode: %v", err)
+	}
+
+	// without setfacl, access is not given through the group but the command fails
+	var stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", grantReadCommand("app", filepath.Join(dir, "foo")))
+	cmd.Env = []string{"PATH=" + t.TempDir()}
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err == nil {
+		t.Fatalf("expected error without setfacl, got '%v'", err)
+	}
+	expMsg := "an ACL (setfacl) is required to give app access to " + filepath.Join(dir, "foo")
+	if !strings.Contains(stderr.String(), expMsg) {
+		t.Fatalf("expected error output '%s', got '%s'", expMsg, stderr.String())
+	}
+	expModes := map[string]os.FileMode{"foo": 0700, "foo/bar.txt": 0600}
+	for path, mode := range expModes {
+		info, err := os.Stat(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatalf("error reading file: %v", err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Fatalf("expected mode %v of %s, got %v", mode, path, info.Mode().Perm())
+		}
+	}
+}
+
+func TestBecomeUserResume(t *testing.T) {
+	server := newBecomeTestServer(t, "app", "")
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("error getting working directory: %v", err)
+	}
+	src, dest := t.TempDir(), t.TempDir()
+	testTreeCreator(t, src, map[string]string{"foo.txt": "foobar"})
+	// partial file of a previous attempt
+	testTreeCreator(t, wd, map[string]string{resumeStagingDir + "/foo.txt": "foo"})
+
+	err = server.Upload(filepath.Join(src, "foo.txt"), dest, WithResume())
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	testTreeChecker(t, dest, map[string]string{"foo.txt": "foobar"})
+	// the staged file is removed once the upload completes
+	testTreeChecker(t, wd, map[string]string{resumeStagingDir + "/": ""})
+	_, err = os.Stat(filepath.Join(wd, resumeStagingDir, "foo.txt"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected staged file to be removed, got '%v'", err)
+	}
+}
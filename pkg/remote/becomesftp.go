@@ -0,0 +1,192 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// paths where sftp-server is commonly installed,
+// tried after the one of the sftp subsystem in the sshd configuration of the server
+var sftpServerPaths = []string{
+	"/usr/lib/openssh/sftp-server",
+	"/usr/libexec/openssh/sftp-server",
+	"/usr/lib/ssh/sftp-server",
+	"/usr/libexec/sftp-server",
+	"/usr/lib/sftp-server",
+}
+
+// reports whether the sftp sessions of Server are run as BecomeUser
+func (server Server) sftpAsBecomeUser() bool {
+	return server.BecomeUser != "" && server.BecomeTransfer == BecomeTransferSFTP
+}
+
+// runs cmd on Server as the user of its sftp sessions, BecomeUser if BecomeTransfer is sftp,
+// so that it has the same access to files as them
+func (server Server) runAsSFTPUser(cmd string) ([]byte, error) {
+	if server.sftpAsBecomeUser() {
+		return server.runCommand(cmd)
+	}
+	return server.runSession(cmd)
+}
+
+// opens an sftp session on Server
+// if BecomeTransfer is sftp, the sftp server is run as BecomeUser,
+// otherwise it is the sftp subsystem of the main user
+func (server Server) newSFTPClient() (*sftp.Client, error) {
+	if !server.sftpAsBecomeUser() {
+		client, err := server.newSubsystemSFTPClient()
+		if err != nil {
+			return nil, fmt.Errorf("error spawning sftp remote session: %v", err)
+		}
+		return client, nil
+	}
+
+	path := server.SFTPServer
+	if path == "" {
+		var err error
+		path, err = server.findSFTPServer()
+		if err != nil {
+			return nil, err
+		}
+	}
+	cmd, prompt, err := server.becomeCommand(fmt.Sprintf("printf '%%s\\n' %s; exec %s", shellQuote(becomeOutputMarker), shellQuote(path)), true)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := server.client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("error spawning remote session: %v", err)
+	}
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	started := make(chan struct{})
+	answerer := &promptAnswerer{
+		stdin:     stdin,
+		prompt:    prompt,
+		pass:      fromEnv(server.BecomePass),
+		wrongPass: func() { sess.Close() },
+		started:   started,
+	}
+	sess.Stderr = answerer
+	err = sess.Start(cmd)
+	if err != nil {
+		sess.Close()
+		return nil, fmt.Errorf("error running sftp server as %s: %v", server.BecomeUser, err)
+	}
+
+	// the sftp protocol starts once the become method is done with the password,
+	// which it reads from the same input
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == nil && line == becomeOutputMarker+"\n" {
+			close(started)
+			break
+		}
+		if err != nil {
+			sess.Close()
+			if answerer.rejected() {
+				return nil, fmt.Errorf("become_pass of server %s was rejected", server.Name)
+			}
+			if msg := strings.TrimSpace(string(answerer.output())); msg != "" {
+				return nil, fmt.Errorf("error running sftp server as %s: %s", server.BecomeUser, msg)
+			}
+			return nil, fmt.Errorf("error running sftp server as %s: %v", server.BecomeUser, err)
+		}
+	}
+
+	client, err := sftp.NewClientPipe(reader, &sessionPipe{WriteCloser: stdin, sess: sess})
+	if err != nil {
+		sess.Close()
+		return nil, fmt.Errorf("error spawning sftp session as %s: %v", server.BecomeUser, err)
+	}
+	return client, nil
+}
+
+// opens an sftp session on the sftp subsystem of Server
+// unlike with sftp.NewClient, closing the client closes the session too
+func (server Server) newSubsystemSFTPClient() (*sftp.Client, error) {
+	sess, err := server.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	err = sess.RequestSubsystem("sftp")
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	client, err := sftp.NewClientPipe(stdout, &sessionPipe{WriteCloser: stdin, sess: sess})
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// sessionPipe is the input of an sftp server run in sess
+// closing it closes the session too
+type sessionPipe struct {
+	io.WriteCloser
+	sess *ssh.Session
+}
+
+func (pipe *sessionPipe) Close() error {
+	err := pipe.WriteCloser.Close()
+	pipe.sess.Close()
+	return err
+}
+
+// returns the path of sftp-server on Server,
+// the one of the sftp subsystem in the sshd configuration or else the first of sftpServerPaths found
+func (server Server) findSFTPServer() (string, error) {
+	paths := make([]string, len(sftpServerPaths))
+	for i, path := range sftpServerPaths {
+		paths[i] = shellQuote(path)
+	}
+	cmd := fmt.Sprintf(`for p in $(awk 'tolower($1) == "subsystem" && $2 == "sftp" { print $3 }' /etc/ssh/sshd_config 2>/dev/null) %s; do `+
+		`if [ -x "$p" ]; then printf '%%s\n' "$p"; exit 0; fi; done; exit 1`, strings.Join(paths, " "))
+	out, err := server.runSession(cmd)
+	if err != nil {
+		return "", fmt.Errorf("sftp-server not found on server %s, set sftp_server", server.Name)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,260 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBecomeSFTP(t *testing.T) {
+	testCases := []struct {
+		name       string
+		method     string
+		becomePass string
+		upload     bool
+		files      map[string]string
+		source     string
+		opts       []CopyOption
+		expFiles   map[string]string
+		expErr     error
+		expErrText string
+	}{
+		{
+			name:     "DownloadFile",
+			files:    map[string]string{"foo.txt": "foo"},
+			source:   "foo.txt",
+			opts:     []CopyOption{WithVerify("")},
+			expFiles: map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:     "UploadFile",
+			upload:   true,
+			files:    map[string]string{"foo.txt": "foo"},
+			source:   "foo.txt",
+			opts:     []CopyOption{WithVerify("")},
+			expFiles: map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:     "DownloadDirectory",
+			files:    map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux", "foo/empty/": ""},
+			source:   "foo",
+			opts:     []CopyOption{WithRecursive()},
+			expFiles: map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux", "foo/empty/": ""},
+		},
+		{
+			name:     "UploadDirectory",
+			upload:   true,
+			files:    map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux", "foo/empty/": ""},
+			source:   "foo",
+			opts:     []CopyOption{WithRecursive()},
+			expFiles: map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux", "foo/empty/": ""},
+		},
+		{
+			name:       "DownloadWithPassword",
+			method:     BecomeMethodSudo,
+			becomePass: "secret",
+			files:      map[string]string{"foo.txt": "foo"},
+			source:     "foo.txt",
+			expFiles:   map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:       "UploadWithPassword",
+			method:     BecomeMethodDzdo,
+			becomePass: "secret",
+			upload:     true,
+			files:      map[string]string{"foo.txt": "foo"},
+			source:     "foo.txt",
+			expFiles:   map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:       "PasswordWithoutStdin",
+			method:     BecomeMethodDoas,
+			becomePass: "secret",
+			files:      map[string]string{"foo.txt": "foo"},
+			source:     "foo.txt",
+			expErr:     fmt.Errorf("PasswordWithoutStdin"),
+			expErrText: "without a terminal",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newBecomeTestServer(t, "app", testCase.becomePass)
+			server.BecomeMethod = testCase.method
+			server.BecomeTransfer = BecomeTransferSFTP
+			server.SFTPServer = testSFTPServer(t)
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatalf("error getting working directory: %v", err)
+			}
+			src, dest := t.TempDir(), t.TempDir()
+			testTreeCreator(t, src, testCase.files)
+
+			if testCase.upload {
+				err = server.Upload(filepath.Join(src, testCase.source), dest, testCase.opts...)
+			} else {
+				err = server.Download(filepath.Join(src, testCase.source), dest, testCase.opts...)
+			}
+			if testCase.expErr != nil {
+				if err == nil {
+					t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+				}
+				if !strings.Contains(err.Error(), testCase.expErrText) {
+					t.Fatalf("expected error containing '%s', got '%v'", testCase.expErrText, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			testTreeChecker(t, dest, testCase.expFiles)
+
+			// nothing is staged
+			entries, err := os.ReadDir(wd)
+			if err != nil {
+				t.Fatalf("error reading working directory: %v", err)
+			}
+			if len(entries) != 0 {
+				t.Fatalf("expected empty working directory, got %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestBecomeSFTPWrongPassword(t *testing.T) {
+	server := newBecomeTestServer(t, "app", "secret")
+	server.BecomeMethod = BecomeMethodSudo
+	server.BecomePass = "wrong"
+	server.BecomeTransfer = BecomeTransferSFTP
+	server.SFTPServer = testSFTPServer(t)
+
+	_, err := server.Glob("/*")
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("expected rejected password error, got '%v'", err)
+	}
+}
+
+func TestBecomeSFTPGlobAndCopyTo(t *testing.T) {
+	server := newBecomeTestServer(t, "app", "")
+	server.BecomeTransfer = BecomeTransferSFTP
+	server.SFTPServer = testSFTPServer(t)
+	src, dest := t.TempDir(), t.TempDir()
+	testTreeCreator(t, src, map[string]string{"foo.txt": "foo", "bar.txt": "bar", "qux.log": "qux"})
+
+	matches, err := server.Glob(filepath.Join(src, "*.txt"))
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	expMatches := []string{filepath.Join(src, "bar.txt"), filepath.Join(src, "foo.txt")}
+	if !reflect.DeepEqual(expMatches, matches) {
+		t.Fatalf("expected '%v', got '%v'", expMatches, matches)
+	}
+
+	err = server.CopyTo(filepath.Join(src, "foo.txt"), &server, dest, WithVerify(""))
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	testTreeChecker(t, dest, map[string]string{"foo.txt": "foo"})
+}
+
+func TestBecomeSFTPResume(t *testing.T) {
+	// head fails unless run as the become user, as if the partial files were only readable by it
+	head, err := exec.LookPath("head")
+	if err != nil {
+		t.Skip("head is not installed")
+	}
+	bin := t.TempDir()
+	err = os.WriteFile(filepath.Join(bin, "head"), []byte("#!/bin/sh\n[ -n \"$TEST_AS_BECOME_USER\" ] || { echo \"head: permission denied\" >&2; exit 1; }\nexec '"+head+"' \"$@\"\n"), 0755)
+	if err != nil {
+		t.Fatalf("error writing fake head: %v", err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	testCases := []struct {
+		name   string
+		upload bool
+	}{
+		{name: "Upload", upload: true},
+		{name: "Download"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newBecomeTestServer(t, "app", "")
+			server.BecomeTransfer = BecomeTransferSFTP
+			server.SFTPServer = testSFTPServer(t)
+			src, dest := t.TempDir(), t.TempDir()
+			content := strings.Repeat("foobar", 1000)
+			testTreeCreator(t, src, map[string]string{"foo.txt": content})
+			testTreeCreator(t, dest, map[string]string{"foo.txt": content[:1000]})
+
+			var reported []Progress
+			fn := func(p Progress) { reported = append(reported, p) }
+			file := filepath.Join(src, "foo.txt")
+			if testCase.upload {
+				err = server.Upload(file, dest, WithProgress(fn), WithResume())
+			} else {
+				err = server.Download(file, dest, WithProgress(fn), WithResume())
+			}
+			if err != nil {
+				t.Fatalf("expected error '<nil>', got '%v'", err)
+			}
+			testProgressChecker(t, reported, file, int64(len(content)), 1000)
+			testTreeChecker(t, dest, map[string]string{"foo.txt": content})
+		})
+	}
+}
+
+func TestFindSFTPServer(t *testing.T) {
+	server := newBecomeTestServer(t, "app", "")
+	server.BecomeTransfer = BecomeTransferSFTP
+	path := testSFTPServer(t)
+	defer func(paths []string) { sftpServerPaths = paths }(sftpServerPaths)
+	// the sftp subsystem of the sshd configuration of the test machine comes first
+	sshdConfig, _ := os.ReadFile("/etc/ssh/sshd_config")
+
+	// the first executable path is found
+	sftpServerPaths = []string{filepath.Join(t.TempDir(), "missing"), path}
+	found, err := server.findSFTPServer()
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	if found != path && !strings.Contains(string(sshdConfig), found) {
+		t.Fatalf("expected %s, got %s", path, found)
+	}
+
+	// the sftp server is found if not set
+	client, err := server.newSFTPClient()
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	client.Close()
+
+	if found != path {
+		return
+	}
+	sftpServerPaths = []string{filepath.Join(t.TempDir(), "missing")}
+	_, err = server.findSFTPServer()
+	if err == nil || !strings.Contains(err.Error(), "sftp_server") {
+		t.Fatalf("expected sftp-server not found error, got '%v'", err)
+	}
+}
@@ -16,158 +16,439 @@ limitations under the License.
 package remote
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
 )
 
 const DefaultPort = 22
 
 // Connect to server
-// connects to the server, hopping through all of the servers in the list starting from the last
+// connects to the server, hopping through all of the servers in the chain starting from the last,
+// the gateway farthest from the server
+// if Multiplex is set, attaches to the multiplexer of the server instead, starting it if it is not running
 func (server *Server) Connect() error {
-	serverChain := server.serverChain
-	// server is directly reachable
-	if len(serverChain) == 0 {
-		// connect and return
-		client, err := server.directConnect()
-		if err != nil {
-			return err
-		}
-
-		server.client = client
-		return nil
-	}
-
-	// connect to last Server in the list and pop
-	nextServer := serverChain[len(server.serverChain)-1]
-	serverChain = serverChain[:(len(server.serverChain) - 1)]
+	return server.ConnectContext(context.Background())
+}
 
-	client, err := nextServer.directConnect()
-	if err != nil {
+// ConnectContext connects to server like Connect
+// the dial and handshake of every hop, or attaching to and starting the multiplexer, are abandoned once ctx is done
+func (server *Server) ConnectContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
+	if server.Multiplex && server.hostKeyFetcher == nil && StartMux != nil {
+		return server.connectMux(ctx)
+	}
+	return server.connectChain(ctx)
+}
 
-	// check if there are servers in the jump chain
-	for len(serverChain) > 0 {
-		// pop the server last in the list
-		nextServer = serverChain[len(server.serverChain)-1]
-		server.serverChain = serverChain[:(len(server.serverChain) - 1)]
+// connects to the server through its chain of gateways
+// the clients of the gateways are taken from the pool, shared with other servers reached through them
+func (server *Server) connectChain(ctx context.Context) error {
+	var client *ssh.Client
+	lease := &gatewayLease{}
 
-		client, err = nextServer.hopConnect(client)
+	// each gateway is reached through the one before it, the first one directly
+	key := ""
+	for i := len(server.serverChain) - 1; i >= 0; i-- {
+		gateway := server.serverChain[i]
+		key += gateway.hopKey()
+		next, err := pool.acquire(ctx, key, lease, func() (*ssh.Client, error) {
+			return gateway.connectThrough(ctx, client)
+		})
 		if err != nil {
-			return err
+			lease.release()
+			return fmt.Errorf("error connecting to gateway %s: %v", gateway.Name, err)
 		}
+		client = next
 	}
 
-	// hop connect to target server
-	client, err = server.hopConnect(client)
+	client, err := server.connectThrough(ctx, client)
 	if err != nil {
+		lease.release()
 		return err
 	}
 
 	server.client = client
+	server.gateways = lease
 	return nil
 }
 
 // Closes the client
+// the clients of the gateways it was reached through are closed too, unless other servers still use them
 func (server Server) CloseClient() error {
 	if server.client == nil {
 		return fmt.Errorf("Client is not set up")
 	}
 
-	return server.client.Close()
+	err := server.client.Close()
+	if server.gateways != nil {
+		server.gateways.release()
+	}
+	return err
 }
 
-// connect to server directly
-func (server Server) directConnect() (*ssh.Client, error) {
-	port := DefaultPort
-	if server.Port != 0 {
-		port = server.Port
-	}
-	host := fmt.Sprintf("%s:%d", server.Addr, port)
-	clientCFG, err := server.constructClientCFG()
+// connect to server directly if prevClient is nil,
+// otherwise with a hop from the server prevClient is connected to
+// the dial and handshake are abandoned after ConnectTimeout, if set
+func (server Server) connectThrough(ctx context.Context, prevClient *ssh.Client) (*ssh.Client, error) {
+	host := server.hostAddr()
+	clientCFG, closeAuth, err := server.constructClientCFG()
 	if err != nil {
 		return nil, err
 	}
+	// the authentication methods are no longer needed once the handshake is over
+	defer closeAuth()
 
-	return ssh.Dial("tcp", host, clientCFG)
-}
+	hopCtx := ctx
+	if clientCFG.Timeout > 0 {
+		var cancel context.CancelFunc
+		hopCtx, cancel = context.WithTimeout(ctx, clientCFG.Timeout)
+		defer cancel()
+	}
 
-// connect to server with a hop from a server we already are connected
-func (server Server) hopConnect(prevClient *ssh.Client) (*ssh.Client, error) {
-	port := DefaultPort
-	if server.Port != 0 {
-		port = server.Port
+	var netConn net.Conn
+	if prevClient == nil {
+		var dialer net.Dialer
+		netConn, err = dialer.DialContext(hopCtx, "tcp", host)
+	} else {
+		netConn, err = dialThrough(hopCtx, prevClient, host)
+	}
+	var client *ssh.Client
+	if err == nil {
+		client, err = handshake(hopCtx, netConn, host, clientCFG)
 	}
-	host := fmt.Sprintf("%s:%d", server.Addr, port)
-	clientCFG, err := server.constructClientCFG()
 	if err != nil {
+		// the deadline of the hop is reported as such, rather than as the end of ctx
+		if ctx.Err() == nil && hopCtx.Err() != nil {
+			return nil, fmt.Errorf("timed out connecting to %s after %s", host, clientCFG.Timeout)
+		}
 		return nil, err
 	}
 
-	netConn, err := prevClient.Dial("tcp", host)
-	if err != nil {
-		return nil, err
+	if server.KeepaliveInterval > 0 {
+		go keepalive(client, server.KeepaliveInterval, server.keepaliveCountMax())
+	}
+	return client, nil
+}
+
+// dial host from the server client is connected to
+// the ssh client cannot cancel a dial, so it is left to finish in the background once ctx is done
+func dialThrough(ctx context.Context, client *ssh.Client, host string) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
 	}
+	result := make(chan dialResult, 1)
+	go func() {
+		conn, err := client.Dial("tcp", host)
+		result <- dialResult{conn, err}
+	}()
+
+	select {
+	case res := <-result:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-result; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// run the ssh handshake over netConn
+// netConn is closed if the handshake fails or ctx is done before it completes
+func handshake(ctx context.Context, netConn net.Conn, host string, clientCFG *ssh.ClientConfig) (*ssh.Client, error) {
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			netConn.Close()
+		case <-done:
+		}
+	}()
 
 	conn, chans, reqs, err := ssh.NewClientConn(netConn, host, clientCFG)
+	// once the watch is over, ctx being done no longer affects netConn
+	close(done)
+	<-watched
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if err == nil {
+			conn.Close()
+		}
+		netConn.Close()
+		return nil, ctxErr
+	}
 	if err != nil {
+		netConn.Close()
 		return nil, err
 	}
 
 	return ssh.NewClient(conn, chans, reqs), nil
 }
 
+// returns the address of server in host:port format, as dialed and checked against known_hosts
+func (server Server) hostAddr() string {
+	port := DefaultPort
+	if server.Port != 0 {
+		port = server.Port
+	}
+	return fmt.Sprintf("%s:%d", server.Addr, port)
+}
+
 // construct the client configuration for the ssh calls
-func (server Server) constructClientCFG() (*ssh.ClientConfig, error) {
-	authMethods, err := server.constructAuthMethod()
-	if err != nil {
-		return nil, err
+// closeAuth releases what the authentication methods hold open, e.g. the connection to ssh-agent,
+// and is called once the handshake is over
+func (server Server) constructClientCFG() (clientCFG *ssh.ClientConfig, closeAuth func(), err error) {
+	// no authentication takes place when only fetching the host key
+	var authMethods []ssh.AuthMethod
+	closeAuth = func() {}
+	if server.hostKeyFetcher == nil {
+		authMethods, closeAuth, err = server.constructAuthMethod()
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	// if username in yaml file starts with $
 	// look for env variable
-	user := server.User
-	re := regexp.MustCompile(`^\$`)
-	if re.MatchString(user) {
-		user = os.Getenv(strings.TrimPrefix(server.User, "$"))
+	user := fromEnv(server.User)
+
+	hostKeyCallback, err := server.hostKeyCallback()
+	if err != nil {
+		closeAuth()
+		return nil, nil, err
+	}
+
+	clientCFG = &ssh.ClientConfig{
+		User:              user,
+		Auth:              authMethods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: server.hostKeyAlgorithms(),
+		Timeout:           server.ConnectTimeout,
 	}
+	return clientCFG, closeAuth, nil
+}
 
-	clientCFG := ssh.ClientConfig{
-		User:            user,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+// constructs the authentication methods for the ClientConfig
+// multiple methods can be given separated by commas, they are tried in order
+// closeAuth closes the connections the methods hold open
+func (server Server) constructAuthMethod() (authMethods []ssh.AuthMethod, closeAuth func(), err error) {
+	var closers []io.Closer
+	closeAuth = func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
 	}
 
-	return &clientCFG, nil
+	for _, method := range strings.Split(server.AuthenticationMethod, ",") {
+		var authMethod ssh.AuthMethod
+		var closer io.Closer
+
+		switch strings.TrimSpace(method) {
+		case "password":
+			authMethod, err = server.passwordAuthMethod()
+		case "publickey":
+			authMethod, err = server.publicKeyAuthMethod()
+		case "agent":
+			authMethod, closer, err = server.agentAuthMethod()
+		case "keyboard-interactive":
+			authMethod, err = server.keyboardInteractiveAuthMethod()
+		default:
+			closeAuth()
+			return nil, nil, fmt.Errorf("authentication method %s is not supported", method)
+		}
+		if err != nil {
+			closeAuth()
+			return nil, nil, err
+		}
+		if closer != nil {
+			closers = append(closers, closer)
+		}
+		authMethods = append(authMethods, authMethod)
+	}
+	return authMethods, closeAuth, nil
 }
 
-// constructs the authentication method for the ClientConfig
-func (server Server) constructAuthMethod() ([]ssh.AuthMethod, error) {
-	var authMethods []ssh.AuthMethod
-	switch server.AuthenticationMethod {
-	case "password":
-		// if password in yaml file starts with $
-		// look for env variable
-		pass := server.Pass
-		re := regexp.MustCompile(`^\$`)
-		if re.MatchString(pass) {
-			pass = os.Getenv(strings.TrimPrefix(server.Pass, "$"))
+// constructs the password authentication method
+func (server Server) passwordAuthMethod() (ssh.AuthMethod, error) {
+	// if password in yaml file starts with $
+	// look for env variable
+	pass := fromEnv(server.Pass)
+	decodedPass, err := url.QueryUnescape(pass)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding password %s: %v", pass, err)
+	}
+	return ssh.Password(decodedPass), nil
+}
+
+// constructs the public key authentication method from the private key in KeyFile
+// OpenSSH, PEM and PKCS#8 encoded keys are supported, optionally protected by Passphrase
+func (server Server) publicKeyAuthMethod() (ssh.AuthMethod, error) {
+	if server.KeyFile == "" {
+		return nil, fmt.Errorf("key_file is required for publickey authentication")
+	}
+	keyFile, err := expandHome(fromEnv(server.KeyFile))
+	if err != nil {
+		return nil, err
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file %s: %v", keyFile, err)
+	}
+
+	var signer ssh.Signer
+	if server.Passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(fromEnv(server.Passphrase)))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("key file %s is encrypted, passphrase is required", keyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing key file %s: %v", keyFile, err)
+	}
+	return ssh.PublicKeys(signer), nil
+}
+
+// constructs the public key authentication method from the signers offered by ssh-agent
+// the agent is reached at AgentSocket if set, otherwise at SSH_AUTH_SOCK
+// the returned closer closes the connection to the agent
+func (server Server) agentAuthMethod() (ssh.AuthMethod, io.Closer, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if server.AgentSocket != "" {
+		var err error
+		socket, err = expandHome(fromEnv(server.AgentSocket))
+		if err != nil {
+			return nil, nil, err
 		}
+	}
+	if socket == "" {
+		return nil, nil, fmt.Errorf("agent authentication requires SSH_AUTH_SOCK or agent_socket to be set")
+	}
 
-		decodedPass, err := url.QueryUnescape(pass)
+	// the connection to the agent is kept open until the handshake is over,
+	// as the signing happens during the handshake
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to ssh-agent at %s: %v", socket, err)
+	}
+	return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), conn, nil
+}
+
+// constructs the keyboard-interactive authentication method
+// each question is answered by the first of the Challenges with a matching prompt,
+// questions with no matching challenge are asked on the terminal
+func (server Server) keyboardInteractiveAuthMethod() (ssh.AuthMethod, error) {
+	prompts := make([]*regexp.Regexp, len(server.Challenges))
+	for i, challenge := range server.Challenges {
+		re, err := regexp.Compile(challenge.Prompt)
 		if err != nil {
-			return nil, fmt.Errorf("error decoding password %s: %v", pass, err)
+			return nil, fmt.Errorf("error parsing challenge prompt %s: %v", challenge.Prompt, err)
 		}
-		authMethods = append(authMethods, ssh.Password(decodedPass))
-	default:
-		return nil, fmt.Errorf("authentication method %s is not supported", server.AuthenticationMethod)
+		prompts[i] = re
 	}
 
-	return authMethods, nil
+	challenge := func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			matched := false
+			for j, re := range prompts {
+				if !re.MatchString(question) {
+					continue
+				}
+				answer, err := server.Challenges[j].answer()
+				if err != nil {
+					return nil, err
+				}
+				answers[i] = answer
+				matched = true
+				break
+			}
+			if matched {
+				continue
+			}
+
+			// no configured answer, ask the user
+			if name != "" || instruction != "" {
+				fmt.Fprintln(os.Stderr, strings.TrimSpace(name+"\n"+instruction))
+				name, instruction = "", ""
+			}
+			answer, err := terminalPrompt(question, echos[i])
+			if err != nil {
+				return nil, fmt.Errorf("no answer for question '%s' of server %s: %v", question, server.Name, err)
+			}
+			answers[i] = answer
+		}
+		return answers, nil
+	}
+	return ssh.KeyboardInteractive(challenge), nil
+}
+
+// returns the answer to the challenge
+// a one-time password is generated if TOTPSeed is set
+func (challenge Challenge) answer() (string, error) {
+	if challenge.TOTPSeed != "" {
+		return totp(fromEnv(challenge.TOTPSeed), time.Now())
+	}
+	return fromEnv(challenge.Answer), nil
+}
+
+// asks question on the terminal and returns the answer of the user
+// input is hidden unless echo is set
+// it is a variable to allow replacing it in tests
+var terminalPrompt = func(question string, echo bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("stdin is not a terminal")
+	}
+
+	fmt.Fprint(os.Stderr, question)
+	if echo {
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		return strings.TrimRight(answer, "\r\n"), err
+	}
+	answer, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(answer), err
+}
+
+// returns the value of the environmental variable if value starts with $
+// otherwise value is returned as is
+func fromEnv(value string) string {
+	re := regexp.MustCompile(`^\$`)
+	if re.MatchString(value) {
+		return os.Getenv(strings.TrimPrefix(value, "$"))
+	}
+	return value
+}
+
+// expands a leading ~ in path to the home directory of the user
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting home directory: %v", err)
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~")), nil
 }
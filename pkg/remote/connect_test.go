@@ -16,9 +16,19 @@ limitations under the License.
 package remote
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 func TestConstructClientCFG(t *testing.T) {
@@ -55,7 +65,7 @@ func TestConstructClientCFG(t *testing.T) {
 				t.Setenv(strings.TrimPrefix(testCase.server.User, "$"), testCase.userInEnvVar)
 			}
 
-			out, err := testCase.server.constructClientCFG()
+			out, closeAuth, err := testCase.server.constructClientCFG()
 			if testCase.expErr != nil {
 				if err == nil {
 					t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
@@ -70,6 +80,7 @@ func TestConstructClientCFG(t *testing.T) {
 			if testCase.expUser != out.User {
 				t.Fatalf("expected username '%s', got '%s'", testCase.expUser, out.User)
 			}
+			closeAuth()
 
 		})
 	}
@@ -77,9 +88,11 @@ func TestConstructClientCFG(t *testing.T) {
 
 func TestConstructAuthMethod(t *testing.T) {
 	testCases := []struct {
-		name   string
-		server Server
-		expErr error
+		name       string
+		server     Server
+		env        map[string]string
+		expErr     error
+		expMethods int
 	}{
 		{
 			name:   "PasswordFromYaml",
@@ -106,15 +119,584 @@ func TestConstructAuthMethod(t *testing.T) {
 			server: Server{Name: "foo", AuthenticationMethod: "unknown"},
 			expErr: fmt.Errorf("UnknownAuthMethod"),
 		},
+		{
+			name:   "PublicKeyOpenSSH",
+			server: Server{Name: "foo", AuthenticationMethod: "publickey", KeyFile: "testdata/id_ed25519"},
+			expErr: nil,
+		},
+		{
+			name:   "PublicKeyPEM",
+			server: Server{Name: "foo", AuthenticationMethod: "publickey", KeyFile: "testdata/id_rsa_pem"},
+			expErr: nil,
+		},
+		{
+			name:   "PublicKeyPKCS8",
+			server: Server{Name: "foo", AuthenticationMethod: "publickey", KeyFile: "testdata/id_ecdsa_pkcs8"},
+			expErr: nil,
+		},
+		{
+			name:   "PublicKeyFromEnvVar",
+			server: Server{Name: "foo", AuthenticationMethod: "publickey", KeyFile: "$fooKeyFile"},
+			env:    map[string]string{"fooKeyFile": "testdata/id_ed25519"},
+			expErr: nil,
+		},
+		{
+			name:   "PublicKeyEncrypted",
+			server: Server{Name: "foo", AuthenticationMethod: "publickey", KeyFile: "testdata/id_ed25519_encrypted", Passphrase: "foo"},
+			expErr: nil,
+		},
+		{
+			name:   "PublicKeyPassphraseFromEnvVar",
+			server: Server{Name: "foo", AuthenticationMethod: "publickey", KeyFile: "testdata/id_ed25519_encrypted", Passphrase: "$fooPassphrase"},
+			env:    map[string]string{"fooPassphrase": "foo"},
+			expErr: nil,
+		},
+		{
+			name:   "PublicKeyWrongPassphrase",
+			server: Server{Name: "foo", AuthenticationMethod: "publickey", KeyFile: "testdata/id_ed25519_encrypted", Passphrase: "bar"},
+			expErr: fmt.Errorf("PublicKeyWrongPassphrase"),
+		},
+		{
+			name:   "PublicKeyMissingPassphrase",
+			server: Server{Name: "foo", AuthenticationMethod: "publickey", KeyFile: "testdata/id_ed25519_encrypted"},
+			expErr: fmt.Errorf("PublicKeyMissingPassphrase"),
+		},
+		{
+			name:   "PublicKeyMissingKeyFile",
+			server: Server{Name: "foo", AuthenticationMethod: "publickey"},
+			expErr: fmt.Errorf("PublicKeyMissingKeyFile"),
+		},
+		{
+			name:   "PublicKeyUnknownKeyFile",
+			server: Server{Name: "foo", AuthenticationMethod: "publickey", KeyFile: "testdata/unknown"},
+			expErr: fmt.Errorf("PublicKeyUnknownKeyFile"),
+		},
+		{
+			name:       "MultipleMethods",
+			server:     Server{Name: "foo", AuthenticationMethod: "publickey, password", KeyFile: "testdata/id_ed25519", Pass: "foo"},
+			expErr:     nil,
+			expMethods: 2,
+		},
+		{
+			name:   "MultipleMethodsOneUnknown",
+			server: Server{Name: "foo", AuthenticationMethod: "password,unknown", Pass: "foo"},
+			expErr: fmt.Errorf("MultipleMethodsOneUnknown"),
+		},
 	}
 
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
-			_, err := testCase.server.constructAuthMethod()
+			for key, val := range testCase.env {
+				t.Setenv(key, val)
+			}
+			out, closeAuth, err := testCase.server.constructAuthMethod()
 			if testCase.expErr != nil && err == nil ||
 				testCase.expErr == nil && err != nil {
 				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
 			}
+			if testCase.expMethods != 0 && testCase.expMethods != len(out) {
+				t.Fatalf("expected %d authentication methods, got %d", testCase.expMethods, len(out))
+			}
+			if err == nil {
+				closeAuth()
+			}
+		})
+	}
+}
+
+func TestAgentAuthMethod(t *testing.T) {
+	agentKey, err := testPrivateKey("testdata/id_ed25519")
+	if err != nil {
+		t.Fatalf("error reading test key: %v", err)
+	}
+	otherKey, err := testPrivateKey("testdata/id_rsa_pem")
+	if err != nil {
+		t.Fatalf("error reading test key: %v", err)
+	}
+	agentSigner, err := ssh.NewSignerFromKey(agentKey)
+	if err != nil {
+		t.Fatalf("error creating signer: %v", err)
+	}
+
+	testCases := []struct {
+		name        string
+		agentKeys   []interface{}
+		agentSocket string
+		authSock    string
+		expErr      error
+	}{
+		{
+			name:        "AgentSocketFromConfig",
+			agentKeys:   []interface{}{agentKey},
+			agentSocket: "agent",
+			expErr:      nil,
+		},
+		{
+			name:      "AgentSocketFromSSHAuthSock",
+			agentKeys: []interface{}{agentKey},
+			authSock:  "agent",
+			expErr:    nil,
+		},
+		{
+			name:        "AgentWithMultipleKeys",
+			agentKeys:   []interface{}{otherKey, agentKey},
+			agentSocket: "agent",
+			expErr:      nil,
+		},
+		{
+			name:        "AgentKeyNotAccepted",
+			agentKeys:   []interface{}{otherKey},
+			agentSocket: "agent",
+			expErr:      fmt.Errorf("AgentKeyNotAccepted"),
+		},
+		{
+			name:   "NoAgentSocket",
+			expErr: fmt.Errorf("NoAgentSocket"),
+		},
+		{
+			name:        "UnreachableAgent",
+			agentSocket: "testdata/unknown.sock",
+			expErr:      fmt.Errorf("UnreachableAgent"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := &ssh.ServerConfig{
+				PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+					if bytes.Equal(key.Marshal(), agentSigner.PublicKey().Marshal()) {
+						return nil, nil
+					}
+					return nil, fmt.Errorf("unknown public key")
+				},
+			}
+			server := newTestSSHServer(t, config)
+			server.Name = "foo"
+			server.User = "foo"
+			server.AuthenticationMethod = "agent"
+
+			socket := ""
+			agentStats := &testServerStats{}
+			if testCase.agentKeys != nil {
+				socket = testAgent(t, agentStats, testCase.agentKeys...)
+			}
+			server.AgentSocket = testCase.agentSocket
+			if testCase.agentSocket == "agent" {
+				server.AgentSocket = socket
+			}
+			t.Setenv("SSH_AUTH_SOCK", testCase.authSock)
+			if testCase.authSock == "agent" {
+				t.Setenv("SSH_AUTH_SOCK", socket)
+			}
+
+			err := server.Connect()
+			// the connection to the agent is closed once the handshake is over, whether it succeeded or not
+			testAgentClosed(t, agentStats)
+			if testCase.expErr != nil {
+				if err == nil {
+					t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			server.CloseClient()
+		})
+	}
+}
+
+// helper function to read a raw private key from file
+func testPrivateKey(filename string) (interface{}, error) {
+	key, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParseRawPrivateKey(key)
+}
+
+// helper function to serve an in-process ssh-agent holding the given keys
+// returns the path of the agent socket
+// the open connections to the agent are counted in stats
+func testAgent(t *testing.T, stats *testServerStats, keys ...interface{}) string {
+	t.Helper()
+
+	keyring := agent.NewKeyring()
+	for _, key := range keys {
+		err := keyring.Add(agent.AddedKey{PrivateKey: key})
+		if err != nil {
+			t.Fatalf("error adding key to agent: %v", err)
+		}
+	}
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("error listening on agent socket: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&stats.open, 1)
+			go func() {
+				defer atomic.AddInt32(&stats.open, -1)
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return socket
+}
+
+func TestKeyboardInteractiveAuthMethod(t *testing.T) {
+	seed := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	testCases := []struct {
+		name         string
+		challenges   []Challenge
+		env          map[string]string
+		promptAnswer string
+		promptErr    error
+		expErr       error
+	}{
+		{
+			name: "ChallengesFromYaml",
+			challenges: []Challenge{
+				{Prompt: "(?i)password", Answer: "s3cr3t"},
+				{Prompt: "(?i)verification code", TOTPSeed: seed},
+			},
+			expErr: nil,
+		},
+		{
+			name: "ChallengesFromEnvVar",
+			challenges: []Challenge{
+				{Prompt: "(?i)password", Answer: "$fooPass"},
+				{Prompt: "(?i)verification code", TOTPSeed: "$fooSeed"},
+			},
+			env:    map[string]string{"fooPass": "s3cr3t", "fooSeed": seed},
+			expErr: nil,
+		},
+		{
+			name: "AnswerFromPrompt",
+			challenges: []Challenge{
+				{Prompt: "(?i)verification code", TOTPSeed: seed},
+			},
+			promptAnswer: "s3cr3t",
+			expErr:       nil,
+		},
+		{
+			name: "NoAnswer",
+			challenges: []Challenge{
+				{Prompt: "(?i)password", Answer: "s3cr3t"},
+			},
+			promptErr: fmt.Errorf("stdin is not a terminal"),
+			expErr:    fmt.Errorf("NoAnswer"),
+		},
+		{
+			name: "WrongAnswer",
+			challenges: []Challenge{
+				{Prompt: "(?i)password", Answer: "foo"},
+				{Prompt: "(?i)verification code", TOTPSeed: seed},
+			},
+			expErr: fmt.Errorf("WrongAnswer"),
+		},
+		{
+			name: "InvalidPrompt",
+			challenges: []Challenge{
+				{Prompt: "\\d(+", Answer: "foo"},
+			},
+			expErr: fmt.Errorf("InvalidPrompt"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := &ssh.ServerConfig{
+				KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+					answers, err := client("", "", []string{"Password: ", "Verification code: "}, []bool{false, true})
+					if err != nil {
+						return nil, err
+					}
+					code, _ := totp(seed, time.Now())
+					prevCode, _ := totp(seed, time.Now().Add(-totpPeriod*time.Second))
+					if answers[0] != "s3cr3t" || (answers[1] != code && answers[1] != prevCode) {
+						return nil, fmt.Errorf("wrong answers")
+					}
+					return nil, nil
+				},
+			}
+			server := newTestSSHServer(t, config)
+			server.Name = "foo"
+			server.User = "foo"
+			server.AuthenticationMethod = "keyboard-interactive"
+			server.Challenges = testCase.challenges
+
+			for key, val := range testCase.env {
+				t.Setenv(key, val)
+			}
+			origPrompt := terminalPrompt
+			terminalPrompt = func(question string, echo bool) (string, error) {
+				return testCase.promptAnswer, testCase.promptErr
+			}
+			t.Cleanup(func() { terminalPrompt = origPrompt })
+
+			err := server.Connect()
+			if testCase.expErr != nil {
+				if err == nil {
+					t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			server.CloseClient()
+		})
+	}
+}
+
+func TestConnectChain(t *testing.T) {
+	testCases := []struct {
+		name        string
+		gateways    int
+		unreachable int
+		expErr      string
+	}{
+		{name: "Direct", gateways: 0, unreachable: -1},
+		{name: "OneGateway", gateways: 1, unreachable: -1},
+		{name: "TwoGateways", gateways: 2, unreachable: -1},
+		{name: "ThreeGateways", gateways: 3, unreachable: -1},
+		{name: "FiveGateways", gateways: 5, unreachable: -1},
+		{name: "UnreachableFirstGateway", gateways: 3, unreachable: 3, expErr: "gateway gw3"},
+		{name: "UnreachableMiddleGateway", gateways: 3, unreachable: 2, expErr: "gateway gw2"},
+		{name: "UnreachableLastGateway", gateways: 3, unreachable: 1, expErr: "gateway gw1"},
+		{name: "UnreachableServer", gateways: 3, unreachable: 0, expErr: "connection refused"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server, stats := newTestChain(t, testCase.gateways, testCase.unreachable)
+
+			err := server.Connect()
+			if testCase.expErr != "" {
+				if err == nil || !strings.Contains(err.Error(), testCase.expErr) {
+					t.Fatalf("expected error containing '%s', got '%v'", testCase.expErr, err)
+				}
+				// the gateways connected before the failure are closed
+				testChainClosed(t, stats)
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '<nil>', got '%v'", err)
+			}
+
+			out, err := server.runSession("echo ok")
+			if err != nil || string(out) != "ok\n" {
+				t.Fatalf("expected output 'ok', got '%s' with error '%v'", out, err)
+			}
+			// every hop is connected to once, and every gateway forwards once to the next hop
+			for i, stat := range stats {
+				if stat.openConns() != 1 {
+					t.Fatalf("expected 1 open connection to hop %d, got %d", i, stat.openConns())
+				}
+				expForwards := 1
+				if i == 0 {
+					expForwards = 0
+				}
+				if stat.forwarded() != expForwards {
+					t.Fatalf("expected %d forwards through hop %d, got %d", expForwards, i, stat.forwarded())
+				}
+			}
+
+			err = server.CloseClient()
+			if err != nil {
+				t.Fatalf("expected close error '<nil>', got '%v'", err)
+			}
+			testChainClosed(t, stats)
+		})
+	}
+}
+
+func TestConnectContext(t *testing.T) {
+	testCases := []struct {
+		name      string
+		gateways  int
+		cancelled bool
+		expErr    error
+	}{
+		{name: "Cancelled", gateways: 1, cancelled: true, expErr: context.Canceled},
+		{name: "DirectHandshake", gateways: 0, expErr: context.DeadlineExceeded},
+		{name: "GatewayHandshake", gateways: 2, expErr: context.DeadlineExceeded},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server, stats := newTestChain(t, testCase.gateways, -1)
+			// the server accepts connections but never speaks
+			server.Port = testSilentPort(t)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			if testCase.cancelled {
+				cancel()
+			}
+			start := time.Now()
+			err := server.ConnectContext(ctx)
+			if err == nil || !strings.Contains(err.Error(), testCase.expErr.Error()) {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("expected connect to stop at the deadline, took %s", elapsed)
+			}
+			testChainClosed(t, stats[1:])
+		})
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	testCases := []struct {
+		name     string
+		gateways int
+		silent   int
+		expErr   string
+	}{
+		{name: "Server", gateways: 0, silent: 0, expErr: "timed out connecting"},
+		{name: "ServerBehindGateways", gateways: 2, silent: 0, expErr: "timed out connecting"},
+		{name: "Gateway", gateways: 2, silent: 2, expErr: "error connecting to gateway gw2: timed out connecting"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server, stats := newTestChain(t, testCase.gateways, -1)
+			// the silent hop accepts connections but never speaks
+			hop := &server
+			if testCase.silent > 0 {
+				hop = &server.serverChain[testCase.silent-1]
+			}
+			hop.Port = testSilentPort(t)
+			hop.ConnectTimeout = 200 * time.Millisecond
+
+			start := time.Now()
+			err := server.Connect()
+			if err == nil || !strings.Contains(err.Error(), testCase.expErr) {
+				t.Fatalf("expected error containing '%s', got '%v'", testCase.expErr, err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("expected connect to time out, took %s", elapsed)
+			}
+			testChainClosed(t, stats)
 		})
 	}
 }
+
+// helper function to start a chain of in-process ssh servers, the server itself and the given number of gateways
+// hop i is reached through hop i+1, hop 0 being the server; hop unreachable, if not -1, is not listening
+// returns the server, with its chain of gateways created, and the stats of every hop
+func newTestChain(t *testing.T, gateways, unreachable int) (Server, []*testServerStats) {
+	t.Helper()
+
+	servers := make(map[string]ServerInterface)
+	stats := make([]*testServerStats, gateways+1)
+	var server Server
+	for i := 0; i <= gateways; i++ {
+		stats[i] = &testServerStats{}
+		hop := newTestSSHServerWithOptions(t, &ssh.ServerConfig{NoClientAuth: true}, testServerOptions{stats: stats[i]})
+		hop.Name = fmt.Sprintf("gw%d", i)
+		if i == 0 {
+			hop.Name = "foo"
+		}
+		if i < gateways {
+			hop.Gateway = fmt.Sprintf("gw%d", i+1)
+		}
+		hop.AuthenticationMethod = "password"
+		if i == unreachable {
+			hop.Port = testClosedPort(t)
+		}
+		servers[hop.Name] = &hop
+		if i == 0 {
+			server = hop
+		}
+	}
+
+	err := server.CreateServerChain(servers)
+	if err != nil {
+		t.Fatalf("error creating server chain: %v", err)
+	}
+	return server, stats
+}
+
+// helper function to return a local port nothing listens on
+func testClosedPort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return port
+}
+
+// helper function to check that no connection to the agent is left open
+func testAgentClosed(t *testing.T, stats *testServerStats) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for stats.openConns() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no open connection to the agent, got %d", stats.openConns())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// helper function to return a local port that accepts connections but never answers on them
+func testSilentPort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	var conns []net.Conn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// helper function to check that no connection to any hop of a chain is left open
+func testChainClosed(t *testing.T, stats []*testServerStats) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i, stat := range stats {
+		for stat.openConns() != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected no open connection to hop %d, got %d", i, stat.openConns())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -16,159 +16,696 @@ limitations under the License.
 package remote
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/pkg/sftp"
 )
 
-// Upload file to Server
-func (server Server) Upload(file, dest string) error {
+// CopyOption configures an Upload or a Download
+type CopyOption func(*copyOptions)
+
+type copyOptions struct {
+	// the copy stops once ctx is done
+	ctx       context.Context
+	recursive bool
+	resume    bool
+	progress  ProgressFunc
+	// checksum algorithm to verify copied files with, none if empty
+	verify   string
+	preserve bool
+}
+
+// where warnings about copies are written, such as resuming being impossible
+var warnings io.Writer = os.Stderr
+
+// time given to a copy stopped by its context to return once its sftp sessions are closed,
+// after which the connection to the server is closed as unresponsive
+var stopTimeout = 5 * time.Second
+
+// time given to removing the files left on a server by a copy stopped by its context,
+// as the connection to the server may be unresponsive by then
+var leftoverTimeout = 5 * time.Second
+
+// WithRecursive allows copying directories along with their contents
+func WithRecursive() CopyOption {
+	return func(options *copyOptions) {
+		options.recursive = true
+	}
+}
+
+// WithResume continues transfers from the end of partial destination files
+// instead of starting over
+func WithResume() CopyOption {
+	return func(options *copyOptions) {
+		options.resume = true
+	}
+}
+
+// constructs the options of a copy
+func newCopyOptions(ctx context.Context, opts []CopyOption) copyOptions {
+	options := copyOptions{ctx: ctx}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// Upload file or directory to Server
+func (server Server) Upload(file, dest string, opts ...CopyOption) error {
+	return server.UploadContext(context.Background(), file, dest, opts...)
+}
+
+// UploadContext uploads file or directory to Server like Upload
+// once ctx is done the upload stops, removing the partial file unless resuming, and any staged files
+// if the server does not respond by then, its connection is closed and the files left on it are named in the error
+func (server Server) UploadContext(ctx context.Context, file, dest string, opts ...CopyOption) error {
+	options := newCopyOptions(ctx, opts)
+	err := validateChecksum(options.verify)
+	if err != nil {
+		return err
+	}
+	streaming, err := server.streaming()
+	if err != nil {
+		return err
+	}
+
 	// open an SFTP session over an existing ssh connection.
-	sftp, err := sftp.NewClient(server.client)
+	sftp, err := server.newSFTPClient()
 	if err != nil {
-		return fmt.Errorf("error spawning sftp remote session: %v", err)
+		return err
 	}
 	defer sftp.Close()
+	stop := server.closeOnDone(ctx, sftp)
+	defer stop()
 
-	// open the source file
-	srcFile, err := os.Open(file)
+	// check the source
+	info, err := os.Stat(file)
 	if err != nil {
 		return fmt.Errorf("error opening source file: %v", err)
 	}
-	defer srcFile.Close()
+	if info.IsDir() && !options.recursive {
+		return fmt.Errorf("%s is a directory, recursive copy is required", file)
+	}
+
+	if streaming {
+		err = server.streamUpload(file, dest, info, options)
+	} else {
+		err = server.uploadOverSFTP(sftp, file, dest, info, options)
+	}
+	if err != nil {
+		return err
+	}
+
+	if options.verify != "" {
+		return server.verifyUpload(sftp, file, filepath.Join(dest, filepath.Base(file)), options.verify)
+	}
+	return nil
+}
+
+// upload file or directory to dest over sftp
+// if files of BecomeUser are staged, it is uploaded to a staging directory and copied from there to dest by BecomeUser
+func (server Server) uploadOverSFTP(client *sftp.Client, file, dest string, info os.FileInfo, options copyOptions) (err error) {
+	var metadata map[string]fileMetadata
+	if options.preserve {
+		metadata, err = localTreeMetadata(file)
+		if err != nil {
+			return err
+		}
+	}
 
 	// construct the file path at destination
-	// if BecomeUser is not set, prepend the destination path
-	// otherwise copy to WD to pick it up later
-	filename := filepath.Base(file)
-	if server.BecomeUser == "" {
-		filename = filepath.Join(dest, filename)
+	// if files of BecomeUser are staged, upload to a private staging directory to pick it up later
+	target := filepath.Join(dest, filepath.Base(file))
+	var staging string
+	if server.staging() {
+		staging, err = server.uploadStagingDir(client, options.resume)
+		if err != nil {
+			return err
+		}
+		// the staging directory is removed even if the upload fails,
+		// unless resuming, in which case a partial file is kept for the next attempt
+		if !options.resume {
+			defer func() {
+				err = withLeftover(err, server.removeOverSFTP(options.ctx, client, staging))
+			}()
+		}
+		target = filepath.Join(staging, filepath.Base(file))
 	}
 
-	// create the destination file
-	dstFile, err := sftp.Create(filename)
+	if info.IsDir() {
+		err = server.uploadDir(client, file, target, options)
+	} else {
+		err = server.uploadFile(client, file, target, options)
+	}
 	if err != nil {
-		return fmt.Errorf("error creating destination file: %v", err)
+		return err
+	}
+	// owners can only be set by root, any staged copy belongs to the main user
+	if options.preserve {
+		err = applyRemoteMetadata(client, filepath.Dir(target), metadata, !server.staging() && server.canChown())
+		if err != nil {
+			return err
+		}
 	}
-	defer dstFile.Close()
 
-	// write to file
-	_, err = dstFile.ReadFrom(srcFile)
+	// if files of BecomeUser are staged then the upload so far is an intermediate step
+	// copy the file to its final destination by becoming the BecomeUser
+	if server.staging() {
+		err = server.grantBecomeUser(staging)
+		if err != nil {
+			return err
+		}
+		err = server.copyAsBecomeUser(target, dest, info.IsDir(), options.preserve)
+		if err != nil {
+			return err
+		}
+		if options.preserve {
+			err = server.restoreAsBecomeUser(dest, metadata)
+			if err != nil {
+				return err
+			}
+		}
+		// when resuming, the staged file is kept until the upload completes
+		if options.resume {
+			return removeAll(client, target)
+		}
+	}
+	return nil
+}
+
+// Download file or directory from Server
+func (server Server) Download(file, dest string, opts ...CopyOption) error {
+	return server.DownloadContext(context.Background(), file, dest, opts...)
+}
+
+// DownloadContext downloads file or directory from Server like Download
+// once ctx is done the download stops, removing the partial file unless resuming, and any staged files
+// if the server does not respond by then, its connection is closed and the files left on it are named in the error
+func (server Server) DownloadContext(ctx context.Context, file, dest string, opts ...CopyOption) error {
+	options := newCopyOptions(ctx, opts)
+	err := validateChecksum(options.verify)
 	if err != nil {
-		return fmt.Errorf("error writing to file: %v", err)
+		return err
+	}
+	streaming, err := server.streaming()
+	if err != nil {
+		return err
 	}
 
-	// if BecomeUser is set then the upload so far is an intermediate step
-	// copy the file to its final destination by becoming the BecomeUser
-	if server.BecomeUser != "" {
-		// remove the file from its intermediate stop
-		defer sftp.Remove(filename)
+	// open an SFTP session over an existing ssh connection.
+	sftp, err := server.newSFTPClient()
+	if err != nil {
+		return err
+	}
+	defer sftp.Close()
+	stop := server.closeOnDone(ctx, sftp)
+	defer stop()
 
-		wd, err := sftp.Getwd()
+	if streaming {
+		err = server.streamDownload(file, dest, options)
+	} else {
+		err = server.downloadOverSFTP(sftp, file, dest, options)
+	}
+	if err != nil {
+		return err
+	}
+	// the metadata of the original file are set, rather than of any staged copy
+	if options.preserve {
+		metadata, err := server.sourceMetadata(sftp, file)
 		if err != nil {
-			return fmt.Errorf("error getting working directory: %v", err)
+			return err
 		}
-
-		err = server.copyAsBecomeUser(filepath.Join(wd, filename), dest, false)
+		err = applyLocalMetadata(dest, metadata)
 		if err != nil {
 			return err
 		}
 	}
 
+	// the original file is verified, rather than any staged copy
+	if options.verify != "" {
+		return server.verifyDownload(sftp, file, filepath.Join(dest, filepath.Base(file)), options.verify)
+	}
 	return nil
 }
 
-// Download file to Server
-func (server Server) Download(file, dest string) error {
-	filename := filepath.Base(file)
+// download file or directory to dest over sftp
+// if files of BecomeUser are staged, it is first copied by BecomeUser to a staging directory and downloaded from there
+func (server Server) downloadOverSFTP(client *sftp.Client, file, dest string, options copyOptions) (err error) {
+	target := filepath.Join(dest, filepath.Base(file))
+
+	// if files of BecomeUser are staged, next steps are:
+	// 1. switch user and copy to a private staging directory readable by the main user
+	// 2. proceed with downloading from that path
+	if server.staging() {
+		var staged string
+		var cleanup func() error
+		staged, cleanup, err = server.stageAsBecomeUser(file, options.recursive)
+		if err != nil {
+			return err
+		}
+		// the staged copy belongs to BecomeUser, so it is removed by becoming the BecomeUser
+		defer func() {
+			err = withLeftover(err, server.removeLeftover(options.ctx, filepath.Dir(staged), cleanup))
+		}()
+		file = staged
+	}
+
+	// check the source
+	info, err := client.Stat(file)
+	if err != nil {
+		return fmt.Errorf("error opening source file: %v", err)
+	}
+	if info.IsDir() && !options.recursive {
+		return fmt.Errorf("%s is a directory, recursive copy is required", file)
+	}
+
+	if info.IsDir() {
+		return server.downloadDir(client, file, target, options)
+	}
+	return server.downloadFile(client, file, target, options)
+}
+
+// Glob returns the paths of the files on Server matching pattern
+// if BecomeUser is set, the pattern is expanded by the shell of BecomeUser,
+// as the main user may not have access to the files, unless the sftp sessions run as BecomeUser
+func (server Server) Glob(pattern string) ([]string, error) {
+	if server.BecomeUser != "" && !server.sftpAsBecomeUser() {
+		cmd := fmt.Sprintf(`for f in %s; do if [ -e "$f" ]; then printf "%%s\n" "$f"; fi; done`, shellQuoteGlob(pattern))
+		out, err := server.runCommand(cmd)
+		if err != nil {
+			return nil, fmt.Errorf("error expanding %s as %s: %v", pattern, server.BecomeUser, err)
+		}
+		var matches []string
+		for _, match := range strings.Split(string(out), "\n") {
+			if match != "" {
+				matches = append(matches, match)
+			}
+		}
+		sort.Strings(matches)
+		return matches, nil
+	}
 
 	// open an SFTP session over an existing ssh connection.
-	sftp, err := sftp.NewClient(server.client)
+	sftp, err := server.newSFTPClient()
 	if err != nil {
-		return fmt.Errorf("error spawning sftp remote session: %v", err)
+		return nil, err
 	}
 	defer sftp.Close()
 
-	// if BecomeUser is set, next steps are:
-	// 1. switch user and copy to the working directory of the main user
-	// 2. proceed with downloading from that path
-	if server.BecomeUser != "" {
-		wd, err := sftp.Getwd()
+	matches, err := sftp.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("error expanding %s: %v", pattern, err)
+	}
+	// sorted like the expansion of a shell
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// upload a single file to dest
+func (server Server) uploadFile(client *sftp.Client, file, dest string, options copyOptions) error {
+	if err := options.ctx.Err(); err != nil {
+		return err
+	}
+
+	// open the source file
+	srcFile, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("error opening source file: %v", err)
+	}
+	defer srcFile.Close()
+
+	// find where to continue a partial upload from
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	var offset int64
+	if options.resume {
+		offset, err = server.uploadOffset(client, srcFile, dest)
 		if err != nil {
-			return fmt.Errorf("error getting working directory: %v", err)
+			return err
+		}
+		if offset > 0 {
+			flags = os.O_WRONLY
+		}
+	}
+
+	// create the destination file
+	dstFile, err := client.OpenFile(dest, flags)
+	if err != nil {
+		return fmt.Errorf("error creating destination file: %v", err)
+	}
+	defer dstFile.Close()
+
+	// write to file
+	_, err = srcFile.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("error seeking source file: %v", err)
+	}
+	_, err = dstFile.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("error seeking destination file: %v", err)
+	}
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading source file: %v", err)
+	}
+	tracker := newProgressTracker(options.progress, file, srcInfo.Size(), offset)
+	// Size allows the destination to be written concurrently
+	src := &progressReader{ctx: options.ctx, reader: srcFile, size: srcInfo.Size() - offset, tracker: tracker}
+	_, err = dstFile.ReadFrom(src)
+	if err != nil {
+		// once ctx is done, the sftp session is closed and its error is not the cause
+		if ctxErr := options.ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		err = fmt.Errorf("error writing to file: %v", err)
+		if options.ctx.Err() != nil && !options.resume {
+			err = withLeftover(err, server.removeOverSFTP(options.ctx, client, dest))
 		}
+		return err
+	}
+	return nil
+}
+
+// returns the offset to resume uploading srcFile to dest from
+func (server Server) uploadOffset(client *sftp.Client, srcFile *os.File, dest string) (int64, error) {
+	dstFile, err := client.Open(dest)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error opening destination file: %v", err)
+	}
+	defer dstFile.Close()
+
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error reading source file: %v", err)
+	}
+	dstInfo, err := dstFile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error reading destination file: %v", err)
+	}
+	return resumeOffset(localPrefixChecksum(srcFile), remotePrefixChecksum(server.runAsSFTPUser, dest), srcInfo.Size(), dstInfo.Size()), nil
+}
 
-		err = server.copyAsBecomeUser(file, wd, true)
+// upload the directory tree rooted at dir to dest, keeping its structure
+// symbolic links and special files are skipped
+func (server Server) uploadDir(client *sftp.Client, dir, dest string, options copyOptions) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking source directory: %v", err)
+		}
+		rel, err := filepath.Rel(dir, path)
 		if err != nil {
 			return err
 		}
+		target := client.Join(dest, filepath.ToSlash(rel))
 
-		// the file is moved to main user WD, removing it as clean up
-		defer sftp.Remove(filename)
+		switch {
+		case entry.IsDir():
+			err = client.MkdirAll(target)
+			if err != nil {
+				return fmt.Errorf("error creating destination directory %s: %v", target, err)
+			}
+		case entry.Type().IsRegular():
+			return server.uploadFile(client, path, target, options)
+		}
+		return nil
+	})
+}
 
-		// the path is set to bare filename as the file resides in WD of main user
-		file = filename
+// download a single file to dest
+func (server Server) downloadFile(client *sftp.Client, file, dest string, options copyOptions) error {
+	if err := options.ctx.Err(); err != nil {
+		return err
 	}
 
 	// open the source file
-	srcFile, err := sftp.Open(file)
+	srcFile, err := client.Open(file)
 	if err != nil {
 		return fmt.Errorf("error opening source file: %v", err)
 	}
 	defer srcFile.Close()
 
+	// find where to continue a partial download from
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	var offset int64
+	if options.resume {
+		offset, err = server.downloadOffset(srcFile, file, dest)
+		if err != nil {
+			return err
+		}
+		if offset > 0 {
+			flags = os.O_WRONLY
+		}
+	}
+
 	// create the destination file
-	filename = filepath.Join(dest, filename)
-	dstFile, err := os.Create(filename)
+	dstFile, err := os.OpenFile(dest, flags, 0666)
 	if err != nil {
 		return fmt.Errorf("error creating destination file: %v", err)
 	}
 	defer dstFile.Close()
 
 	// write to file
-	_, err = dstFile.ReadFrom(srcFile)
+	_, err = srcFile.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("error seeking source file: %v", err)
+	}
+	_, err = dstFile.Seek(offset, io.SeekStart)
 	if err != nil {
+		return fmt.Errorf("error seeking destination file: %v", err)
+	}
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading source file: %v", err)
+	}
+	tracker := newProgressTracker(options.progress, file, srcInfo.Size(), offset)
+	dst := &progressWriter{ctx: options.ctx, writer: dstFile, tracker: tracker}
+	// the source is read concurrently as sftp.File implements io.WriterTo
+	_, err = io.Copy(dst, srcFile)
+	if err != nil {
+		// once ctx is done, the sftp session is closed and its error is not the cause
+		if ctxErr := options.ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		if options.ctx.Err() != nil && !options.resume {
+			dstFile.Close()
+			os.Remove(dest)
+		}
 		return fmt.Errorf("error writing to file: %v", err)
 	}
-
 	return nil
 }
 
-// copy file to destination
-// switch user to BecomeUser to do the copy
-func (server Server) copyAsBecomeUser(file, dest string, giveReadPerm bool) error {
-	// copy file on the same server as the BecomeUser
-	cmd := fmt.Sprintf("sudo su - %s -c 'cp %s %s'", server.BecomeUser, file, dest)
-	sess, err := server.client.NewSession()
+// returns the offset to resume downloading srcFile, opened from file, to dest from
+func (server Server) downloadOffset(srcFile *sftp.File, file, dest string) (int64, error) {
+	dstFile, err := os.Open(dest)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error opening destination file: %v", err)
+	}
+	defer dstFile.Close()
+
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error reading source file: %v", err)
+	}
+	dstInfo, err := dstFile.Stat()
 	if err != nil {
-		return fmt.Errorf("error spawning remote session: %v", err)
+		return 0, fmt.Errorf("error reading destination file: %v", err)
+	}
+	return resumeOffset(remotePrefixChecksum(server.runAsSFTPUser, file), localPrefixChecksum(dstFile), srcInfo.Size(), dstInfo.Size()), nil
+}
+
+// returns the offset to resume a transfer from src to a partial dst from
+// the checksums of the whole of dst and of the same prefix of src are compared,
+// each computed where the file is, so that the overlap is verified without transferring it
+// the transfer starts over if dst is larger than src, the checksums differ or either of them cannot be computed,
+// in which case a warning is written to warnings, as resuming was asked for
+func resumeOffset(src, dst prefixChecksum, srcSize, dstSize int64) int64 {
+	if dstSize == 0 || dstSize > srcSize {
+		return 0
 	}
-	defer sess.Close()
 
-	err = sess.Run(cmd)
+	srcSum, err := src(dstSize)
 	if err != nil {
-		return fmt.Errorf("error copying file to %s - make sure directory have execute permissions for 'all'", dest)
+		fmt.Fprintf(warnings, "warning: %v, starting over\n", err)
+		return 0
+	}
+	dstSum, err := dst(dstSize)
+	if err != nil {
+		fmt.Fprintf(warnings, "warning: %v, starting over\n", err)
+		return 0
+	}
+	if srcSum != dstSum {
+		return 0
+	}
+	return dstSize
+}
+
+// computes the hex encoded sha256 checksum of the first size bytes of a file
+type prefixChecksum func(size int64) (string, error)
+
+// returns the prefixChecksum of a local file
+func localPrefixChecksum(file io.ReaderAt) prefixChecksum {
+	return func(size int64) (string, error) {
+		sum := sha256.New()
+		_, err := io.Copy(sum, io.NewSectionReader(file, 0, size))
+		if err != nil {
+			return "", fmt.Errorf("error computing checksum of local file: %v", err)
+		}
+		return hex.EncodeToString(sum.Sum(nil)), nil
 	}
+}
 
-	// give read permissions to the file in destination
-	// required to allow downloading as the main user
-	if giveReadPerm {
-		filename := filepath.Base(file)
-		cmd = fmt.Sprintf("sudo su - %s -c 'chmod o+r %s/%s'", server.BecomeUser, dest, filename)
-		sess, err = server.client.NewSession()
+// returns the prefixChecksum of path on a server, computed by head and sha256sum run with run
+// the checksum cannot be computed on servers that only allow sftp
+// path is checked to be readable first, as the status of the pipeline is the one of sha256sum
+func remotePrefixChecksum(run func(cmd string) ([]byte, error), path string) prefixChecksum {
+	return func(size int64) (string, error) {
+		quoted := shellQuote(path)
+		out, err := run(fmt.Sprintf("test -r %s && head -c %d -- %s | sha256sum", quoted, size, quoted))
 		if err != nil {
-			return fmt.Errorf("error spawning remote session: %v", err)
+			return "", fmt.Errorf("error computing checksum of %s: %v", path, err)
+		}
+		fields := strings.Fields(string(out))
+		if len(fields) == 0 {
+			return "", fmt.Errorf("error computing checksum of %s: no output from sha256sum", path)
 		}
-		defer sess.Close()
+		return fields[0], nil
+	}
+}
 
-		err = sess.Run(cmd)
-		// we don't expect this command to fail as we were already able to copy the file
+// download the directory tree rooted at dir to dest, keeping its structure
+// symbolic links and special files are skipped
+func (server Server) downloadDir(client *sftp.Client, dir, dest string, options copyOptions) error {
+	walker := client.Walk(dir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return fmt.Errorf("error walking source directory: %v", err)
+		}
+		rel, err := filepath.Rel(dir, walker.Path())
 		if err != nil {
 			return err
 		}
-	}
+		target := filepath.Join(dest, rel)
 
+		switch info := walker.Stat(); {
+		case info.IsDir():
+			err = os.MkdirAll(target, 0755)
+			if err != nil {
+				return fmt.Errorf("error creating destination directory %s: %v", target, err)
+			}
+		case info.Mode().IsRegular():
+			err = server.downloadFile(client, walker.Path(), target, options)
+			if err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
+
+// closes client, an sftp client of Server, once ctx is done, so that transfers blocked on the server return
+// if the connection does not respond, closing the sftp session does not complete,
+// so the connection is closed too unless the returned function, which stops watching ctx, is called within stopTimeout
+func (server Server) closeOnDone(ctx context.Context, client io.Closer) func() {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+			return
+		}
+		go client.Close()
+		select {
+		case <-time.After(stopTimeout):
+			server.client.Close()
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+// removes path, left on Server by a copy, with remove once the copy is over
+// if ctx is done, the connection may be unresponsive, so remove is given up after leftoverTimeout
+// and the returned error reports path as left behind
+func (server Server) removeLeftover(ctx context.Context, path string, remove func() error) error {
+	if ctx.Err() == nil {
+		remove()
+		return nil
+	}
+	removed := make(chan error, 1)
+	go func() {
+		removed <- remove()
+	}()
+	select {
+	case err := <-removed:
+		if err == nil {
+			return nil
+		}
+	case <-time.After(leftoverTimeout):
+	}
+	return fmt.Errorf("%s is left on server %s", path, server.Name)
+}
+
+// removes path and its contents, left on Server by a copy over client, once the copy is over
+// if ctx is done, client is closed by then, so a new sftp session is used
+func (server Server) removeOverSFTP(ctx context.Context, client *sftp.Client, path string) error {
+	return server.removeLeftover(ctx, path, func() error {
+		if ctx.Err() == nil {
+			return removeAll(client, path)
+		}
+		client, err := server.newSFTPClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		return removeAll(client, path)
+	})
+}
+
+// adds leftErr, the error of removing the files left by a copy, to err, the error of the copy
+func withLeftover(err, leftErr error) error {
+	if leftErr == nil {
+		return err
+	}
+	if err == nil {
+		return leftErr
+	}
+	return fmt.Errorf("%v, %v", err, leftErr)
+}
+
+// remove path and, if it is a directory, its contents
+func removeAll(client *sftp.Client, path string) error {
+	info, err := client.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := client.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err = removeAll(client, client.Join(path, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+		return client.RemoveDirectory(path)
+	}
+	return client.Remove(path)
+}
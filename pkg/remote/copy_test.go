@@ -0,0 +1,626 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUpload(t *testing.T) {
+	testCases := []struct {
+		name      string
+		files     map[string]string
+		destFiles map[string]string
+		source    string
+		opts      []CopyOption
+		expFiles  map[string]string
+		expErr    error
+	}{
+		{
+			name:     "File",
+			files:    map[string]string{"foo.txt": "foo"},
+			source:   "foo.txt",
+			expFiles: map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:   "DirectoryNotRecursive",
+			files:  map[string]string{"foo/bar.txt": "bar"},
+			source: "foo",
+			expErr: fmt.Errorf("DirectoryNotRecursive"),
+		},
+		{
+			name:   "DirectoryRecursive",
+			files:  map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux", "foo/empty/": ""},
+			source: "foo",
+			opts:   []CopyOption{WithRecursive()},
+			expFiles: map[string]string{
+				"foo/bar.txt":      "bar",
+				"foo/qux/quux.txt": "quux",
+				"foo/empty/":       "",
+			},
+		},
+		{
+			name:     "FileRecursive",
+			files:    map[string]string{"foo.txt": "foo"},
+			source:   "foo.txt",
+			opts:     []CopyOption{WithRecursive()},
+			expFiles: map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:      "ResumePartialFile",
+			files:     map[string]string{"foo.txt": "foobar"},
+			destFiles: map[string]string{"foo.txt": "foo"},
+			source:    "foo.txt",
+			opts:      []CopyOption{WithResume()},
+			expFiles:  map[string]string{"foo.txt": "foobar"},
+		},
+		{
+			name:      "ResumeMismatchingFile",
+			files:     map[string]string{"foo.txt": "foobar"},
+			destFiles: map[string]string{"foo.txt": "bar"},
+			source:    "foo.txt",
+			opts:      []CopyOption{WithResume()},
+			expFiles:  map[string]string{"foo.txt": "foobar"},
+		},
+		{
+			name:      "ResumeLargerFile",
+			files:     map[string]string{"foo.txt": "foo"},
+			destFiles: map[string]string{"foo.txt": "foobar"},
+			source:    "foo.txt",
+			opts:      []CopyOption{WithResume()},
+			expFiles:  map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:      "ResumeDirectory",
+			files:     map[string]string{"foo/bar.txt": "bar", "foo/qux.txt": "qux"},
+			destFiles: map[string]string{"foo/bar.txt": "bar", "foo/qux.txt": "q"},
+			source:    "foo",
+			opts:      []CopyOption{WithRecursive(), WithResume()},
+			expFiles:  map[string]string{"foo/bar.txt": "bar", "foo/qux.txt": "qux"},
+		},
+		{
+			name:      "NoResumeOverwrites",
+			files:     map[string]string{"foo.txt": "foo"},
+			destFiles: map[string]string{"foo.txt": "foobar"},
+			source:    "foo.txt",
+			expFiles:  map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:     "Verify",
+			files:    map[string]string{"foo.txt": "foo"},
+			source:   "foo.txt",
+			opts:     []CopyOption{WithVerify("")},
+			expFiles: map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:     "VerifyDirectory",
+			files:    map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux"},
+			source:   "foo",
+			opts:     []CopyOption{WithRecursive(), WithVerify("md5")},
+			expFiles: map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux"},
+		},
+		{
+			name:   "VerifyUnsupportedChecksum",
+			files:  map[string]string{"foo.txt": "foo"},
+			source: "foo.txt",
+			opts:   []CopyOption{WithVerify("crc32")},
+			expErr: fmt.Errorf("VerifyUnsupportedChecksum"),
+		},
+		{
+			name:   "MissingSource",
+			source: "foo.txt",
+			expErr: fmt.Errorf("MissingSource"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newConnectedTestServer(t)
+			src, dest := t.TempDir(), t.TempDir()
+			testTreeCreator(t, src, testCase.files)
+			testTreeCreator(t, dest, testCase.destFiles)
+
+			err := server.Upload(filepath.Join(src, testCase.source), dest, testCase.opts...)
+			if testCase.expErr != nil {
+				if err == nil {
+					t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			testTreeChecker(t, dest, testCase.expFiles)
+		})
+	}
+}
+
+func TestDownload(t *testing.T) {
+	testCases := []struct {
+		name      string
+		files     map[string]string
+		destFiles map[string]string
+		source    string
+		opts      []CopyOption
+		expFiles  map[string]string
+		expErr    error
+	}{
+		{
+			name:     "File",
+			files:    map[string]string{"foo.txt": "foo"},
+			source:   "foo.txt",
+			expFiles: map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:   "DirectoryNotRecursive",
+			files:  map[string]string{"foo/bar.txt": "bar"},
+			source: "foo",
+			expErr: fmt.Errorf("DirectoryNotRecursive"),
+		},
+		{
+			name:   "DirectoryRecursive",
+			files:  map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux", "foo/empty/": ""},
+			source: "foo",
+			opts:   []CopyOption{WithRecursive()},
+			expFiles: map[string]string{
+				"foo/bar.txt":      "bar",
+				"foo/qux/quux.txt": "quux",
+				"foo/empty/":       "",
+			},
+		},
+		{
+			name:      "ResumePartialFile",
+			files:     map[string]string{"foo.txt": "foobar"},
+			destFiles: map[string]string{"foo.txt": "foo"},
+			source:    "foo.txt",
+			opts:      []CopyOption{WithResume()},
+			expFiles:  map[string]string{"foo.txt": "foobar"},
+		},
+		{
+			name:      "ResumeMismatchingFile",
+			files:     map[string]string{"foo.txt": "foobar"},
+			destFiles: map[string]string{"foo.txt": "bar"},
+			source:    "foo.txt",
+			opts:      []CopyOption{WithResume()},
+			expFiles:  map[string]string{"foo.txt": "foobar"},
+		},
+		{
+			name:      "ResumeLargerFile",
+			files:     map[string]string{"foo.txt": "foo"},
+			destFiles: map[string]string{"foo.txt": "foobar"},
+			source:    "foo.txt",
+			opts:      []CopyOption{WithResume()},
+			expFiles:  map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:      "ResumeDirectory",
+			files:     map[string]string{"foo/bar.txt": "bar", "foo/qux.txt": "qux"},
+			destFiles: map[string]string{"foo/bar.txt": "bar", "foo/qux.txt": "q"},
+			source:    "foo",
+			opts:      []CopyOption{WithRecursive(), WithResume()},
+			expFiles:  map[string]string{"foo/bar.txt": "bar", "foo/qux.txt": "qux"},
+		},
+		{
+			name:      "NoResumeOverwrites",
+			files:     map[string]string{"foo.txt": "foo"},
+			destFiles: map[string]string{"foo.txt": "foobar"},
+			source:    "foo.txt",
+			expFiles:  map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:     "Verify",
+			files:    map[string]string{"foo.txt": "foo"},
+			source:   "foo.txt",
+			opts:     []CopyOption{WithVerify("")},
+			expFiles: map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:     "VerifyDirectory",
+			files:    map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux"},
+			source:   "foo",
+			opts:     []CopyOption{WithRecursive(), WithVerify("md5")},
+			expFiles: map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux"},
+		},
+		{
+			name:   "VerifyUnsupportedChecksum",
+			files:  map[string]string{"foo.txt": "foo"},
+			source: "foo.txt",
+			opts:   []CopyOption{WithVerify("crc32")},
+			expErr: fmt.Errorf("VerifyUnsupportedChecksum"),
+		},
+		{
+			name:   "MissingSource",
+			source: "foo.txt",
+			expErr: fmt.Errorf("MissingSource"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newConnectedTestServer(t)
+			src, dest := t.TempDir(), t.TempDir()
+			testTreeCreator(t, src, testCase.files)
+			testTreeCreator(t, dest, testCase.destFiles)
+
+			err := server.Download(filepath.Join(src, testCase.source), dest, testCase.opts...)
+			if testCase.expErr != nil {
+				if err == nil {
+					t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			testTreeChecker(t, dest, testCase.expFiles)
+		})
+	}
+}
+
+func TestGlob(t *testing.T) {
+	testCases := []struct {
+		name       string
+		pattern    string
+		expMatches []string
+	}{
+		{name: "Wildcard", pattern: "*.log", expMatches: []string{"bar.log", "foo.log"}},
+		{name: "CharacterClass", pattern: "[f]oo.*", expMatches: []string{"foo.log", "foo.txt"}},
+		{name: "Directory", pattern: "*/qux.log", expMatches: []string{"qux/qux.log"}},
+		{name: "NoMatch", pattern: "*.gz", expMatches: nil},
+	}
+
+	server := newConnectedTestServer(t)
+	root := t.TempDir()
+	testTreeCreator(t, root, map[string]string{"foo.log": "foo", "bar.log": "bar", "foo.txt": "foo", "qux/qux.log": "qux"})
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			matches, err := server.Glob(filepath.Join(root, testCase.pattern))
+			if err != nil {
+				t.Fatalf("expected error '<nil>', got '%v'", err)
+			}
+			var expMatches []string
+			for _, match := range testCase.expMatches {
+				expMatches = append(expMatches, filepath.Join(root, match))
+			}
+			if !reflect.DeepEqual(expMatches, matches) {
+				t.Fatalf("expected '%v', got '%v'", expMatches, matches)
+			}
+		})
+	}
+}
+
+func TestCopyProgress(t *testing.T) {
+	server := newConnectedTestServer(t)
+	src, dest := t.TempDir(), t.TempDir()
+	content := strings.Repeat("foobar", 100000)
+	testTreeCreator(t, src, map[string]string{"foo.txt": content})
+	testTreeCreator(t, dest, map[string]string{"foo.txt": content[:1000]})
+
+	var reported []Progress
+	fn := func(p Progress) { reported = append(reported, p) }
+
+	file := filepath.Join(src, "foo.txt")
+	err := server.Upload(file, dest, WithProgress(fn))
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	testProgressChecker(t, reported, file, int64(len(content)), 0)
+
+	reported = nil
+	file = filepath.Join(dest, "foo.txt")
+	err = server.Download(file, src, WithProgress(fn))
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	testProgressChecker(t, reported, file, int64(len(content)), 0)
+
+	// resumed transfers report the part already at destination
+	reported = nil
+	testTreeCreator(t, dest, map[string]string{"foo.txt": content[:1000]})
+	file = filepath.Join(src, "foo.txt")
+	err = server.Upload(file, dest, WithProgress(fn), WithResume())
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	testProgressChecker(t, reported, file, int64(len(content)), 1000)
+	testTreeChecker(t, dest, map[string]string{"foo.txt": content})
+}
+
+func TestCopyContext(t *testing.T) {
+	testCases := []struct {
+		name     string
+		download bool
+		opts     []CopyOption
+		expKept  bool
+	}{
+		{name: "Upload"},
+		{name: "Download", download: true},
+		{name: "UploadResume", opts: []CopyOption{WithResume()}, expKept: true},
+		{name: "DownloadResume", download: true, opts: []CopyOption{WithResume()}, expKept: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newConnectedTestServer(t)
+			src, dest := t.TempDir(), t.TempDir()
+			testTreeCreator(t, src, map[string]string{"foo.txt": strings.Repeat("foobar", 1000000)})
+
+			// the copy is cancelled once it has started
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			opts := append(testCase.opts, WithProgress(func(p Progress) {
+				if p.Transferred > 0 {
+					cancel()
+				}
+			}))
+			file := filepath.Join(src, "foo.txt")
+			var err error
+			if testCase.download {
+				err = server.DownloadContext(ctx, file, dest, opts...)
+			} else {
+				err = server.UploadContext(ctx, file, dest, opts...)
+			}
+			if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+				t.Fatalf("expected error '%v', got '%v'", context.Canceled, err)
+			}
+
+			_, err = os.Stat(filepath.Join(dest, "foo.txt"))
+			if kept := err == nil; kept != testCase.expKept {
+				t.Fatalf("expected partial file kept %t, got %t", testCase.expKept, kept)
+			}
+		})
+	}
+}
+
+func TestCopyContextStalled(t *testing.T) {
+	testCases := []struct {
+		name     string
+		download bool
+	}{
+		{name: "Upload"},
+		{name: "Download", download: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			// the sftp sessions stall, the ssh connection still works
+			server := newTestSSHServerWithOptions(t, &ssh.ServerConfig{NoClientAuth: true}, testServerOptions{serveSFTP: stallingTestSFTP(t, 1<<16)})
+			server.Name = "foo"
+			server.AuthenticationMethod = "password"
+			err := server.Connect()
+			if err != nil {
+				t.Fatalf("error connecting to test server: %v", err)
+			}
+			defer server.CloseClient()
+			src, dest := t.TempDir(), t.TempDir()
+			testTreeCreator(t, src, map[string]string{"foo.txt": strings.Repeat("foobar", 1000000)})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			copied := make(chan error, 1)
+			go func() {
+				file := filepath.Join(src, "foo.txt")
+				if testCase.download {
+					copied <- server.DownloadContext(ctx, file, dest)
+				} else {
+					copied <- server.UploadContext(ctx, file, dest)
+				}
+			}()
+			select {
+			case err = <-copied:
+				if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+					t.Fatalf("expected error '%v', got '%v'", context.DeadlineExceeded, err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("expected the copy to stop once the context is done")
+			}
+
+			// the partial file is removed over a new session
+			_, err = os.Stat(filepath.Join(dest, "foo.txt"))
+			if !os.IsNotExist(err) {
+				t.Fatalf("expected partial file to be removed, got '%v'", err)
+			}
+		})
+	}
+}
+
+func TestCloseOnDoneUnresponsive(t *testing.T) {
+	origTimeout := stopTimeout
+	stopTimeout = 10 * time.Millisecond
+	defer func() { stopTimeout = origTimeout }()
+	server := newConnectedTestServer(t)
+
+	// the sftp session cannot be closed, so the connection is
+	blocked := make(chan struct{})
+	defer close(blocked)
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := server.closeOnDone(ctx, blockingCloser(blocked))
+	defer stop()
+	cancel()
+	closed := make(chan struct{})
+	go func() {
+		server.client.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the connection to be closed")
+	}
+}
+
+// blockingCloser is closed once its channel is
+type blockingCloser chan struct{}
+
+func (closer blockingCloser) Close() error {
+	<-closer
+	return nil
+}
+
+func TestRemoveLeftover(t *testing.T) {
+	origTimeout := leftoverTimeout
+	leftoverTimeout = 10 * time.Millisecond
+	defer func() { leftoverTimeout = origTimeout }()
+	server := Server{Name: "foo"}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the files are reported if they cannot be removed in time
+	blocked := make(chan struct{})
+	defer close(blocked)
+	err := server.removeLeftover(ctx, "/tmp/bar", func() error {
+		<-blocked
+		return nil
+	})
+	if err == nil || err.Error() != "/tmp/bar is left on server foo" {
+		t.Fatalf("expected error '/tmp/bar is left on server foo', got '%v'", err)
+	}
+	err = server.removeLeftover(ctx, "/tmp/bar", func() error {
+		return fmt.Errorf("no luck")
+	})
+	if err == nil || err.Error() != "/tmp/bar is left on server foo" {
+		t.Fatalf("expected error '/tmp/bar is left on server foo', got '%v'", err)
+	}
+	err = server.removeLeftover(ctx, "/tmp/bar", func() error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+}
+
+func TestResumeOffset(t *testing.T) {
+	large := bytes.Repeat([]byte("foobar"), 1<<20)
+	changed := append([]byte{}, large...)
+	changed[0] = 'x'
+	unavailable := func(size int64) (string, error) {
+		return "", fmt.Errorf("sha256sum: command not found")
+	}
+
+	testCases := []struct {
+		name       string
+		src        []byte
+		dst        []byte
+		dstSum     prefixChecksum
+		expOffset  int64
+		expWarning string
+	}{
+		{name: "EmptyDestination", src: []byte("foo"), dst: []byte{}, expOffset: 0},
+		{name: "PartialDestination", src: []byte("foobar"), dst: []byte("foo"), expOffset: 3},
+		{name: "CompleteDestination", src: []byte("foobar"), dst: []byte("foobar"), expOffset: 6},
+		{name: "MismatchingDestination", src: []byte("foobar"), dst: []byte("bar"), expOffset: 0},
+		{name: "LargerDestination", src: []byte("foo"), dst: []byte("foobar"), expOffset: 0},
+		{name: "LargePartialDestination", src: large, dst: large[:len(large)-10], expOffset: int64(len(large) - 10)},
+		// the whole overlap is compared
+		{name: "MismatchAtStart", src: large, dst: changed[:len(large)-10], expOffset: 0},
+		{name: "UnavailableChecksum", src: []byte("foobar"), dst: []byte("foo"), dstSum: unavailable, expOffset: 0, expWarning: "warning: sha256sum: command not found, starting over\n"},
+	}
+
+	origWarnings := warnings
+	defer func() { warnings = origWarnings }()
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var warned bytes.Buffer
+			warnings = &warned
+			dstSum := testCase.dstSum
+			if dstSum == nil {
+				dstSum = localPrefixChecksum(bytes.NewReader(testCase.dst))
+			}
+			offset := resumeOffset(localPrefixChecksum(bytes.NewReader(testCase.src)), dstSum, int64(len(testCase.src)), int64(len(testCase.dst)))
+			if testCase.expOffset != offset {
+				t.Fatalf("expected offset %d, got %d", testCase.expOffset, offset)
+			}
+			if warned.String() != testCase.expWarning {
+				t.Fatalf("expected warning '%s', got '%s'", testCase.expWarning, warned.String())
+			}
+		})
+	}
+}
+
+// helper function to create files under root
+// paths ending with a slash are created as directories
+func testTreeCreator(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if name[len(name)-1] == '/' {
+			err := os.MkdirAll(path, 0755)
+			if err != nil {
+				t.Fatalf("error creating test directory: %v", err)
+			}
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatalf("error creating test directory: %v", err)
+		}
+		err = os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("error creating test file: %v", err)
+		}
+	}
+}
+
+// helper function to check that root contains exactly the expected files
+// paths ending with a slash are expected to be directories
+func testTreeChecker(t *testing.T, root string, expFiles map[string]string) {
+	t.Helper()
+
+	found := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if info.IsDir() {
+			found[rel+"/"] = ""
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		found[rel] = string(content)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("error walking destination: %v", err)
+	}
+
+	for name, content := range expFiles {
+		got, ok := found[name]
+		if !ok {
+			t.Fatalf("expected %s in destination, got '%v'", name, found)
+		}
+		if got != content {
+			t.Fatalf("expected content '%s' in %s, got '%s'", content, name, got)
+		}
+	}
+	for name := range found {
+		if _, ok := expFiles[name]; !ok && name[len(name)-1] != '/' {
+			t.Fatalf("unexpected file %s in destination", name)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// policies for the verification of host keys
+const (
+	// only hosts with a matching key in known_hosts are accepted
+	HostKeyPolicyStrict = "strict"
+	// unknown hosts are accepted and added to known_hosts, changed keys are rejected
+	HostKeyPolicyAcceptNew = "accept-new"
+	// host keys are not verified
+	HostKeyPolicyInsecure = "insecure"
+)
+
+const DefaultKnownHosts = "~/.ssh/known_hosts"
+
+// errHostKeyFetched aborts the handshake once the host key has been fetched
+var errHostKeyFetched = errors.New("host key fetched")
+
+// FetchHostKey returns the host key presented by the server
+// the server is reached through its chain of gateways, whose host keys are verified as usual
+// no authentication takes place with the server itself
+func (server *Server) FetchHostKey() (ssh.PublicKey, error) {
+	var hostKey ssh.PublicKey
+	target := *server
+	target.hostKeyFetcher = func(key ssh.PublicKey) {
+		hostKey = key
+	}
+
+	err := target.Connect()
+	if hostKey != nil {
+		return hostKey, nil
+	}
+	if err == nil {
+		target.CloseClient()
+		return nil, fmt.Errorf("server %s did not present a host key", server.Name)
+	}
+	return nil, err
+}
+
+// constructs the callback verifying the host key presented by the server
+// keys are checked against the pinned HostKey if set,
+// otherwise against the KnownHosts file according to HostKeyPolicy
+func (server Server) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if server.hostKeyFetcher != nil {
+		callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			server.hostKeyFetcher(key)
+			return errHostKeyFetched
+		}
+		return callback, nil
+	}
+
+	if server.HostKey != "" {
+		return server.pinnedHostKeyCallback()
+	}
+
+	policy := server.HostKeyPolicy
+	if policy == "" {
+		policy = HostKeyPolicyStrict
+	}
+	switch policy {
+	case HostKeyPolicyInsecure:
+		return ssh.InsecureIgnoreHostKey(), nil
+	case HostKeyPolicyStrict, HostKeyPolicyAcceptNew:
+	default:
+		return nil, fmt.Errorf("host key policy %s is not supported", policy)
+	}
+
+	knownHostsFile, err := server.knownHostsFile()
+	if err != nil {
+		return nil, err
+	}
+
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		// known_hosts is read at verification time
+		// so hosts accepted earlier in the chain are taken into account
+		_, err := os.Stat(knownHostsFile)
+		if os.IsNotExist(err) && policy == HostKeyPolicyAcceptNew {
+			return addKnownHost(knownHostsFile, hostname, key)
+		}
+		check, err := knownhosts.New(knownHostsFile)
+		if err != nil {
+			return fmt.Errorf("error reading known hosts file %s to verify server %s: %v", knownHostsFile, server.Name, err)
+		}
+
+		err = check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			if err != nil {
+				return fmt.Errorf("host key verification of server %s (%s) failed: %v", server.Name, hostname, err)
+			}
+			return nil
+		}
+
+		// the host is known with a different key
+		if len(keyErr.Want) > 0 {
+			want := keyErr.Want[0]
+			return fmt.Errorf("host key of server %s (%s) does not match the key in %s:%d, got %s key %s - possible man-in-the-middle attack",
+				server.Name, hostname, want.Filename, want.Line, key.Type(), ssh.FingerprintSHA256(key))
+		}
+
+		// the host is not known
+		if policy == HostKeyPolicyAcceptNew {
+			return addKnownHost(knownHostsFile, hostname, key)
+		}
+		return fmt.Errorf("host key of server %s (%s) is not in %s, got %s key %s - add it or set host_key_policy to %s",
+			server.Name, hostname, knownHostsFile, key.Type(), ssh.FingerprintSHA256(key), HostKeyPolicyAcceptNew)
+	}
+	return callback, nil
+}
+
+// returns the path of the known hosts file of Server
+func (server Server) knownHostsFile() (string, error) {
+	knownHostsFile := DefaultKnownHosts
+	if server.KnownHosts != "" {
+		knownHostsFile = server.KnownHosts
+	}
+	return expandHome(fromEnv(knownHostsFile))
+}
+
+// returns the host key algorithms to negotiate with Server, those of the pinned HostKey
+// or of its keys in the known hosts file, as OpenSSH does
+// otherwise the server may present a key of another type than the one known, which would be taken for a changed key
+// returns nil, for the default algorithms, if the keys of Server are not known or not verified
+// a pinned fingerprint does not tell the type of the key, so it has to be of the key negotiated by default,
+// the one printed by 'tiramolla fingerprint'
+func (server Server) hostKeyAlgorithms() []string {
+	if server.hostKeyFetcher != nil {
+		return nil
+	}
+	if server.HostKey != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(server.HostKey))
+		if err != nil {
+			// a fingerprint, or a key the callback reports as invalid
+			return nil
+		}
+		return keyAlgorithms(key.Type())
+	}
+	if server.HostKeyPolicy == HostKeyPolicyInsecure {
+		return nil
+	}
+	knownHostsFile, err := server.knownHostsFile()
+	if err != nil {
+		return nil
+	}
+	check, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		// the callback reports a known hosts file that cannot be read
+		return nil
+	}
+
+	// no key matches the probe, so the error lists the known keys of the host
+	err = check(server.hostAddr(), &net.TCPAddr{}, probeKey{})
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+	// in the order of the file, as the keys are collected in a map
+	sort.Slice(keyErr.Want, func(i, j int) bool { return keyErr.Want[i].Line < keyErr.Want[j].Line })
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		algorithms = append(algorithms, keyAlgorithms(known.Key.Type())...)
+	}
+	return algorithms
+}
+
+// returns the host key algorithms that a key of keyType is presented with
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// probeKey is a public key matching no known host key
+type probeKey struct{}
+
+func (probeKey) Type() string {
+	return "probe@tiramolla"
+}
+
+func (probeKey) Marshal() []byte {
+	return []byte("probe@tiramolla")
+}
+
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error {
+	return fmt.Errorf("probe key cannot verify signatures")
+}
+
+// appends the key of hostname to the known hosts file, creating it if needed
+func addKnownHost(knownHostsFile, hostname string, key ssh.PublicKey) error {
+	err := os.MkdirAll(filepath.Dir(knownHostsFile), 0700)
+	if err != nil {
+		return fmt.Errorf("error creating directory of known hosts file: %v", err)
+	}
+	file, err := os.OpenFile(knownHostsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening known hosts file %s: %v", knownHostsFile, err)
+	}
+	defer file.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	_, err = fmt.Fprintln(file, line)
+	if err != nil {
+		return fmt.Errorf("error writing to known hosts file %s: %v", knownHostsFile, err)
+	}
+	return nil
+}
+
+// constructs the callback accepting only the pinned HostKey
+// HostKey is either a SHA256 fingerprint or a key in authorized_keys format
+func (server Server) pinnedHostKeyCallback() (ssh.HostKeyCallback, error) {
+	fingerprint, err := server.hostKeyFingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if ssh.FingerprintSHA256(key) != fingerprint {
+			return fmt.Errorf("host key of server %s (%s) does not match the pinned key %s, got %s key %s - possible man-in-the-middle attack",
+				server.Name, hostname, fingerprint, key.Type(), ssh.FingerprintSHA256(key))
+		}
+		return nil
+	}
+	return callback, nil
+}
+
+// returns the SHA256 fingerprint of the pinned HostKey
+func (server Server) hostKeyFingerprint() (string, error) {
+	if strings.HasPrefix(server.HostKey, "SHA256:") {
+		return server.HostKey, nil
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(server.HostKey))
+	if err != nil {
+		return "", fmt.Errorf("error parsing host key of server %s, expected SHA256 fingerprint or authorized_keys format: %v", server.Name, err)
+	}
+	return ssh.FingerprintSHA256(key), nil
+}
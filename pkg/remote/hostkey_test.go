@@ -0,0 +1,414 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestHostKeyCallback(t *testing.T) {
+	otherKey, err := testPrivateKey("testdata/id_ed25519")
+	if err != nil {
+		t.Fatalf("error reading test key: %v", err)
+	}
+	otherSigner, err := ssh.NewSignerFromKey(otherKey)
+	if err != nil {
+		t.Fatalf("error creating signer: %v", err)
+	}
+
+	testCases := []struct {
+		name          string
+		policy        string
+		knownHosts    func(host string, key ssh.PublicKey) string
+		expErr        error
+		expKnownHosts bool
+	}{
+		{
+			name:   "KnownHost",
+			policy: HostKeyPolicyStrict,
+			knownHosts: func(host string, key ssh.PublicKey) string {
+				return knownhosts.Line([]string{knownhosts.Normalize(host)}, key)
+			},
+			expErr: nil,
+		},
+		{
+			name:   "KnownHostDefaultPolicy",
+			policy: "",
+			knownHosts: func(host string, key ssh.PublicKey) string {
+				return knownhosts.Line([]string{knownhosts.Normalize(host)}, key)
+			},
+			expErr: nil,
+		},
+		{
+			name:   "HashedKnownHost",
+			policy: HostKeyPolicyStrict,
+			knownHosts: func(host string, key ssh.PublicKey) string {
+				return knownhosts.Line([]string{knownhosts.HashHostname(knownhosts.Normalize(host))}, key)
+			},
+			expErr: nil,
+		},
+		{
+			name:   "UnknownHostStrict",
+			policy: HostKeyPolicyStrict,
+			knownHosts: func(host string, key ssh.PublicKey) string {
+				return knownhosts.Line([]string{"[10.0.0.1]:2222"}, key)
+			},
+			expErr: fmt.Errorf("UnknownHostStrict"),
+		},
+		{
+			name:   "UnknownHostAcceptNew",
+			policy: HostKeyPolicyAcceptNew,
+			knownHosts: func(host string, key ssh.PublicKey) string {
+				return knownhosts.Line([]string{"[10.0.0.1]:2222"}, key)
+			},
+			expErr:        nil,
+			expKnownHosts: true,
+		},
+		{
+			name:   "ChangedKeyStrict",
+			policy: HostKeyPolicyStrict,
+			knownHosts: func(host string, key ssh.PublicKey) string {
+				return knownhosts.Line([]string{knownhosts.Normalize(host)}, otherSigner.PublicKey())
+			},
+			expErr: fmt.Errorf("ChangedKeyStrict"),
+		},
+		{
+			name:   "ChangedKeyAcceptNew",
+			policy: HostKeyPolicyAcceptNew,
+			knownHosts: func(host string, key ssh.PublicKey) string {
+				return knownhosts.Line([]string{knownhosts.Normalize(host)}, otherSigner.PublicKey())
+			},
+			expErr: fmt.Errorf("ChangedKeyAcceptNew"),
+		},
+		{
+			name:   "ChangedKeyInsecure",
+			policy: HostKeyPolicyInsecure,
+			knownHosts: func(host string, key ssh.PublicKey) string {
+				return knownhosts.Line([]string{knownhosts.Normalize(host)}, otherSigner.PublicKey())
+			},
+			expErr: nil,
+		},
+		{
+			name:   "MissingKnownHostsStrict",
+			policy: HostKeyPolicyStrict,
+			expErr: fmt.Errorf("MissingKnownHostsStrict"),
+		},
+		{
+			name:          "MissingKnownHostsAcceptNew",
+			policy:        HostKeyPolicyAcceptNew,
+			expErr:        nil,
+			expKnownHosts: true,
+		},
+		{
+			name:   "UnknownPolicy",
+			policy: "unknown",
+			expErr: fmt.Errorf("UnknownPolicy"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newTestSSHServer(t, &ssh.ServerConfig{NoClientAuth: true})
+			server.Name = "foo"
+			server.AuthenticationMethod = "password"
+			server.HostKeyPolicy = testCase.policy
+			host := fmt.Sprintf("%s:%d", server.Addr, server.Port)
+			hostKey := testHostKey(t, server)
+
+			server.KnownHosts = filepath.Join(t.TempDir(), ".ssh", "known_hosts")
+			if testCase.knownHosts != nil {
+				err := os.MkdirAll(filepath.Dir(server.KnownHosts), 0700)
+				if err != nil {
+					t.Fatalf("error creating known hosts directory: %v", err)
+				}
+				err = os.WriteFile(server.KnownHosts, []byte(testCase.knownHosts(host, hostKey)+"\n"), 0600)
+				if err != nil {
+					t.Fatalf("error writing known hosts file: %v", err)
+				}
+			}
+
+			err := server.Connect()
+			if testCase.expErr != nil {
+				if err == nil {
+					t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+				}
+				if testCase.policy != "unknown" && !strings.Contains(err.Error(), "server foo") {
+					t.Fatalf("expected error naming server foo, got '%v'", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			server.CloseClient()
+
+			if testCase.expKnownHosts {
+				// the accepted key is now known, even with the strict policy
+				server.HostKeyPolicy = HostKeyPolicyStrict
+				err = server.Connect()
+				if err != nil {
+					t.Fatalf("expected accepted host key to be known, got '%v'", err)
+				}
+				server.CloseClient()
+			}
+		})
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	var signers []ssh.Signer
+	for _, file := range []string{"testdata/id_ecdsa_pkcs8", "testdata/id_rsa_pem"} {
+		key, err := testPrivateKey(file)
+		if err != nil {
+			t.Fatalf("error reading test key: %v", err)
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatalf("error creating signer: %v", err)
+		}
+		signers = append(signers, signer)
+	}
+	ecdsaSigner, rsaSigner := signers[0], signers[1]
+
+	testCases := []struct {
+		name     string
+		pinned   bool // the known key is pinned with host_key instead of being in known_hosts
+		known    func(ed25519Key ssh.PublicKey) []ssh.PublicKey
+		expKey   func(ed25519Key ssh.PublicKey) ssh.PublicKey
+		expAlgos []string
+	}{
+		{
+			name:     "Ed25519Known",
+			known:    func(key ssh.PublicKey) []ssh.PublicKey { return []ssh.PublicKey{key} },
+			expKey:   func(key ssh.PublicKey) ssh.PublicKey { return key },
+			expAlgos: []string{ssh.KeyAlgoED25519},
+		},
+		{
+			name:     "RSAKnown",
+			known:    func(key ssh.PublicKey) []ssh.PublicKey { return []ssh.PublicKey{rsaSigner.PublicKey()} },
+			expKey:   func(key ssh.PublicKey) ssh.PublicKey { return rsaSigner.PublicKey() },
+			expAlgos: []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA},
+		},
+		{
+			name:     "Ed25519AndECDSAKnown",
+			known:    func(key ssh.PublicKey) []ssh.PublicKey { return []ssh.PublicKey{key, ecdsaSigner.PublicKey()} },
+			expKey:   func(key ssh.PublicKey) ssh.PublicKey { return key },
+			expAlgos: []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256},
+		},
+		{
+			name:     "Ed25519Pinned",
+			pinned:   true,
+			known:    func(key ssh.PublicKey) []ssh.PublicKey { return []ssh.PublicKey{key} },
+			expKey:   func(key ssh.PublicKey) ssh.PublicKey { return key },
+			expAlgos: []string{ssh.KeyAlgoED25519},
+		},
+		{
+			name:     "RSAPinned",
+			pinned:   true,
+			known:    func(key ssh.PublicKey) []ssh.PublicKey { return []ssh.PublicKey{rsaSigner.PublicKey()} },
+			expKey:   func(key ssh.PublicKey) ssh.PublicKey { return rsaSigner.PublicKey() },
+			expAlgos: []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			// the server has ECDSA and RSA host keys besides the ed25519 one of test servers
+			config := &ssh.ServerConfig{NoClientAuth: true}
+			config.AddHostKey(ecdsaSigner)
+			config.AddHostKey(rsaSigner)
+			server := newTestSSHServer(t, config)
+			server.Name = "foo"
+			server.AuthenticationMethod = "password"
+			host := fmt.Sprintf("%s:%d", server.Addr, server.Port)
+			ed25519Key := testHostKey(t, server)
+
+			var lines []string
+			for _, key := range testCase.known(ed25519Key) {
+				lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(host)}, key))
+			}
+			err := os.WriteFile(server.KnownHosts, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+			if err != nil {
+				t.Fatalf("error writing known hosts file: %v", err)
+			}
+			if testCase.pinned {
+				server.HostKey = string(ssh.MarshalAuthorizedKey(testCase.known(ed25519Key)[0]))
+				server.KnownHosts = filepath.Join(t.TempDir(), "known_hosts")
+			}
+			expKey := testCase.expKey(ed25519Key)
+
+			algos := server.hostKeyAlgorithms()
+			if !reflect.DeepEqual(algos, testCase.expAlgos) {
+				t.Fatalf("expected algorithms %v, got %v", testCase.expAlgos, algos)
+			}
+
+			// the known key is negotiated, rather than the one preferred by default
+			cfg, closeAuth, err := server.constructClientCFG()
+			if err != nil {
+				t.Fatalf("expected error '<nil>', got '%v'", err)
+			}
+			closeAuth()
+			callback := cfg.HostKeyCallback
+			var presented ssh.PublicKey
+			cfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				presented = key
+				return callback(hostname, remote, key)
+			}
+			client, err := ssh.Dial("tcp", host, cfg)
+			if err != nil {
+				t.Fatalf("expected error '<nil>', got '%v'", err)
+			}
+			client.Close()
+			if ssh.FingerprintSHA256(presented) != ssh.FingerprintSHA256(expKey) {
+				t.Fatalf("expected host key '%s', got '%s'", ssh.FingerprintSHA256(expKey), ssh.FingerprintSHA256(presented))
+			}
+
+			// so the host is accepted with the default strict policy
+			err = server.Connect()
+			if err != nil {
+				t.Fatalf("expected error '<nil>', got '%v'", err)
+			}
+			server.CloseClient()
+		})
+	}
+}
+
+func TestPinnedHostKey(t *testing.T) {
+	otherKey, err := testPrivateKey("testdata/id_ed25519")
+	if err != nil {
+		t.Fatalf("error reading test key: %v", err)
+	}
+	otherSigner, err := ssh.NewSignerFromKey(otherKey)
+	if err != nil {
+		t.Fatalf("error creating signer: %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		hostKey func(key ssh.PublicKey) string
+		expErr  error
+	}{
+		{
+			name:    "PinnedFingerprint",
+			hostKey: func(key ssh.PublicKey) string { return ssh.FingerprintSHA256(key) },
+			expErr:  nil,
+		},
+		{
+			name:    "PinnedAuthorizedKey",
+			hostKey: func(key ssh.PublicKey) string { return string(ssh.MarshalAuthorizedKey(key)) },
+			expErr:  nil,
+		},
+		{
+			name: "PinnedAuthorizedKeyWithComment",
+			hostKey: func(key ssh.PublicKey) string {
+				return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " root@foo"
+			},
+			expErr: nil,
+		},
+		{
+			name:    "MismatchingFingerprint",
+			hostKey: func(key ssh.PublicKey) string { return ssh.FingerprintSHA256(otherSigner.PublicKey()) },
+			expErr:  fmt.Errorf("MismatchingFingerprint"),
+		},
+		{
+			name:    "MismatchingAuthorizedKey",
+			hostKey: func(key ssh.PublicKey) string { return string(ssh.MarshalAuthorizedKey(otherSigner.PublicKey())) },
+			expErr:  fmt.Errorf("MismatchingAuthorizedKey"),
+		},
+		{
+			name:    "InvalidHostKey",
+			hostKey: func(key ssh.PublicKey) string { return "foo" },
+			expErr:  fmt.Errorf("InvalidHostKey"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newTestSSHServer(t, &ssh.ServerConfig{NoClientAuth: true})
+			server.Name = "foo"
+			server.AuthenticationMethod = "password"
+			server.HostKey = testCase.hostKey(testHostKey(t, server))
+			// the pinned key takes precedence over known_hosts
+			server.KnownHosts = filepath.Join(t.TempDir(), "known_hosts")
+
+			err := server.Connect()
+			if testCase.expErr != nil {
+				if err == nil {
+					t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+				}
+				if !strings.Contains(err.Error(), "server foo") {
+					t.Fatalf("expected error naming server foo, got '%v'", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			server.CloseClient()
+		})
+	}
+}
+
+func TestFetchHostKey(t *testing.T) {
+	server := newTestSSHServer(t, &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, fmt.Errorf("no authentication expected")
+		},
+	})
+	server.Name = "foo"
+	expKey := testHostKey(t, server)
+	// the host key is fetched even if it is unknown
+	server.KnownHosts = filepath.Join(t.TempDir(), "known_hosts")
+
+	key, err := server.FetchHostKey()
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	if ssh.FingerprintSHA256(key) != ssh.FingerprintSHA256(expKey) {
+		t.Fatalf("expected host key '%s', got '%s'", ssh.FingerprintSHA256(expKey), ssh.FingerprintSHA256(key))
+	}
+
+	// fetching fails if the server is unreachable
+	server.Port = 0
+	_, err = server.FetchHostKey()
+	if err == nil {
+		t.Fatalf("expected error for unreachable server, got '%v'", err)
+	}
+}
+
+// helper function to read the host key of a test server from its known hosts file
+func testHostKey(t *testing.T, server Server) ssh.PublicKey {
+	t.Helper()
+
+	content, err := os.ReadFile(server.KnownHosts)
+	if err != nil {
+		t.Fatalf("error reading known hosts file: %v", err)
+	}
+	_, _, key, _, _, err := ssh.ParseKnownHosts(content)
+	if err != nil {
+		t.Fatalf("error parsing known hosts file: %v", err)
+	}
+	return key
+}
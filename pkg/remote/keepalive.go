@@ -0,0 +1,71 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// number of unanswered keepalives after which a connection is closed, as ServerAliveCountMax of OpenSSH
+	DefaultKeepaliveCountMax = 3
+
+	keepaliveRequest = "keepalive@openssh.com"
+)
+
+// returns the number of unanswered keepalives after which the connection to Server is closed
+func (server Server) keepaliveCountMax() int {
+	if server.KeepaliveCountMax > 0 {
+		return server.KeepaliveCountMax
+	}
+	return DefaultKeepaliveCountMax
+}
+
+// sends a keepalive request on client every interval, until the connection is closed
+// the connection is closed once countMax keepalives in a row are unanswered, so that the clients
+// of the hops reached through it, and anything using them, fail instead of hanging
+func keepalive(client *ssh.Client, interval time.Duration, countMax int) {
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// any reply counts as an answer, even a refusal of a server that does not know the request
+	var unanswered int32
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+		if atomic.AddInt32(&unanswered, 1) > int32(countMax) {
+			client.Close()
+			return
+		}
+		go func() {
+			_, _, err := client.SendRequest(keepaliveRequest, true, nil)
+			if err == nil {
+				atomic.StoreInt32(&unanswered, 0)
+			}
+		}()
+	}
+}
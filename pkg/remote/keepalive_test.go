@@ -0,0 +1,108 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeepalive(t *testing.T) {
+	testCases := []struct {
+		name       string
+		unanswered bool
+	}{
+		{name: "Answered"},
+		{name: "UnansweredGateway", unanswered: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			// the gateway either answers keepalives, as OpenSSH does, or stops answering at all
+			handleRequests := func(reqs <-chan *ssh.Request) {
+				for req := range reqs {
+					if req.Type == keepaliveRequest && testCase.unanswered {
+						continue
+					}
+					req.Reply(req.Type == keepaliveRequest, nil)
+				}
+			}
+			stats := []*testServerStats{{}, {}}
+			server := newTestSSHServerWithOptions(t, &ssh.ServerConfig{NoClientAuth: true}, testServerOptions{stats: stats[0]})
+			gateway := newTestSSHServerWithOptions(t, &ssh.ServerConfig{NoClientAuth: true}, testServerOptions{stats: stats[1], handleRequests: handleRequests})
+			server.Name, server.Gateway, gateway.Name = "foo", "gw", "gw"
+			for _, s := range []*Server{&server, &gateway} {
+				s.AuthenticationMethod = "password"
+				s.KeepaliveInterval = 20 * time.Millisecond
+				s.KeepaliveCountMax = 2
+			}
+			err := server.CreateServerChain(map[string]ServerInterface{"foo": &server, "gw": &gateway})
+			if err != nil {
+				t.Fatalf("error creating server chain: %v", err)
+			}
+			err = server.Connect()
+			if err != nil {
+				t.Fatalf("expected error '<nil>', got '%v'", err)
+			}
+			defer server.CloseClient()
+
+			if !testCase.unanswered {
+				time.Sleep(200 * time.Millisecond)
+				out, err := server.runSession("echo ok")
+				if err != nil || strings.TrimSpace(string(out)) != "ok" {
+					t.Fatalf("expected output 'ok', got '%s' with error '%v'", out, err)
+				}
+				return
+			}
+
+			// the chain is torn down once the gateway stops answering
+			lost := make(chan struct{})
+			go func() {
+				server.client.Wait()
+				close(lost)
+			}()
+			select {
+			case <-lost:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected connection to be closed")
+			}
+			testChainClosed(t, stats)
+		})
+	}
+}
+
+func TestKeepaliveCountMax(t *testing.T) {
+	testCases := []struct {
+		name     string
+		countMax int
+		expCount int
+	}{
+		{name: "Default", countMax: 0, expCount: DefaultKeepaliveCountMax},
+		{name: "Set", countMax: 5, expCount: 5},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := Server{KeepaliveCountMax: testCase.countMax}
+			if count := server.keepaliveCountMax(); count != testCase.expCount {
+				t.Fatalf("expected count %d, got %d", testCase.expCount, count)
+			}
+		})
+	}
+}
@@ -0,0 +1,503 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// connections are multiplexed by a background process, the multiplexer, which keeps the chain to a server open
+// and serves ssh on a unix socket, forwarding the channels of the processes attached to it to the server
+
+const DefaultMuxIdleTimeout = 10 * time.Minute
+
+// global requests handled by the multiplexer itself
+const (
+	muxInfoRequest  = "info@tiramolla"
+	muxCloseRequest = "close@tiramolla"
+)
+
+// StartMux starts the multiplexer of server in the background and returns once it is listening,
+// or once ctx is done, stopping the multiplexer
+// Multiplex is ignored if it is not set
+var StartMux func(ctx context.Context, server Server) error
+
+// MuxInfo describes a running multiplexer
+type MuxInfo struct {
+	Server      string
+	Socket      string
+	PID         int
+	Started     time.Time
+	Clients     int
+	IdleTimeout time.Duration
+}
+
+// payload of the reply to muxInfoRequest
+type muxInfoMsg struct {
+	Server      string
+	PID         uint32
+	Started     uint64
+	Clients     uint32
+	IdleTimeout uint64
+}
+
+// MuxDir returns the directory of the sockets of the multiplexers, creating it if needed
+// it is $XDG_RUNTIME_DIR/tiramolla, or a directory of the user in the temporary directory
+func MuxDir() (string, error) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("tiramolla-%d", os.Getuid()))
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		dir = filepath.Join(runtimeDir, "tiramolla")
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("error creating multiplexer directory: %v", err)
+	}
+	// anyone with access to the directory can use the connections
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", fmt.Errorf("error creating multiplexer directory: %v", err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0700 {
+		return "", fmt.Errorf("multiplexer directory %s is not a directory with mode 0700", dir)
+	}
+	if meta := localMetadata(info); meta.owned && meta.uid != os.Getuid() {
+		return "", fmt.Errorf("multiplexer directory %s is not owned by the user", dir)
+	}
+	return dir, nil
+}
+
+// returns the socket of the multiplexer of Server
+// it depends on the name, user, address and port of the server and of its gateways,
+// so that a new multiplexer is started if any of them changes
+func (server Server) muxSocket() (string, error) {
+	dir, err := MuxDir()
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	for _, hop := range append([]Server{server}, server.serverChain...) {
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%d\x00", hop.Name, fromEnv(hop.User), hop.Addr, hop.Port)
+	}
+	return filepath.Join(dir, hex.EncodeToString(hash.Sum(nil))[:16]+".sock"), nil
+}
+
+// attaches to the multiplexer of Server, starting it if it is not running
+// attaching and starting are abandoned once ctx is done
+func (server *Server) connectMux(ctx context.Context) error {
+	socket, err := server.muxSocket()
+	if err != nil {
+		return err
+	}
+
+	client, err := attachMux(ctx, socket)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		err = StartMux(ctx, *server)
+		if err != nil {
+			return fmt.Errorf("error starting multiplexer of server %s: %v", server.Name, err)
+		}
+		client, err = attachMux(ctx, socket)
+		if err != nil {
+			return fmt.Errorf("error attaching to multiplexer of server %s: %v", server.Name, err)
+		}
+	}
+
+	server.client = client
+	server.gateways = nil
+	return nil
+}
+
+// connects to the multiplexer listening on socket, until ctx is done
+// its host key is the one written next to the socket
+func attachMux(ctx context.Context, socket string) (*ssh.Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	key, err := os.ReadFile(socket + ".pub")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey(key)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error parsing host key of multiplexer: %v", err)
+	}
+
+	return handshake(ctx, conn, socket, &ssh.ClientConfig{
+		User:            "tiramolla",
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+	})
+}
+
+// ListMux returns the running multiplexers
+// sockets left behind by multiplexers that are no longer running are removed
+func ListMux() ([]MuxInfo, error) {
+	dir, err := MuxDir()
+	if err != nil {
+		return nil, err
+	}
+	sockets, err := filepath.Glob(filepath.Join(dir, "*.sock"))
+	if err != nil {
+		return nil, err
+	}
+
+	var muxes []MuxInfo
+	for _, socket := range sockets {
+		client, err := attachMux(context.Background(), socket)
+		if err != nil {
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				os.Remove(socket)
+				os.Remove(socket + ".pub")
+			}
+			continue
+		}
+		ok, payload, err := client.SendRequest(muxInfoRequest, true, nil)
+		client.Close()
+		var msg muxInfoMsg
+		if err != nil || !ok || ssh.Unmarshal(payload, &msg) != nil {
+			continue
+		}
+		muxes = append(muxes, MuxInfo{
+			Server:      msg.Server,
+			Socket:      socket,
+			PID:         int(msg.PID),
+			Started:     time.Unix(int64(msg.Started), 0),
+			Clients:     int(msg.Clients),
+			IdleTimeout: time.Duration(msg.IdleTimeout),
+		})
+	}
+	return muxes, nil
+}
+
+// CloseMux stops the multiplexer listening on socket, closing its connection to the server
+func CloseMux(socket string) error {
+	client, err := attachMux(context.Background(), socket)
+	if err != nil {
+		return fmt.Errorf("error attaching to multiplexer: %v", err)
+	}
+	defer client.Close()
+
+	ok, _, err := client.SendRequest(muxCloseRequest, true, nil)
+	if err != nil {
+		return fmt.Errorf("error closing multiplexer: %v", err)
+	}
+	if !ok {
+		return fmt.Errorf("error closing multiplexer: request refused")
+	}
+	return nil
+}
+
+// ServeMux connects to Server through its chain of gateways and serves the connection on the socket of Server
+// to the processes attaching to it, until none has been attached for MultiplexIdleTimeout,
+// the connection to the server is lost, the multiplexer is closed or ctx is done
+// ready is called once the socket is listening, or with the error that prevented it
+func (server *Server) ServeMux(ctx context.Context, ready func(error)) error {
+	mux, err := server.listenMux(ctx)
+	if err != nil {
+		ready(err)
+		return err
+	}
+	if mux == nil {
+		// another multiplexer of the server is running
+		ready(nil)
+		return nil
+	}
+	defer server.CloseClient()
+	defer os.Remove(mux.socket + ".pub")
+
+	ready(nil)
+	mux.serve(ctx)
+	return nil
+}
+
+// mux holds the state of a running multiplexer
+type mux struct {
+	server      *Server
+	socket      string
+	listener    net.Listener
+	config      *ssh.ServerConfig
+	started     time.Time
+	idleTimeout time.Duration
+
+	mutex  sync.Mutex
+	conns  map[*ssh.ServerConn]bool
+	idle   *time.Timer
+	closed bool
+}
+
+// connects to Server and listens on its socket
+// returns nil if another multiplexer is already listening on it
+func (server *Server) listenMux(ctx context.Context) (*mux, error) {
+	socket, err := server.muxSocket()
+	if err != nil {
+		return nil, err
+	}
+	// processes starting the multiplexer at once take turns, so that the later ones attach to it
+	// instead of replacing its socket
+	unlock, err := lockMux(ctx, socket)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if client, err := attachMux(ctx, socket); err == nil {
+		client.Close()
+		return nil, nil
+	}
+	err = server.connectChain(ctx)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(socket)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		server.CloseClient()
+		return nil, fmt.Errorf("error generating host key of multiplexer: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		server.CloseClient()
+		return nil, fmt.Errorf("error generating host key of multiplexer: %v", err)
+	}
+	err = os.WriteFile(socket+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600)
+	if err != nil {
+		server.CloseClient()
+		return nil, fmt.Errorf("error writing host key of multiplexer: %v", err)
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		server.CloseClient()
+		os.Remove(socket + ".pub")
+		return nil, fmt.Errorf("error listening on %s: %v", socket, err)
+	}
+
+	// the socket is only accessible to the user, no authentication is needed
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	idleTimeout := server.MultiplexIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultMuxIdleTimeout
+	}
+	return &mux{
+		server:      server,
+		socket:      socket,
+		listener:    listener,
+		config:      config,
+		started:     time.Now(),
+		idleTimeout: idleTimeout,
+		conns:       make(map[*ssh.ServerConn]bool),
+	}, nil
+}
+
+// accepts the processes attaching to the multiplexer until it is closed
+func (mux *mux) serve(ctx context.Context) {
+	mux.mutex.Lock()
+	mux.idle = time.AfterFunc(mux.idleTimeout, mux.close)
+	mux.mutex.Unlock()
+	go func() {
+		mux.server.client.Wait()
+		mux.close()
+	}()
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			mux.close()
+		case <-stopped:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for {
+		conn, err := mux.listener.Accept()
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			mux.serveConn(conn)
+			wg.Done()
+		}()
+	}
+	mux.close()
+	wg.Wait()
+}
+
+// stops accepting processes and closes the connections of those attached
+func (mux *mux) close() {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	if mux.closed {
+		return
+	}
+	mux.closed = true
+	mux.idle.Stop()
+	mux.listener.Close()
+	for conn := range mux.conns {
+		conn.Close()
+	}
+}
+
+// serves a process attached to the multiplexer
+func (mux *mux) serveConn(conn net.Conn) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, mux.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+
+	mux.mutex.Lock()
+	if mux.closed {
+		mux.mutex.Unlock()
+		return
+	}
+	mux.conns[sshConn] = true
+	mux.idle.Stop()
+	mux.mutex.Unlock()
+
+	go mux.handleRequests(sshConn, reqs)
+	var wg sync.WaitGroup
+	for newChan := range chans {
+		wg.Add(1)
+		go func(newChan ssh.NewChannel) {
+			proxyChannel(mux.server.client, newChan)
+			wg.Done()
+		}(newChan)
+	}
+	wg.Wait()
+
+	// the idle timeout starts once the last process detaches
+	mux.mutex.Lock()
+	delete(mux.conns, sshConn)
+	if len(mux.conns) == 0 && !mux.closed {
+		mux.idle.Reset(mux.idleTimeout)
+	}
+	mux.mutex.Unlock()
+}
+
+// handles the global requests of an attached process
+// those not meant for the multiplexer are forwarded to the server
+func (mux *mux) handleRequests(conn *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case muxInfoRequest:
+			mux.mutex.Lock()
+			// the process asking is not counted
+			clients := len(mux.conns) - 1
+			mux.mutex.Unlock()
+			req.Reply(true, ssh.Marshal(muxInfoMsg{
+				Server:      mux.server.Name,
+				PID:         uint32(os.Getpid()),
+				Started:     uint64(mux.started.Unix()),
+				Clients:     uint32(clients),
+				IdleTimeout: uint64(mux.idleTimeout),
+			}))
+		case muxCloseRequest:
+			req.Reply(true, nil)
+			go mux.close()
+		default:
+			ok, payload, err := mux.server.client.SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply {
+				req.Reply(ok && err == nil, payload)
+			}
+		}
+	}
+}
+
+// forwards a channel opened by an attached process to the server of client
+// data and requests are copied both ways until either side closes the channel
+func proxyChannel(client *ssh.Client, newChan ssh.NewChannel) {
+	upstream, upReqs, err := client.OpenChannel(newChan.ChannelType(), newChan.ExtraData())
+	if err != nil {
+		if openErr, ok := err.(*ssh.OpenChannelError); ok {
+			newChan.Reject(openErr.Reason, openErr.Message)
+		} else {
+			newChan.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	downstream, downReqs, err := newChan.Accept()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+
+	go func() {
+		forwardRequests(upstream, downReqs)
+		upstream.Close()
+	}()
+	go copyChannel(upstream, downstream)
+
+	// the output of the server is copied entirely before the channel is closed
+	done := make(chan struct{})
+	go func() {
+		copyChannel(downstream, upstream)
+		close(done)
+	}()
+	forwardRequests(downstream, upReqs)
+	<-done
+	downstream.Close()
+}
+
+// copies the data and the standard error of src to dst, then sends EOF to dst
+// no data of either kind is accepted after EOF, so it waits for both
+func copyChannel(dst, src ssh.Channel) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		io.Copy(dst, src)
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(dst.Stderr(), src.Stderr())
+		wg.Done()
+	}()
+	wg.Wait()
+	dst.CloseWrite()
+}
+
+// sends reqs, received on one side of a proxied channel, to the other side dst
+func forwardRequests(dst ssh.Channel, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		ok, err := dst.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok && err == nil, nil)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMux(t *testing.T) {
+	stopped := testInProcessMux(t)
+	server, stats := newTestChain(t, 2, -1)
+	server.Multiplex = true
+
+	err := server.Connect()
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	if server.gateways != nil {
+		t.Fatalf("expected no gateway clients in the attached process, got '%v'", server.gateways)
+	}
+
+	// output, errors and exit statuses of commands are forwarded
+	out, err := server.runSession("echo ok")
+	if err != nil || string(out) != "ok\n" {
+		t.Fatalf("expected output 'ok', got '%s' with error '%v'", out, err)
+	}
+	_, err = server.runSession("echo oops >&2; exit 3")
+	if err == nil || !strings.Contains(err.Error(), "status 3") || !strings.Contains(err.Error(), "oops") {
+		t.Fatalf("expected error with exit status 3 and 'oops', got '%v'", err)
+	}
+
+	// sftp sessions are forwarded
+	src, dest := t.TempDir(), t.TempDir()
+	testTreeCreator(t, src, map[string]string{"file.txt": "foo"})
+	err = server.Upload(filepath.Join(src, "file.txt"), dest)
+	if err != nil {
+		t.Fatalf("expected upload error '<nil>', got '%v'", err)
+	}
+	testTreeChecker(t, dest, map[string]string{"file.txt": "foo"})
+	err = server.CloseClient()
+	if err != nil {
+		t.Fatalf("expected close error '<nil>', got '%v'", err)
+	}
+
+	// the next process attaches to the same connection
+	next := server
+	err = next.Connect()
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	out, err = next.runSession("echo ok")
+	if err != nil || string(out) != "ok\n" {
+		t.Fatalf("expected output 'ok', got '%s' with error '%v'", out, err)
+	}
+	for i, stat := range stats {
+		if stat.openConns() != 1 {
+			t.Fatalf("expected 1 open connection to hop %d, got %d", i, stat.openConns())
+		}
+		if i > 0 && stat.forwarded() != 1 {
+			t.Fatalf("expected 1 forward through hop %d, got %d", i, stat.forwarded())
+		}
+	}
+
+	muxes, err := ListMux()
+	if err != nil {
+		t.Fatalf("expected list error '<nil>', got '%v'", err)
+	}
+	if len(muxes) != 1 || muxes[0].Server != "foo" || muxes[0].Clients != 1 || muxes[0].PID != os.Getpid() || muxes[0].IdleTimeout != DefaultMuxIdleTimeout {
+		t.Fatalf("expected 1 multiplexer of foo with 1 client, got '%+v'", muxes)
+	}
+
+	// closing the multiplexer closes the whole chain and detaches the processes
+	err = CloseMux(muxes[0].Socket)
+	if err != nil {
+		t.Fatalf("expected close error '<nil>', got '%v'", err)
+	}
+	testMuxStopped(t, stopped)
+	testChainClosed(t, stats)
+	_, err = next.runSession("echo ok")
+	if err == nil {
+		t.Fatalf("expected error running command after closing the multiplexer, got '<nil>'")
+	}
+	next.CloseClient()
+	muxes, err = ListMux()
+	if err != nil || len(muxes) != 0 {
+		t.Fatalf("expected no multiplexer, got '%+v' with error '%v'", muxes, err)
+	}
+}
+
+func TestMuxIdleTimeout(t *testing.T) {
+	stopped := testInProcessMux(t)
+	server, stats := newTestChain(t, 1, -1)
+	server.Multiplex = true
+	server.MultiplexIdleTimeout = 100 * time.Millisecond
+
+	err := server.Connect()
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	socket, err := server.muxSocket()
+	if err != nil {
+		t.Fatalf("error getting multiplexer socket: %v", err)
+	}
+
+	// the multiplexer is not idle while a process is attached
+	time.Sleep(300 * time.Millisecond)
+	out, err := server.runSession("echo ok")
+	if err != nil || string(out) != "ok\n" {
+		t.Fatalf("expected output 'ok', got '%s' with error '%v'", out, err)
+	}
+
+	server.CloseClient()
+	testMuxStopped(t, stopped)
+	testChainClosed(t, stats)
+	for _, path := range []string{socket, socket + ".pub"} {
+		_, err = os.Stat(path)
+		if !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed, got '%v'", path, err)
+		}
+	}
+}
+
+func TestMuxStaleSocket(t *testing.T) {
+	stopped := testInProcessMux(t)
+	server, _ := newTestChain(t, 1, -1)
+	server.Multiplex = true
+
+	// sockets of multiplexers that are no longer running
+	socket, err := server.muxSocket()
+	if err != nil {
+		t.Fatalf("error getting multiplexer socket: %v", err)
+	}
+	other := filepath.Join(filepath.Dir(socket), "other.sock")
+	for _, path := range []string{socket, other} {
+		listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			t.Fatalf("error listening: %v", err)
+		}
+		listener.SetUnlinkOnClose(false)
+		listener.Close()
+		testTreeCreator(t, filepath.Dir(path), map[string]string{filepath.Base(path) + ".pub": "stale"})
+	}
+
+	err = server.Connect()
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	out, err := server.runSession("echo ok")
+	if err != nil || string(out) != "ok\n" {
+		t.Fatalf("expected output 'ok', got '%s' with error '%v'", out, err)
+	}
+
+	muxes, err := ListMux()
+	if err != nil || len(muxes) != 1 || muxes[0].Socket != socket {
+		t.Fatalf("expected 1 multiplexer on %s, got '%+v' with error '%v'", socket, muxes, err)
+	}
+	_, err = os.Stat(other)
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected stale socket to be removed, got '%v'", err)
+	}
+
+	server.CloseClient()
+	err = CloseMux(socket)
+	if err != nil {
+		t.Fatalf("expected close error '<nil>', got '%v'", err)
+	}
+	testMuxStopped(t, stopped)
+}
+
+func TestMuxConcurrentStart(t *testing.T) {
+	stopped := testInProcessMux(t)
+	server, stats := newTestChain(t, 0, -1)
+	server.Multiplex = true
+
+	// multiplexers started at once connect one after the other, the later ones finding the first one running
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- StartMux(context.Background(), server)
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		err := <-errs
+		if err != nil {
+			t.Fatalf("expected error '<nil>', got '%v'", err)
+		}
+	}
+	for i := 1; i < cap(errs); i++ {
+		testMuxStopped(t, stopped)
+	}
+	if stats[0].openConns() != 1 {
+		t.Fatalf("expected 1 open connection, got %d", stats[0].openConns())
+	}
+
+	err := server.Connect()
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	out, err := server.runSession("echo ok")
+	if err != nil || string(out) != "ok\n" {
+		t.Fatalf("expected output 'ok', got '%s' with error '%v'", out, err)
+	}
+	server.CloseClient()
+
+	muxes, err := ListMux()
+	if err != nil || len(muxes) != 1 {
+		t.Fatalf("expected 1 multiplexer, got '%+v' with error '%v'", muxes, err)
+	}
+	err = CloseMux(muxes[0].Socket)
+	if err != nil {
+		t.Fatalf("expected close error '<nil>', got '%v'", err)
+	}
+	testMuxStopped(t, stopped)
+}
+
+func TestMuxContext(t *testing.T) {
+	testInProcessMux(t)
+	server, _ := newTestChain(t, 0, -1)
+	server.Multiplex = true
+
+	// a multiplexer that never answers the handshake
+	socket, err := server.muxSocket()
+	if err != nil {
+		t.Fatalf("error getting multiplexer socket: %v", err)
+	}
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	hostKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	testTreeCreator(t, filepath.Dir(socket), map[string]string{filepath.Base(socket) + ".pub": string(ssh.MarshalAuthorizedKey(hostKey))})
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	connected := make(chan error, 1)
+	go func() {
+		connected <- server.ConnectContext(ctx)
+	}()
+	select {
+	case err = <-connected:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("expected error '%v', got '%v'", context.DeadlineExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected attaching to stop once the context is done")
+	}
+}
+
+func TestMuxStartError(t *testing.T) {
+	testInProcessMux(t)
+	StartMux = func(ctx context.Context, server Server) error {
+		return fmt.Errorf("no luck")
+	}
+	server, _ := newTestChain(t, 0, -1)
+	server.Multiplex = true
+
+	err := server.Connect()
+	if err == nil || !strings.Contains(err.Error(), "multiplexer of server foo: no luck") {
+		t.Fatalf("expected error starting the multiplexer, got '%v'", err)
+	}
+}
+
+func TestMuxDir(t *testing.T) {
+	testCases := []struct {
+		name   string
+		mode   os.FileMode
+		expErr bool
+	}{
+		{name: "Private", mode: 0700},
+		{name: "GroupReadable", mode: 0750, expErr: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			runtimeDir := t.TempDir()
+			t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+			err := os.Mkdir(filepath.Join(runtimeDir, "tiramolla"), 0700)
+			if err != nil {
+				t.Fatalf("error creating directory: %v", err)
+			}
+			err = os.Chmod(filepath.Join(runtimeDir, "tiramolla"), testCase.mode)
+			if err != nil {
+				t.Fatalf("error changing mode: %v", err)
+			}
+
+			dir, err := MuxDir()
+			if testCase.expErr {
+				if err == nil {
+					t.Fatalf("expected error, got '<nil>'")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '<nil>', got '%v'", err)
+			}
+			if dir != filepath.Join(runtimeDir, "tiramolla") {
+				t.Fatalf("expected '%s', got '%s'", filepath.Join(runtimeDir, "tiramolla"), dir)
+			}
+		})
+	}
+}
+
+// helper function to run the multiplexers started by the test in the test process
+// multiplexers still running when the test finishes are closed
+// returns a channel receiving the error of each multiplexer once it stops
+func testInProcessMux(t *testing.T) <-chan error {
+	t.Helper()
+
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	stopped := make(chan error, 10)
+	origStartMux := StartMux
+	StartMux = func(ctx context.Context, server Server) error {
+		ready := make(chan error, 1)
+		go func() {
+			stopped <- server.ServeMux(context.Background(), func(err error) { ready <- err })
+		}()
+		return <-ready
+	}
+	t.Cleanup(func() {
+		StartMux = origStartMux
+		muxes, _ := ListMux()
+		for _, mux := range muxes {
+			CloseMux(mux.Socket)
+		}
+	})
+	return stopped
+}
+
+// helper function to wait for a multiplexer to stop
+func testMuxStopped(t *testing.T, stopped <-chan error) {
+	t.Helper()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("expected multiplexer error '<nil>', got '%v'", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected multiplexer to stop")
+	}
+}
@@ -0,0 +1,58 @@
+//go:build !windows
+
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// interval between the attempts to take the startup lock of a multiplexer
+const muxLockInterval = 50 * time.Millisecond
+
+// takes the startup lock of the multiplexer listening on socket, an flock of socket.lock,
+// waiting for it until ctx is done
+// the lock file is kept, as removing it would let two processes lock different files
+func lockMux(ctx context.Context, socket string) (unlock func(), err error) {
+	file, err := os.OpenFile(socket+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error locking multiplexer: %v", err)
+	}
+	for {
+		err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			// closing the file releases the lock
+			return func() { file.Close() }, nil
+		}
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			file.Close()
+			return nil, fmt.Errorf("error locking multiplexer: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		case <-time.After(muxLockInterval):
+		}
+	}
+}
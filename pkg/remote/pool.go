@@ -0,0 +1,132 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// pool of the clients of gateways, shared by the servers of the process reached through them
+var pool = &gatewayPool{clients: make(map[string]*pooledClient), connecting: make(map[string]chan struct{})}
+
+// gatewayPool holds the clients of gateways, keyed by the identities of the hops leading to them,
+// so that servers sharing the start of their chain reuse its clients
+type gatewayPool struct {
+	mutex   sync.Mutex
+	clients map[string]*pooledClient
+	// gateways being connected to, each channel is closed once the connection is done
+	connecting map[string]chan struct{}
+}
+
+// pooledClient is the client of a gateway, closed once no server uses it
+type pooledClient struct {
+	key    string
+	client *ssh.Client
+	refs   int
+}
+
+// gatewayLease holds the clients of the gateways used by a connected server, starting from the farthest
+// copies of the server share it, so that the clients are released once
+type gatewayLease struct {
+	once    sync.Once
+	clients []*pooledClient
+}
+
+// returns the identity of the gateway as a hop in the key of the pool
+func (server Server) hopKey() string {
+	return fmt.Sprintf("%s\x00%s\x00%d\x00%s\x00", server.Name, server.Addr, server.Port, fromEnv(server.User))
+}
+
+// returns the client of the gateway with key, connecting it with connect if not in the pool, and adds it to lease
+// the pool is not locked while connecting, servers needing the same gateway wait for the connection until ctx is done
+func (pool *gatewayPool) acquire(ctx context.Context, key string, lease *gatewayLease, connect func() (*ssh.Client, error)) (*ssh.Client, error) {
+	pool.mutex.Lock()
+	for {
+		if pooled, ok := pool.clients[key]; ok {
+			pooled.refs++
+			lease.clients = append(lease.clients, pooled)
+			pool.mutex.Unlock()
+			return pooled.client, nil
+		}
+		done, ok := pool.connecting[key]
+		if !ok {
+			break
+		}
+		// if the connection fails, the next server in line connects
+		pool.mutex.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		pool.mutex.Lock()
+	}
+	done := make(chan struct{})
+	pool.connecting[key] = done
+	pool.mutex.Unlock()
+
+	client, err := connect()
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	delete(pool.connecting, key)
+	close(done)
+	if err != nil {
+		return nil, err
+	}
+	pooled := &pooledClient{key: key, client: client, refs: 1}
+	pool.clients[key] = pooled
+	lease.clients = append(lease.clients, pooled)
+	// a lost connection is no longer handed out, the servers using it get errors and reconnect
+	go func() {
+		client.Wait()
+		pool.remove(pooled)
+	}()
+	return client, nil
+}
+
+// removes pooled from the pool, if it is still there
+func (pool *gatewayPool) remove(pooled *pooledClient) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if pool.clients[pooled.key] == pooled {
+		delete(pool.clients, pooled.key)
+	}
+}
+
+// releases the clients of the lease, closing those no longer used, nearest to the server first
+func (lease *gatewayLease) release() {
+	lease.once.Do(func() {
+		pool.mutex.Lock()
+		defer pool.mutex.Unlock()
+
+		for i := len(lease.clients) - 1; i >= 0; i-- {
+			pooled := lease.clients[i]
+			pooled.refs--
+			if pooled.refs == 0 {
+				pooled.client.Close()
+				if pool.clients[pooled.key] == pooled {
+					delete(pool.clients, pooled.key)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,217 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGatewayPool(t *testing.T) {
+	// foo and bar are both reached through gw1, which is reached through gw2
+	hops := map[string]*testServerStats{}
+	servers := make(map[string]ServerInterface)
+	for name, gateway := range map[string]string{"gw2": "", "gw1": "gw2", "foo": "gw1", "bar": "gw1", "qux": "gw2"} {
+		hops[name] = &testServerStats{}
+		server := newTestSSHServerWithOptions(t, &ssh.ServerConfig{NoClientAuth: true}, testServerOptions{stats: hops[name]})
+		server.Name = name
+		server.Gateway = gateway
+		server.AuthenticationMethod = "password"
+		servers[name] = &server
+	}
+	connect := func(name string) Server {
+		t.Helper()
+		server := *servers[name].(*Server)
+		err := server.CreateServerChain(servers)
+		if err != nil {
+			t.Fatalf("error creating server chain: %v", err)
+		}
+		err = server.Connect()
+		if err != nil {
+			t.Fatalf("expected error '<nil>', got '%v'", err)
+		}
+		return server
+	}
+	expect := func(expOpen map[string]int) {
+		t.Helper()
+		for name, exp := range expOpen {
+			testOpenConns(t, name, hops[name], exp)
+		}
+	}
+
+	foo := connect("foo")
+	bar := connect("bar")
+	qux := connect("qux")
+	// the gateways are connected to once, gw1 forwards to both foo and bar
+	expect(map[string]int{"gw2": 1, "gw1": 1, "foo": 1, "bar": 1, "qux": 1})
+	if hops["gw1"].forwarded() != 2 || hops["gw2"].forwarded() != 2 {
+		t.Fatalf("expected 2 forwards through gw1 and gw2, got %d and %d", hops["gw1"].forwarded(), hops["gw2"].forwarded())
+	}
+
+	// closing foo, even more than once, leaves the gateways of bar open
+	foo.CloseClient()
+	foo.CloseClient()
+	expect(map[string]int{"gw2": 1, "gw1": 1, "foo": 0, "bar": 1})
+	out, err := bar.runSession("echo ok")
+	if err != nil || string(out) != "ok\n" {
+		t.Fatalf("expected output 'ok', got '%s' with error '%v'", out, err)
+	}
+
+	// gw1 is closed along with bar, its last server, gw2 is still used by qux
+	bar.CloseClient()
+	expect(map[string]int{"gw2": 1, "gw1": 0, "bar": 0, "qux": 1})
+
+	// gw1 is connected to again when needed
+	foo = connect("foo")
+	expect(map[string]int{"gw2": 1, "gw1": 1, "foo": 1})
+
+	foo.CloseClient()
+	qux.CloseClient()
+	expect(map[string]int{"gw2": 0, "gw1": 0, "foo": 0, "qux": 0})
+}
+
+func TestGatewayPoolLostConnection(t *testing.T) {
+	server, stats := newTestChain(t, 1, -1)
+	err := server.Connect()
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+
+	// the connection to the gateway is lost, the next server connects to it again
+	server.gateways.clients[0].client.Close()
+	testOpenConns(t, "gw1", stats[1], 0)
+	next := server
+	err = next.Connect()
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	testOpenConns(t, "gw1", stats[1], 1)
+	out, err := next.runSession("echo ok")
+	if err != nil || string(out) != "ok\n" {
+		t.Fatalf("expected output 'ok', got '%s' with error '%v'", out, err)
+	}
+
+	server.CloseClient()
+	next.CloseClient()
+	testChainClosed(t, stats)
+}
+
+func TestGatewayPoolConcurrentConnect(t *testing.T) {
+	clients := make([]*ssh.Client, 2)
+	for i := range clients {
+		server := newTestSSHServerWithOptions(t, &ssh.ServerConfig{NoClientAuth: true}, testServerOptions{})
+		server.AuthenticationMethod = "password"
+		err := server.Connect()
+		if err != nil {
+			t.Fatalf("expected error '<nil>', got '%v'", err)
+		}
+		clients[i] = server.client
+	}
+	type result struct {
+		client *ssh.Client
+		err    error
+	}
+	acquire := func(ctx context.Context, key string, lease *gatewayLease, connect func() (*ssh.Client, error)) <-chan result {
+		acquired := make(chan result, 1)
+		go func() {
+			client, err := pool.acquire(ctx, key, lease, connect)
+			acquired <- result{client, err}
+		}()
+		return acquired
+	}
+	wait := func(acquired <-chan result) result {
+		t.Helper()
+		select {
+		case res := <-acquired:
+			return res
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected acquire to return")
+		}
+		return result{}
+	}
+	unexpected := func() (*ssh.Client, error) {
+		t.Errorf("expected no second connection to gw1")
+		return nil, fmt.Errorf("unexpected connection")
+	}
+
+	// gw1 takes a while to connect to
+	slow := make(chan struct{})
+	first := &gatewayLease{}
+	connecting := acquire(context.Background(), "gw1", first, func() (*ssh.Client, error) {
+		<-slow
+		return clients[0], nil
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pool.mutex.Lock()
+		_, ok := pool.connecting["gw1"]
+		pool.mutex.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected gw1 to be connecting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// other gateways are connected to meanwhile
+	other := &gatewayLease{}
+	res := wait(acquire(context.Background(), "gw2", other, func() (*ssh.Client, error) {
+		return clients[1], nil
+	}))
+	if res.err != nil || res.client != clients[1] {
+		t.Fatalf("expected client of gw2, got '%v' with error '%v'", res.client, res.err)
+	}
+	other.release()
+
+	// servers needing gw1 wait for the connection, unless their context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled := &gatewayLease{}
+	res = wait(acquire(ctx, "gw1", cancelled, unexpected))
+	if res.err != context.Canceled || len(cancelled.clients) != 0 {
+		t.Fatalf("expected error '%v' and no clients, got '%v' and %d clients", context.Canceled, res.err, len(cancelled.clients))
+	}
+	second := &gatewayLease{}
+	waiting := acquire(context.Background(), "gw1", second, unexpected)
+	close(slow)
+	for _, acquired := range []<-chan result{connecting, waiting} {
+		res = wait(acquired)
+		if res.err != nil || res.client != clients[0] {
+			t.Fatalf("expected client of gw1, got '%v' with error '%v'", res.client, res.err)
+		}
+	}
+	first.release()
+	second.release()
+}
+
+// helper function to wait for the number of open connections to a hop to be exp
+func testOpenConns(t *testing.T, name string, stats *testServerStats, exp int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for stats.openConns() != exp {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d open connections to %s, got %d", exp, name, stats.openConns())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
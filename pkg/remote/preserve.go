@@ -0,0 +1,272 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// WithPreserve keeps the mode bits, access and modification times of copied files, like scp -p
+// the owner and group are kept too if the destination is written by root or by BecomeUser
+func WithPreserve() CopyOption {
+	return func(options *copyOptions) {
+		options.preserve = true
+	}
+}
+
+// fileMetadata holds the attributes of a file kept by WithPreserve
+type fileMetadata struct {
+	mode  os.FileMode
+	atime time.Time
+	mtime time.Time
+	// owner and group are unknown if owned is false
+	uid, gid int
+	owned    bool
+}
+
+// returns the metadata of a local file
+func localMetadata(info os.FileInfo) fileMetadata {
+	meta := fileMetadata{mode: info.Mode().Perm(), atime: info.ModTime(), mtime: info.ModTime()}
+	localOwnerAndAccessTime(info, &meta)
+	return meta
+}
+
+// returns the metadata of a file of an sftp server
+func remoteMetadata(info os.FileInfo) fileMetadata {
+	meta := fileMetadata{mode: info.Mode().Perm(), atime: info.ModTime(), mtime: info.ModTime()}
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		meta.atime = time.Unix(int64(stat.Atime), 0)
+		meta.uid, meta.gid, meta.owned = int(stat.UID), int(stat.GID), true
+	}
+	return meta
+}
+
+// sets the metadata of path on the server of client
+// the owner is set only if chown is true
+func (meta fileMetadata) applyRemote(client *sftp.Client, path string, chown bool) error {
+	if chown && meta.owned {
+		err := client.Chown(path, meta.uid, meta.gid)
+		if err != nil {
+			return fmt.Errorf("error preserving owner of %s: %v", path, err)
+		}
+	}
+	err := client.Chmod(path, meta.mode)
+	if err != nil {
+		return fmt.Errorf("error preserving mode of %s: %v", path, err)
+	}
+	err = client.Chtimes(path, meta.atime, meta.mtime)
+	if err != nil {
+		return fmt.Errorf("error preserving times of %s: %v", path, err)
+	}
+	return nil
+}
+
+// sets the metadata of a local path
+// the owner is set only when running as root
+func (meta fileMetadata) applyLocal(path string) error {
+	if meta.owned && os.Geteuid() == 0 {
+		err := os.Lchown(path, meta.uid, meta.gid)
+		if err != nil {
+			return fmt.Errorf("error preserving owner of %s: %v", path, err)
+		}
+	}
+	err := os.Chmod(path, meta.mode)
+	if err != nil {
+		return fmt.Errorf("error preserving mode of %s: %v", path, err)
+	}
+	err = os.Chtimes(path, meta.atime, meta.mtime)
+	if err != nil {
+		return fmt.Errorf("error preserving times of %s: %v", path, err)
+	}
+	return nil
+}
+
+// reports whether files written over the sftp sessions of Server can be given another owner
+func (server Server) canChown() bool {
+	if server.sftpAsBecomeUser() {
+		return server.BecomeUser == "root"
+	}
+	return fromEnv(server.User) == "root"
+}
+
+// returns the metadata of the local path and, if it is a directory, of the directories and regular files under it,
+// keyed by their path relative to the parent directory of path
+func localTreeMetadata(path string) (map[string]fileMetadata, error) {
+	metadata := make(map[string]fileMetadata)
+	err := filepath.WalkDir(path, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking source directory: %v", err)
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("error reading attributes of %s: %v", p, err)
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		metadata[filepath.Join(filepath.Base(path), rel)] = localMetadata(info)
+		return nil
+	})
+	return metadata, err
+}
+
+// returns the metadata of path on the server of client and, if it is a directory,
+// of the directories and regular files under it, keyed by their path relative to the parent directory of path
+func remoteTreeMetadata(client *sftp.Client, path string) (map[string]fileMetadata, error) {
+	metadata := make(map[string]fileMetadata)
+	walker := client.Walk(path)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, fmt.Errorf("error walking source directory: %v", err)
+		}
+		info := walker.Stat()
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			continue
+		}
+		rel, err := filepath.Rel(path, walker.Path())
+		if err != nil {
+			return nil, err
+		}
+		metadata[filepath.Join(filepath.Base(path), rel)] = remoteMetadata(info)
+	}
+	return metadata, nil
+}
+
+// returns the metadata of source, the original of a copy from Server
+// read by BecomeUser if set, as the main user may not have access to it, unless the sftp sessions run as BecomeUser
+func (server Server) sourceMetadata(client *sftp.Client, source string) (map[string]fileMetadata, error) {
+	if server.BecomeUser != "" && !server.sftpAsBecomeUser() {
+		return server.becomeMetadata(source)
+	}
+	return remoteTreeMetadata(client, source)
+}
+
+// returns the metadata of path and, if it is a directory, of the directories and regular files under it,
+// read by BecomeUser as the main user may not have access to them
+// metadata are keyed by their path relative to the parent directory of path
+func (server Server) becomeMetadata(path string) (map[string]fileMetadata, error) {
+	// the base name is prefixed with ./ so that it is not taken for an option of find
+	cmd := fmt.Sprintf(`cd -- %s && find %s \( -type f -o -type d \) -exec stat -c '%%a %%X %%Y %%u %%g %%n' {} +`,
+		shellQuote(filepath.Dir(path)), shellQuote("./"+filepath.Base(path)))
+	out, err := server.runCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("error reading attributes of %s: %v", path, err)
+	}
+
+	metadata := make(map[string]fileMetadata)
+	for _, line := range strings.Split(string(out), "\n") {
+		// lines of file names with newlines do not parse and are skipped
+		fields := strings.SplitN(line, " ", 6)
+		if len(fields) != 6 {
+			continue
+		}
+		mode, err1 := strconv.ParseUint(fields[0], 8, 32)
+		atime, err2 := strconv.ParseInt(fields[1], 10, 64)
+		mtime, err3 := strconv.ParseInt(fields[2], 10, 64)
+		uid, err4 := strconv.Atoi(fields[3])
+		gid, err5 := strconv.Atoi(fields[4])
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil {
+			continue
+		}
+		metadata[filepath.Clean(fields[5])] = fileMetadata{
+			mode:  os.FileMode(mode).Perm(),
+			atime: time.Unix(atime, 0),
+			mtime: time.Unix(mtime, 0),
+			uid:   uid,
+			gid:   gid,
+			owned: true,
+		}
+	}
+	return metadata, nil
+}
+
+// returns the keys of metadata in reverse order, so that directories come after their contents
+// and their modification times are not changed by setting the metadata of the contents
+func metadataPaths(metadata map[string]fileMetadata) []string {
+	paths := make([]string, 0, len(metadata))
+	for path := range metadata {
+		paths = append(paths, path)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	return paths
+}
+
+// sets metadata, keyed by paths relative to dir, to the local files under dir
+func applyLocalMetadata(dir string, metadata map[string]fileMetadata) error {
+	for _, path := range metadataPaths(metadata) {
+		err := metadata[path].applyLocal(filepath.Join(dir, path))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sets metadata, keyed by paths relative to dir, to the files under dir on the server of client
+// the owners are set only if chown is true
+func applyRemoteMetadata(client *sftp.Client, dir string, metadata map[string]fileMetadata, chown bool) error {
+	for _, path := range metadataPaths(metadata) {
+		err := metadata[path].applyRemote(client, client.Join(dir, filepath.ToSlash(path)), chown)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sets the modes and, if BecomeUser is root, the owners of metadata, keyed by paths relative to dir, to the files under dir
+// switch user to BecomeUser to do it
+// the modes of a copy of staged files have the group bits widened by the ACL giving BecomeUser access to them
+func (server Server) restoreAsBecomeUser(dir string, metadata map[string]fileMetadata) error {
+	// files of the same owner or mode are changed by a single command
+	owners := make(map[string][]string)
+	modes := make(map[os.FileMode][]string)
+	for _, path := range metadataPaths(metadata) {
+		meta := metadata[path]
+		quoted := shellQuote(filepath.Join(dir, path))
+		if server.BecomeUser == "root" && meta.owned {
+			owner := fmt.Sprintf("%d:%d", meta.uid, meta.gid)
+			owners[owner] = append(owners[owner], quoted)
+		}
+		modes[meta.mode] = append(modes[meta.mode], quoted)
+	}
+	for owner, paths := range owners {
+		_, err := server.runCommand(fmt.Sprintf("chown %s -- %s", owner, strings.Join(paths, " ")))
+		if err != nil {
+			return fmt.Errorf("error preserving owners in %s: %v", dir, err)
+		}
+	}
+	for mode, paths := range modes {
+		_, err := server.runCommand(fmt.Sprintf("chmod %o -- %s", mode, strings.Join(paths, " ")))
+		if err != nil {
+			return fmt.Errorf("error preserving modes in %s: %v", dir, err)
+		}
+	}
+	return nil
+}
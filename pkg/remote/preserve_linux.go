@@ -0,0 +1,30 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// sets the owner, group and access time of meta from the local file of info
+func localOwnerAndAccessTime(info os.FileInfo, meta *fileMetadata) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		meta.atime = time.Unix(stat.Atim.Unix())
+		meta.uid, meta.gid, meta.owned = int(stat.Uid), int(stat.Gid), true
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPreserve(t *testing.T) {
+	testCases := []struct {
+		name       string
+		becomeUser string
+		becomePass string
+		transfer   string
+		copy       func(server Server, src, dest string, opts ...CopyOption) error
+	}{
+		{name: "Upload", copy: Server.Upload},
+		{name: "Download", copy: Server.Download},
+		{name: "CopyTo", copy: func(server Server, src, dest string, opts ...CopyOption) error {
+			return server.CopyTo(src, &server, dest, opts...)
+		}},
+		{name: "UploadBecomeUser", becomeUser: "app", copy: Server.Upload},
+		{name: "DownloadBecomeUser", becomeUser: "app", copy: Server.Download},
+		{name: "DownloadBecomeUserWithPassword", becomeUser: "app", becomePass: "secret", copy: Server.Download},
+		{name: "UploadStream", becomeUser: "app", transfer: BecomeTransferStream, copy: Server.Upload},
+		{name: "DownloadStream", becomeUser: "app", transfer: BecomeTransferStream, copy: Server.Download},
+		{name: "UploadSFTP", becomeUser: "app", transfer: BecomeTransferSFTP, copy: Server.Upload},
+		{name: "DownloadSFTP", becomeUser: "app", transfer: BecomeTransferSFTP, copy: Server.Download},
+		{name: "CopyToFromBecomeUser", becomeUser: "app", copy: func(server Server, src, dest string, opts ...CopyOption) error {
+			target := newConnectedTestServer(t)
+			return server.CopyTo(src, &target, dest, opts...)
+		}},
+		{name: "CopyToBecomeUser", becomeUser: "app", copy: func(server Server, src, dest string, opts ...CopyOption) error {
+			source := newConnectedTestServer(t)
+			return source.CopyTo(src, &server, dest, opts...)
+		}},
+		{name: "CopyToBetweenBecomeUsers", becomeUser: "app", copy: func(server Server, src, dest string, opts ...CopyOption) error {
+			return server.CopyTo(src, &server, dest, opts...)
+		}},
+	}
+
+	// modes and modification times of the copied tree
+	expModes := map[string]os.FileMode{
+		"foo":             0750,
+		"foo/run.sh":      0755,
+		"foo/private.txt": 0600,
+		"foo/qux":         0710,
+		"foo/qux/quux.sh": 0700,
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var server Server
+			if testCase.becomeUser != "" {
+				server = newBecomeTestServer(t, testCase.becomeUser, testCase.becomePass)
+				server.BecomeTransfer = testCase.transfer
+				if testCase.transfer == BecomeTransferSFTP {
+					server.SFTPServer = testSFTPServer(t)
+				}
+			} else {
+				server = newConnectedTestServer(t)
+			}
+			src, dest := t.TempDir(), t.TempDir()
+			testTreeCreator(t, src, map[string]string{"foo/run.sh": "run", "foo/private.txt": "private", "foo/qux/quux.sh": "quux"})
+			for _, path := range []string{"foo/run.sh", "foo/private.txt", "foo/qux/quux.sh", "foo/qux", "foo"} {
+				err := os.Chmod(filepath.Join(src, path), expModes[path])
+				if err != nil {
+					t.Fatalf("error changing mode: %v", err)
+				}
+				err = os.Chtimes(filepath.Join(src, path), mtime, mtime)
+				if err != nil {
+					t.Fatalf("error changing times: %v", err)
+				}
+			}
+
+			err := testCase.copy(server, filepath.Join(src, "foo"), dest, WithRecursive(), WithPreserve())
+			if err != nil {
+				t.Fatalf("expected error '<nil>', got '%v'", err)
+			}
+			testTreeChecker(t, dest, map[string]string{"foo/run.sh": "run", "foo/private.txt": "private", "foo/qux/quux.sh": "quux"})
+			for path, mode := range expModes {
+				info, err := os.Stat(filepath.Join(dest, path))
+				if err != nil {
+					t.Fatalf("error reading copied file: %v", err)
+				}
+				if info.Mode().Perm() != mode {
+					t.Fatalf("expected mode %v of %s, got %v", mode, path, info.Mode().Perm())
+				}
+				if !info.ModTime().Equal(mtime) {
+					t.Fatalf("expected modification time %v of %s, got %v", mtime, path, info.ModTime())
+				}
+			}
+		})
+	}
+}
+
+func TestNoPreserve(t *testing.T) {
+	server := newConnectedTestServer(t)
+	src, dest := t.TempDir(), t.TempDir()
+	testTreeCreator(t, src, map[string]string{"foo.sh": "foo"})
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	err := os.Chtimes(filepath.Join(src, "foo.sh"), mtime, mtime)
+	if err != nil {
+		t.Fatalf("error changing times: %v", err)
+	}
+
+	err = server.Upload(filepath.Join(src, "foo.sh"), dest)
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	info, err := os.Stat(filepath.Join(dest, "foo.sh"))
+	if err != nil {
+		t.Fatalf("error reading copied file: %v", err)
+	}
+	if info.ModTime().Equal(mtime) {
+		t.Fatalf("expected new modification time of copy, got %v", info.ModTime())
+	}
+}
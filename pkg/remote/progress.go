@@ -0,0 +1,140 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Progress describes the state of the transfer of a file
+type Progress struct {
+	// source path of the file
+	File string
+	// bytes of the file at destination, including the part of a resumed transfer
+	Transferred int64
+	// size of the file
+	Total int64
+	// bytes already at destination when the transfer started
+	Resumed int64
+	// time the transfer started
+	Started time.Time
+}
+
+// ProgressFunc is called as a transfer advances
+// it runs on the goroutine of the transfer, so it should return quickly
+type ProgressFunc func(Progress)
+
+// WithProgress reports the progress of every transferred file to fn
+func WithProgress(fn ProgressFunc) CopyOption {
+	return func(options *copyOptions) {
+		options.progress = fn
+	}
+}
+
+// Rate returns the transfer rate in bytes per second
+func (progress Progress) Rate() float64 {
+	elapsed := time.Since(progress.Started).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(progress.Transferred-progress.Resumed) / elapsed
+}
+
+// ETA returns the estimated time until the transfer completes
+// it is zero if the rate is not known yet
+func (progress Progress) ETA() time.Duration {
+	rate := progress.Rate()
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(progress.Total-progress.Transferred) / rate * float64(time.Second))
+}
+
+// progressTracker calls the progress function of a transfer as bytes are moved
+type progressTracker struct {
+	fn       ProgressFunc
+	progress Progress
+}
+
+// constructs the tracker of the transfer of file, starting at offset
+// returns nil if there is no progress function
+func newProgressTracker(fn ProgressFunc, file string, size, offset int64) *progressTracker {
+	if fn == nil {
+		return nil
+	}
+	tracker := &progressTracker{
+		fn: fn,
+		progress: Progress{
+			File:        file,
+			Transferred: offset,
+			Total:       size,
+			Resumed:     offset,
+			Started:     time.Now(),
+		},
+	}
+	fn(tracker.progress)
+	return tracker
+}
+
+// account for n more bytes transferred
+// a nil tracker does nothing
+func (tracker *progressTracker) add(n int) {
+	if tracker == nil || n <= 0 {
+		return
+	}
+	tracker.progress.Transferred += int64(n)
+	tracker.fn(tracker.progress)
+}
+
+// progressReader tracks the bytes read from a reader, failing once ctx is done
+// Size allows sftp to upload concurrently, as it does for files
+type progressReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	size    int64
+	tracker *progressTracker
+}
+
+func (reader *progressReader) Read(p []byte) (int, error) {
+	if err := reader.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := reader.reader.Read(p)
+	reader.tracker.add(n)
+	return n, err
+}
+
+func (reader *progressReader) Size() int64 {
+	return reader.size
+}
+
+// progressWriter tracks the bytes written to a writer, failing once ctx is done
+type progressWriter struct {
+	ctx     context.Context
+	writer  io.Writer
+	tracker *progressTracker
+}
+
+func (writer *progressWriter) Write(p []byte) (int, error) {
+	if err := writer.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := writer.writer.Write(p)
+	writer.tracker.add(n)
+	return n, err
+}
@@ -0,0 +1,147 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressRateAndETA(t *testing.T) {
+	testCases := []struct {
+		name    string
+		elapsed time.Duration
+		p       Progress
+		expRate float64
+		expETA  time.Duration
+	}{
+		{
+			name:    "HalfWay",
+			elapsed: 10 * time.Second,
+			p:       Progress{Transferred: 500, Total: 1000},
+			expRate: 50,
+			expETA:  10 * time.Second,
+		},
+		{
+			name:    "Resumed",
+			elapsed: 10 * time.Second,
+			p:       Progress{Transferred: 600, Total: 1000, Resumed: 400},
+			expRate: 20,
+			expETA:  20 * time.Second,
+		},
+		{
+			name:    "NothingTransferred",
+			elapsed: 10 * time.Second,
+			p:       Progress{Transferred: 400, Total: 1000, Resumed: 400},
+			expRate: 0,
+			expETA:  0,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			p := testCase.p
+			p.Started = time.Now().Add(-testCase.elapsed)
+
+			rate := p.Rate()
+			if math.Abs(rate-testCase.expRate) > testCase.expRate/100 {
+				t.Fatalf("expected rate %f, got %f", testCase.expRate, rate)
+			}
+			eta := p.ETA()
+			if d := eta - testCase.expETA; d > time.Second/10 || d < -time.Second/10 {
+				t.Fatalf("expected ETA %v, got %v", testCase.expETA, eta)
+			}
+		})
+	}
+}
+
+func TestProgressTracker(t *testing.T) {
+	content := strings.Repeat("foo", 10000)
+
+	var reported []Progress
+	fn := func(p Progress) { reported = append(reported, p) }
+
+	// reading
+	tracker := newProgressTracker(fn, "foo", int64(len(content))+3, 3)
+	reader := &progressReader{ctx: context.Background(), reader: strings.NewReader(content), size: int64(len(content)), tracker: tracker}
+	if reader.Size() != int64(len(content)) {
+		t.Fatalf("expected size %d, got %d", len(content), reader.Size())
+	}
+	_, err := io.Copy(io.Discard, reader)
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	testProgressChecker(t, reported, "foo", int64(len(content))+3, 3)
+
+	// writing
+	reported = nil
+	tracker = newProgressTracker(fn, "bar", int64(len(content)), 0)
+	var buf bytes.Buffer
+	writer := &progressWriter{ctx: context.Background(), writer: &buf, tracker: tracker}
+	_, err = io.Copy(writer, strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	testProgressChecker(t, reported, "bar", int64(len(content)), 0)
+
+	// no progress function
+	if newProgressTracker(nil, "foo", 0, 0) != nil {
+		t.Fatalf("expected no tracker without progress function")
+	}
+
+	// cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reader = &progressReader{ctx: ctx, reader: strings.NewReader(content)}
+	_, err = io.Copy(io.Discard, reader)
+	if err != context.Canceled {
+		t.Fatalf("expected error '%v', got '%v'", context.Canceled, err)
+	}
+	writer = &progressWriter{ctx: ctx, writer: &buf}
+	_, err = io.Copy(writer, strings.NewReader(content))
+	if err != context.Canceled {
+		t.Fatalf("expected error '%v', got '%v'", context.Canceled, err)
+	}
+}
+
+// helper function to check the reported progress of a transfer
+// starting at offset and completing at size
+func testProgressChecker(t *testing.T, reported []Progress, file string, size, offset int64) {
+	t.Helper()
+
+	if len(reported) == 0 {
+		t.Fatalf("expected progress to be reported")
+	}
+	if reported[0].Transferred != offset {
+		t.Fatalf("expected first report at %d, got %d", offset, reported[0].Transferred)
+	}
+	for i, p := range reported {
+		if p.File != file || p.Total != size || p.Resumed != offset {
+			t.Fatalf("unexpected report %+v", p)
+		}
+		if i > 0 && p.Transferred < reported[i-1].Transferred {
+			t.Fatalf("expected increasing progress, got %d after %d", p.Transferred, reported[i-1].Transferred)
+		}
+	}
+	if last := reported[len(reported)-1]; last.Transferred != size {
+		t.Fatalf("expected last report at %d, got %d", size, last.Transferred)
+	}
+}
@@ -0,0 +1,319 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+)
+
+// CopyTo copies file or directory of Server to dest on target
+// data is streamed from one sftp session to the other and never written to local disk
+// both servers have to be connected
+func (server Server) CopyTo(file string, target ServerInterface, dest string, opts ...CopyOption) error {
+	return server.CopyToContext(context.Background(), file, target, dest, opts...)
+}
+
+// CopyToContext copies file or directory of Server to dest on target like CopyTo
+// once ctx is done the copy stops, removing the partial file unless resuming, and any staged files
+// if the server does not respond by then, its connection is closed and the files left on it are named in the error
+func (server Server) CopyToContext(ctx context.Context, file string, target ServerInterface, dest string, opts ...CopyOption) (err error) {
+	options := newCopyOptions(ctx, opts)
+	err = validateChecksum(options.verify)
+	if err != nil {
+		return err
+	}
+	dst, ok := target.(*Server)
+	if !ok {
+		return fmt.Errorf("copying to %s is not supported", target.GetName())
+	}
+	filename := filepath.Base(file)
+	source := file
+
+	// files of BecomeUser are staged when streaming too, as streams are only between local and remote files,
+	// so the become transfers are only checked
+	for _, s := range []*Server{&server, dst} {
+		if _, err := s.streaming(); err != nil {
+			return err
+		}
+	}
+
+	// open an SFTP session over the existing ssh connection of each server
+	srcClient, err := server.newSFTPClient()
+	if err != nil {
+		return fmt.Errorf("server %s: %v", server.Name, err)
+	}
+	defer srcClient.Close()
+	dstClient, err := dst.newSFTPClient()
+	if err != nil {
+		return fmt.Errorf("server %s: %v", dst.Name, err)
+	}
+	defer dstClient.Close()
+	stopSrc := server.closeOnDone(ctx, srcClient)
+	defer stopSrc()
+	stopDst := dst.closeOnDone(ctx, dstClient)
+	defer stopDst()
+
+	// if files of BecomeUser of the source are staged, the file is first copied to a private staging directory,
+	// the same way as for downloading
+	if server.staging() {
+		var staged string
+		var cleanup func() error
+		staged, cleanup, err = server.stageAsBecomeUser(file, options.recursive)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err = withLeftover(err, server.removeLeftover(ctx, filepath.Dir(staged), cleanup))
+		}()
+		file = staged
+	}
+
+	// check the source
+	info, err := srcClient.Stat(file)
+	if err != nil {
+		return fmt.Errorf("error opening source file: %v", err)
+	}
+	if info.IsDir() && !options.recursive {
+		return fmt.Errorf("%s is a directory, recursive copy is required", file)
+	}
+	var metadata map[string]fileMetadata
+	if options.preserve {
+		metadata, err = server.sourceMetadata(srcClient, source)
+		if err != nil {
+			return err
+		}
+	}
+
+	// if files of BecomeUser of the destination are staged, the file is copied to a private staging directory
+	// and picked up from there, the same way as for uploading
+	targetPath := filepath.Join(dest, filename)
+	var staging string
+	if dst.staging() {
+		staging, err = dst.uploadStagingDir(dstClient, options.resume)
+		if err != nil {
+			return err
+		}
+		if !options.resume {
+			defer func() {
+				err = withLeftover(err, dst.removeOverSFTP(ctx, dstClient, staging))
+			}()
+		}
+		targetPath = filepath.Join(staging, filename)
+	}
+
+	if info.IsDir() {
+		err = server.copyRemoteDir(dst, srcClient, dstClient, file, targetPath, options)
+	} else {
+		err = server.copyRemoteFile(dst, srcClient, dstClient, file, targetPath, options)
+	}
+	if err != nil {
+		return err
+	}
+	if options.preserve {
+		err = applyRemoteMetadata(dstClient, filepath.Dir(targetPath), metadata, !dst.staging() && dst.canChown())
+		if err != nil {
+			return err
+		}
+	}
+
+	if dst.staging() {
+		err = dst.grantBecomeUser(staging)
+		if err != nil {
+			return err
+		}
+		err = dst.copyAsBecomeUser(targetPath, dest, info.IsDir(), options.preserve)
+		if err != nil {
+			return err
+		}
+		if options.preserve {
+			err = dst.restoreAsBecomeUser(dest, metadata)
+			if err != nil {
+				return err
+			}
+		}
+		if options.resume {
+			err = removeAll(dstClient, targetPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if options.verify != "" {
+		return server.verifyCopy(srcClient, source, file, dst, dstClient, filepath.Join(dest, filename), options.verify)
+	}
+	return nil
+}
+
+// copy a single file from Server to dest on dst over srcClient and dstClient
+func (server Server) copyRemoteFile(dst *Server, srcClient, dstClient *sftp.Client, file, dest string, options copyOptions) error {
+	if err := options.ctx.Err(); err != nil {
+		return err
+	}
+
+	// open the source file
+	srcFile, err := srcClient.Open(file)
+	if err != nil {
+		return fmt.Errorf("error opening source file: %v", err)
+	}
+	defer srcFile.Close()
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading source file: %v", err)
+	}
+
+	// find where to continue a partial copy from
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	var offset int64
+	if options.resume {
+		offset, err = server.remoteCopyOffset(srcFile, file, dst, dstClient, dest)
+		if err != nil {
+			return err
+		}
+		if offset > 0 {
+			flags = os.O_WRONLY
+		}
+	}
+
+	// create the destination file
+	dstFile, err := dstClient.OpenFile(dest, flags)
+	if err != nil {
+		return fmt.Errorf("error creating destination file: %v", err)
+	}
+	defer dstFile.Close()
+
+	// write to file
+	_, err = srcFile.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("error seeking source file: %v", err)
+	}
+	_, err = dstFile.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("error seeking destination file: %v", err)
+	}
+	tracker := newProgressTracker(options.progress, file, srcInfo.Size(), offset)
+	// Size allows the destination to be written concurrently
+	src := &progressReader{ctx: options.ctx, reader: srcFile, size: srcInfo.Size() - offset, tracker: tracker}
+	_, err = dstFile.ReadFrom(src)
+	if err != nil {
+		// once ctx is done, the sftp session is closed and its error is not the cause
+		if ctxErr := options.ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		err = fmt.Errorf("error writing to file: %v", err)
+		if options.ctx.Err() != nil && !options.resume {
+			err = withLeftover(err, dst.removeOverSFTP(options.ctx, dstClient, dest))
+		}
+		return err
+	}
+	return nil
+}
+
+// returns the offset to resume copying srcFile, opened from file, to dest on dst from
+func (server Server) remoteCopyOffset(srcFile *sftp.File, file string, dst *Server, dstClient *sftp.Client, dest string) (int64, error) {
+	dstFile, err := dstClient.Open(dest)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error opening destination file: %v", err)
+	}
+	defer dstFile.Close()
+
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error reading source file: %v", err)
+	}
+	dstInfo, err := dstFile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error reading destination file: %v", err)
+	}
+	return resumeOffset(remotePrefixChecksum(server.runAsSFTPUser, file), remotePrefixChecksum(dst.runAsSFTPUser, dest), srcInfo.Size(), dstInfo.Size()), nil
+}
+
+// copy the directory tree rooted at dir of Server to dest on dst over srcClient and dstClient
+// symbolic links and special files are skipped
+func (server Server) copyRemoteDir(dst *Server, srcClient, dstClient *sftp.Client, dir, dest string, options copyOptions) error {
+	walker := srcClient.Walk(dir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return fmt.Errorf("error walking source directory: %v", err)
+		}
+		rel, err := filepath.Rel(dir, walker.Path())
+		if err != nil {
+			return err
+		}
+		target := dstClient.Join(dest, filepath.ToSlash(rel))
+
+		switch info := walker.Stat(); {
+		case info.IsDir():
+			err = dstClient.MkdirAll(target)
+			if err != nil {
+				return fmt.Errorf("error creating destination directory %s: %v", target, err)
+			}
+		case info.Mode().IsRegular():
+			err = server.copyRemoteFile(dst, srcClient, dstClient, walker.Path(), target, options)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// verifies the copy of source on Server to remotePath on dst
+// the files to verify are found by walking file, the copy of source readable by the main user
+// mismatching files are removed from dst
+func (server Server) verifyCopy(srcClient *sftp.Client, source, file string, dst *Server, dstClient *sftp.Client, remotePath, algorithm string) error {
+	walker := srcClient.Walk(file)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return fmt.Errorf("error walking source directory: %v", err)
+		}
+		if !walker.Stat().Mode().IsRegular() {
+			continue
+		}
+		rel, err := filepath.Rel(file, walker.Path())
+		if err != nil {
+			return err
+		}
+		srcFile, dstFile := filepath.Join(source, rel), filepath.Join(remotePath, rel)
+
+		srcSum, err := server.remoteChecksum(srcClient, srcFile, algorithm)
+		if err != nil {
+			return err
+		}
+		dstSum, err := dst.remoteChecksum(dstClient, dstFile, algorithm)
+		if err != nil {
+			return err
+		}
+		if srcSum != dstSum {
+			if dst.BecomeUser != "" {
+				dst.removeAsBecomeUser(dstFile)
+			} else {
+				dstClient.Remove(dstFile)
+			}
+			return fmt.Errorf("checksum of %s on server %s does not match %s on server %s, removed it", dstFile, dst.Name, srcFile, server.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopyTo(t *testing.T) {
+	testCases := []struct {
+		name      string
+		files     map[string]string
+		destFiles map[string]string
+		source    string
+		opts      []CopyOption
+		expFiles  map[string]string
+		expErr    error
+	}{
+		{
+			name:     "File",
+			files:    map[string]string{"foo.txt": "foo"},
+			source:   "foo.txt",
+			expFiles: map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:     "LargeFile",
+			files:    map[string]string{"foo.txt": strings.Repeat("foobar", 100000)},
+			source:   "foo.txt",
+			opts:     []CopyOption{WithProgress(func(Progress) {})},
+			expFiles: map[string]string{"foo.txt": strings.Repeat("foobar", 100000)},
+		},
+		{
+			name:   "DirectoryNotRecursive",
+			files:  map[string]string{"foo/bar.txt": "bar"},
+			source: "foo",
+			expErr: fmt.Errorf("DirectoryNotRecursive"),
+		},
+		{
+			name:   "DirectoryRecursive",
+			files:  map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux", "foo/empty/": ""},
+			source: "foo",
+			opts:   []CopyOption{WithRecursive()},
+			expFiles: map[string]string{
+				"foo/bar.txt":      "bar",
+				"foo/qux/quux.txt": "quux",
+				"foo/empty/":       "",
+			},
+		},
+		{
+			name:      "ResumePartialFile",
+			files:     map[string]string{"foo.txt": "foobar"},
+			destFiles: map[string]string{"foo.txt": "foo"},
+			source:    "foo.txt",
+			opts:      []CopyOption{WithResume()},
+			expFiles:  map[string]string{"foo.txt": "foobar"},
+		},
+		{
+			name:     "Verify",
+			files:    map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux"},
+			source:   "foo",
+			opts:     []CopyOption{WithRecursive(), WithVerify("sha512")},
+			expFiles: map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux"},
+		},
+		{
+			name:   "MissingSource",
+			source: "foo.txt",
+			expErr: fmt.Errorf("MissingSource"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server, target := newConnectedTestServer(t), newConnectedTestServer(t)
+			target.Name = "bar"
+			src, dest := t.TempDir(), t.TempDir()
+			testTreeCreator(t, src, testCase.files)
+			testTreeCreator(t, dest, testCase.destFiles)
+
+			err := server.CopyTo(filepath.Join(src, testCase.source), &target, dest, testCase.opts...)
+			if testCase.expErr != nil {
+				if err == nil {
+					t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			testTreeChecker(t, dest, testCase.expFiles)
+		})
+	}
+}
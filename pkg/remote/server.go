@@ -16,8 +16,10 @@ limitations under the License.
 package remote
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -26,22 +28,73 @@ type ServerInterface interface {
 	GetName() string
 	CreateServerChain(servers map[string]ServerInterface) error
 	Connect() error
+	ConnectContext(ctx context.Context) error
 	CloseClient() error
-	Download(file, dest string) error
-	Upload(file, dest string) error
+	Download(file, dest string, opts ...CopyOption) error
+	DownloadContext(ctx context.Context, file, dest string, opts ...CopyOption) error
+	Upload(file, dest string, opts ...CopyOption) error
+	UploadContext(ctx context.Context, file, dest string, opts ...CopyOption) error
+	Glob(pattern string) ([]string, error)
+	CopyTo(file string, target ServerInterface, dest string, opts ...CopyOption) error
+	CopyToContext(ctx context.Context, file string, target ServerInterface, dest string, opts ...CopyOption) error
+	FetchHostKey() (ssh.PublicKey, error)
 }
 
 type Server struct {
-	Name                 string `mapstructure:"name"`
-	Addr                 string `mapstructure:"addr"`
-	Port                 int    `mapstructure:"port"`
-	AuthenticationMethod string `mapstructure:"authentication_method"`
-	User                 string `mapstructure:"user"`
-	Pass                 string `mapstructure:"pass"`
-	Gateway              string `mapstructure:"gateway"`
-	BecomeUser           string `mapstructure:"become_user"`
+	Name                 string        `mapstructure:"name"`
+	Addr                 string        `mapstructure:"addr"`
+	Port                 int           `mapstructure:"port"`
+	AuthenticationMethod string        `mapstructure:"authentication_method"`
+	User                 string        `mapstructure:"user"`
+	Pass                 string        `mapstructure:"pass"`
+	KeyFile              string        `mapstructure:"key_file"`
+	Passphrase           string        `mapstructure:"passphrase"`
+	AgentSocket          string        `mapstructure:"agent_socket"`
+	Challenges           []Challenge   `mapstructure:"challenges"`
+	HostKeyPolicy        string        `mapstructure:"host_key_policy"`
+	KnownHosts           string        `mapstructure:"known_hosts"`
+	HostKey              string        `mapstructure:"host_key"`
+	Gateway              string        `mapstructure:"gateway"`
+	BecomeUser           string        `mapstructure:"become_user"`
+	BecomeMethod         string        `mapstructure:"become_method"`
+	BecomePass           string        `mapstructure:"become_pass"`
+	BecomeTransfer       string        `mapstructure:"become_transfer"`
+	SFTPServer           string        `mapstructure:"sftp_server"`
+	Multiplex            bool          `mapstructure:"multiplex"`
+	MultiplexIdleTimeout time.Duration `mapstructure:"multiplex_idle_timeout"`
+	ConnectTimeout       time.Duration `mapstructure:"connect_timeout"`
+	KeepaliveInterval    time.Duration `mapstructure:"keepalive_interval"`
+	KeepaliveCountMax    int           `mapstructure:"keepalive_count_max"`
 	serverChain          []Server
 	client               *ssh.Client
+	gateways             *gatewayLease
+	hostKeyFetcher       func(ssh.PublicKey)
+}
+
+// Challenge holds the answer to a keyboard-interactive question
+// questions are matched against Prompt, a regular expression
+// the answer is either Answer or a one-time password generated from TOTPSeed
+type Challenge struct {
+	Prompt   string `mapstructure:"prompt"`
+	Answer   string `mapstructure:"answer"`
+	TOTPSeed string `mapstructure:"totp_seed"`
+}
+
+// Stringer method for Challenge struct
+// answers and TOTP seeds are secrets, so they are shown only if they refer to an environment variable
+func (challenge Challenge) String() string {
+	if challenge.TOTPSeed != "" {
+		return fmt.Sprintf("%s -> totp(%s)", challenge.Prompt, redact(challenge.TOTPSeed))
+	}
+	return fmt.Sprintf("%s -> %s", challenge.Prompt, redact(challenge.Answer))
+}
+
+// returns secret if it refers to an environment variable, otherwise a placeholder that does not reveal it
+func redact(secret string) string {
+	if strings.HasPrefix(secret, "$") {
+		return secret
+	}
+	return "<redacted>"
 }
 
 // Getter method for Name field
@@ -53,6 +106,12 @@ func (server Server) GetName() string {
 // with a list of servers that should be used as gateways
 // server index 0 is the server closest to our Server
 func (server *Server) CreateServerChain(servers map[string]ServerInterface) error {
+	// a loop of gateways would be followed forever
+	_, err := server.gatewayLoop(servers)
+	if err != nil {
+		return err
+	}
+
 	var serverChain []Server
 	curServer := server
 
@@ -70,6 +129,7 @@ func (server *Server) CreateServerChain(servers map[string]ServerInterface) erro
 }
 
 // Stringer method for Server struct
+// passwords and passphrases are redacted unless they refer to an environment variable
 func (server Server) String() string {
 	str := make([]string, 0)
 
@@ -89,7 +149,32 @@ func (server Server) String() string {
 		str = append(str, fmt.Sprintf("User: %s", server.User))
 	}
 	if server.Pass != "" {
-		str = append(str, fmt.Sprintf("Pass: %s", server.Pass))
+		str = append(str, fmt.Sprintf("Pass: %s", redact(server.Pass)))
+	}
+	if server.KeyFile != "" {
+		str = append(str, fmt.Sprintf("KeyFile: %s", server.KeyFile))
+	}
+	if server.Passphrase != "" {
+		str = append(str, fmt.Sprintf("Passphrase: %s", redact(server.Passphrase)))
+	}
+	if server.AgentSocket != "" {
+		str = append(str, fmt.Sprintf("AgentSocket: %s", server.AgentSocket))
+	}
+	for _, challenge := range server.Challenges {
+		str = append(str, fmt.Sprintf("Challenge: %s", challenge))
+	}
+	if server.HostKeyPolicy != "" {
+		str = append(str, fmt.Sprintf("HostKeyPolicy: %s", server.HostKeyPolicy))
+	}
+	if server.KnownHosts != "" {
+		str = append(str, fmt.Sprintf("KnownHosts: %s", server.KnownHosts))
+	}
+	if server.HostKey != "" {
+		fingerprint, err := server.hostKeyFingerprint()
+		if err != nil {
+			fingerprint = fmt.Sprintf("%s (invalid)", server.HostKey)
+		}
+		str = append(str, fmt.Sprintf("HostKey: %s", fingerprint))
 	}
 	if server.Gateway != "" {
 		str = append(str, fmt.Sprintf("Gateway: %s", server.Gateway))
@@ -97,6 +182,33 @@ func (server Server) String() string {
 	if server.BecomeUser != "" {
 		str = append(str, fmt.Sprintf("BecomeUser: %s", server.BecomeUser))
 	}
+	if server.BecomeMethod != "" {
+		str = append(str, fmt.Sprintf("BecomeMethod: %s", server.BecomeMethod))
+	}
+	if server.BecomePass != "" {
+		str = append(str, fmt.Sprintf("BecomePass: %s", redact(server.BecomePass)))
+	}
+	if server.BecomeTransfer != "" {
+		str = append(str, fmt.Sprintf("BecomeTransfer: %s", server.BecomeTransfer))
+	}
+	if server.SFTPServer != "" {
+		str = append(str, fmt.Sprintf("SFTPServer: %s", server.SFTPServer))
+	}
+	if server.Multiplex {
+		str = append(str, "Multiplex: true")
+	}
+	if server.MultiplexIdleTimeout != 0 {
+		str = append(str, fmt.Sprintf("MultiplexIdleTimeout: %s", server.MultiplexIdleTimeout))
+	}
+	if server.ConnectTimeout != 0 {
+		str = append(str, fmt.Sprintf("ConnectTimeout: %s", server.ConnectTimeout))
+	}
+	if server.KeepaliveInterval != 0 {
+		str = append(str, fmt.Sprintf("KeepaliveInterval: %s", server.KeepaliveInterval))
+	}
+	if server.KeepaliveCountMax != 0 {
+		str = append(str, fmt.Sprintf("KeepaliveCountMax: %d", server.KeepaliveCountMax))
+	}
 
 	return strings.Join(str, "\n")
 }
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestGetName(t *testing.T) {
@@ -91,6 +92,33 @@ func TestCreateServerChain(t *testing.T) {
 			},
 			expErr: fmt.Errorf("unknown gateway server"),
 		},
+		{
+			name:   "LoopingChain",
+			server: Server{Name: "foo", Gateway: "bar"},
+			servers: map[string]Server{
+				"foo": {Name: "foo", Gateway: "bar"},
+				"bar": {Name: "bar", Gateway: "foo"},
+			},
+			expErr: fmt.Errorf("gateways of server foo loop: foo -> bar -> foo"),
+		},
+		{
+			name:   "LoopingGateways",
+			server: Server{Name: "foo", Gateway: "bar"},
+			servers: map[string]Server{
+				"foo": {Name: "foo", Gateway: "bar"},
+				"bar": {Name: "bar", Gateway: "qux"},
+				"qux": {Name: "qux", Gateway: "bar"},
+			},
+			expErr: fmt.Errorf("gateways of server bar loop: bar -> qux -> bar"),
+		},
+		{
+			name:   "SelfGateway",
+			server: Server{Name: "foo", Gateway: "foo"},
+			servers: map[string]Server{
+				"foo": {Name: "foo", Gateway: "foo"},
+			},
+			expErr: fmt.Errorf("gateways of server foo loop: foo -> foo"),
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -131,15 +159,55 @@ func TestString(t *testing.T) {
 			server: Server{Name: "foo"},
 			expOut: "Name: foo",
 		},
+		{
+			name: "Challenges",
+			server: Server{Name: "foo", Challenges: []Challenge{
+				{Prompt: "(?i)password", Answer: "$fooPass"},
+				{Prompt: "(?i)pin", Answer: "1234"},
+				{Prompt: "(?i)verification code", TOTPSeed: "JBSWY3DPEHPK3PXP"},
+				{Prompt: "(?i)token", TOTPSeed: "$fooSeed"},
+			}},
+			expOut: "Name: foo\nChallenge: (?i)password -> $fooPass\nChallenge: (?i)pin -> <redacted>\nChallenge: (?i)verification code -> totp(<redacted>)\nChallenge: (?i)token -> totp($fooSeed)",
+		},
 		{
 			name:   "NameAddrGateway",
 			server: Server{Name: "foo", Addr: "1.1.1.1", Gateway: "bar"},
 			expOut: "Name: foo\nAddr: 1.1.1.1\nGateway: bar",
 		},
+		{
+			name:   "Multiplex",
+			server: Server{Name: "foo", Addr: "1.1.1.1", Multiplex: true, MultiplexIdleTimeout: 30 * time.Minute},
+			expOut: "Name: foo\nAddr: 1.1.1.1\nMultiplex: true\nMultiplexIdleTimeout: 30m0s",
+		},
+		{
+			name:   "TimeoutAndKeepalives",
+			server: Server{Name: "foo", Addr: "1.1.1.1", ConnectTimeout: 10 * time.Second, KeepaliveInterval: 30 * time.Second, KeepaliveCountMax: 5},
+			expOut: "Name: foo\nAddr: 1.1.1.1\nConnectTimeout: 10s\nKeepaliveInterval: 30s\nKeepaliveCountMax: 5",
+		},
+		{
+			name:   "PinnedFingerprint",
+			server: Server{Name: "foo", HostKey: "SHA256:2PiHJvN3nM3/x4cQ5nRdoFx4C6O1MvNOGh3AJCfB3Kk"},
+			expOut: "Name: foo\nHostKey: SHA256:2PiHJvN3nM3/x4cQ5nRdoFx4C6O1MvNOGh3AJCfB3Kk",
+		},
+		{
+			name:   "PinnedAuthorizedKey",
+			server: Server{Name: "foo", HostKey: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGbY0R2sCv4jcRTnvjRVZJp8gGtlUvTvH1yyHzgV9K9p"},
+			expOut: "Name: foo\nHostKey: SHA256:e9sytYWYZsM6iQsCc50+4HAahQYm/XyBf3Cb1/4LvPg",
+		},
 		{
 			name:   "AllFields",
 			server: Server{Name: "foo", Addr: "1.1.1.1", Port: 22, AuthenticationMethod: "password", User: "foo", Pass: "bar", Gateway: "qux", BecomeUser: "foobar"},
-			expOut: "Name: foo\nAddr: 1.1.1.1\nPort: 22\nAuthenticationMethod: password\nUser: foo\nPass: bar\nGateway: qux\nBecomeUser: foobar",
+			expOut: "Name: foo\nAddr: 1.1.1.1\nPort: 22\nAuthenticationMethod: password\nUser: foo\nPass: <redacted>\nGateway: qux\nBecomeUser: foobar",
+		},
+		{
+			name:   "Secrets",
+			server: Server{Name: "foo", Pass: "bar", KeyFile: "~/.ssh/id_ed25519", Passphrase: "$FOO_PASSPHRASE", BecomeUser: "foobar", BecomePass: "qux"},
+			expOut: "Name: foo\nPass: <redacted>\nKeyFile: ~/.ssh/id_ed25519\nPassphrase: $FOO_PASSPHRASE\nBecomeUser: foobar\nBecomePass: <redacted>",
+		},
+		{
+			name:   "BecomeMethod",
+			server: Server{Name: "foo", BecomeUser: "foobar", BecomeMethod: "doas", BecomePass: "$BECOME_PASS", BecomeTransfer: "sftp", SFTPServer: "/usr/lib/sftp-server"},
+			expOut: "Name: foo\nBecomeUser: foobar\nBecomeMethod: doas\nBecomePass: $BECOME_PASS\nBecomeTransfer: sftp\nSFTPServer: /usr/lib/sftp-server",
 		},
 	}
 
@@ -0,0 +1,62 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"regexp"
+	"strings"
+)
+
+// quotes s as a single word for a POSIX shell
+// the whole word is enclosed in single quotes, inside which nothing is special,
+// and single quotes in s are closed, escaped and reopened
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// bracket expressions left unquoted in glob patterns
+// only letters, digits and a few punctuation characters are allowed, so that they expand to nothing else
+var shellBracketExpr = regexp.MustCompile(`^\[[!^]?[A-Za-z0-9._-]+\]`)
+
+// quotes a glob pattern for a POSIX shell
+// *, ? and simple bracket expressions are kept for the shell to expand,
+// everything else is quoted with shellQuote
+func shellQuoteGlob(pattern string) string {
+	var quoted, literal strings.Builder
+	flush := func() {
+		if literal.Len() > 0 {
+			quoted.WriteString(shellQuote(literal.String()))
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '*' || c == '?':
+			flush()
+			quoted.WriteByte(c)
+		case c == '[' && shellBracketExpr.MatchString(pattern[i:]):
+			flush()
+			expr := shellBracketExpr.FindString(pattern[i:])
+			quoted.WriteString(expr)
+			i += len(expr) - 1
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	flush()
+	return quoted.String()
+}
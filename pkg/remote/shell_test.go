@@ -0,0 +1,181 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// file names that break or inject into unquoted shell commands
+// commands injected by them create a file named pwned in the working directory
+var nastyFilenames = []string{
+	"with space.txt",
+	"single'quote.txt",
+	`double"quote.txt`,
+	"$(touch pwned).txt",
+	"`touch pwned`.txt",
+	"semi;touch pwned;.txt",
+	"amp&&touch pwned.txt",
+	"pipe|touch pwned.txt",
+	"dollar$HOME.txt",
+	"-dash.txt",
+	`back\slash.txt`,
+	"tab\t.txt",
+	"new\nline.txt",
+	"glob*?.txt",
+	"brackets[a].txt",
+	"'$(touch pwned)'.txt",
+	"~tilde.txt",
+	"#hash.txt",
+	"<redirect>.txt",
+}
+
+func TestShellQuote(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range nastyFilenames {
+		t.Run(name, func(t *testing.T) {
+			cmd := exec.Command("sh", "-c", "printf %s "+shellQuote(name))
+			cmd.Dir = dir
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("expected error '<nil>', got '%v'", err)
+			}
+			if string(out) != name {
+				t.Fatalf("expected '%s', got '%s'", name, out)
+			}
+			testNotPwned(t, dir)
+		})
+	}
+}
+
+func TestShellQuoteGlob(t *testing.T) {
+	testCases := []struct {
+		name       string
+		pattern    string
+		expMatches []string
+	}{
+		{name: "Wildcard", pattern: "*.log", expMatches: []string{"$(touch pwned).log", "foo bar.log", "foo.log"}},
+		{name: "QuestionMark", pattern: "fo?.log", expMatches: []string{"foo.log"}},
+		{name: "SpaceAndWildcard", pattern: "foo *", expMatches: []string{"foo bar.log"}},
+		{name: "BracketExpression", pattern: "[f]oo.*", expMatches: []string{"foo.log", "foo.txt"}},
+		{name: "NegatedBracketExpression", pattern: "[!f]*", expMatches: []string{"$(touch pwned).log"}},
+		{name: "CommandSubstitution", pattern: "$(touch pwned)*", expMatches: []string{"$(touch pwned).log"}},
+		{name: "BracketWithCommandSubstitution", pattern: "[$(touch pwned)]*", expMatches: nil},
+		{name: "Backticks", pattern: "`touch pwned`*", expMatches: nil},
+		{name: "Variable", pattern: "$HOME*", expMatches: nil},
+	}
+
+	dir := t.TempDir()
+	testTreeCreator(t, dir, map[string]string{"foo.log": "", "foo bar.log": "", "foo.txt": "", "$(touch pwned).log": ""})
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			script := `for f in ` + shellQuoteGlob(testCase.pattern) + `; do if [ -e "$f" ]; then printf "%s\n" "$f"; fi; done`
+			cmd := exec.Command("sh", "-c", script)
+			cmd.Dir = dir
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("expected error '<nil>', got '%v'", err)
+			}
+			var matches []string
+			for _, match := range strings.Split(string(out), "\n") {
+				if match != "" {
+					matches = append(matches, match)
+				}
+			}
+			if !reflect.DeepEqual(testCase.expMatches, matches) {
+				t.Fatalf("expected '%v', got '%v'", testCase.expMatches, matches)
+			}
+			testNotPwned(t, dir)
+		})
+	}
+}
+
+func TestBecomeUserNastyFilenames(t *testing.T) {
+	for _, name := range nastyFilenames {
+		t.Run(name, func(t *testing.T) {
+			server := newBecomeTestServer(t, "app user;touch pwned", "")
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatalf("error getting working directory: %v", err)
+			}
+			src := t.TempDir()
+			dest := filepath.Join(t.TempDir(), "dest $(touch pwned) 'dir'")
+			testTreeCreator(t, src, map[string]string{name: name, "dir " + name + "/" + name: name})
+			testTreeCreator(t, dest, map[string]string{"up/": "", "down/": "", "down dir/": ""})
+
+			// upload to the directory of BecomeUser
+			err = server.Upload(filepath.Join(src, name), filepath.Join(dest, "up"), WithVerify(""))
+			if err != nil {
+				t.Fatalf("expected upload error '<nil>', got '%v'", err)
+			}
+			testTreeChecker(t, filepath.Join(dest, "up"), map[string]string{name: name})
+
+			// download from the directory of BecomeUser
+			err = server.Download(filepath.Join(dest, "up", name), filepath.Join(dest, "down"), WithVerify(""))
+			if err != nil {
+				t.Fatalf("expected download error '<nil>', got '%v'", err)
+			}
+			testTreeChecker(t, filepath.Join(dest, "down"), map[string]string{name: name})
+
+			// directories are copied and cleaned up as BecomeUser
+			err = server.Download(filepath.Join(src, "dir "+name), filepath.Join(dest, "down dir"), WithRecursive())
+			if err != nil {
+				t.Fatalf("expected recursive download error '<nil>', got '%v'", err)
+			}
+			testTreeChecker(t, filepath.Join(dest, "down dir"), map[string]string{"dir " + name + "/" + name: name})
+
+			// newlines separate the matches of a pattern
+			if !strings.Contains(name, "\n") {
+				matches, err := server.Glob(filepath.Join(src, "*"))
+				if err != nil {
+					t.Fatalf("expected glob error '<nil>', got '%v'", err)
+				}
+				expMatches := []string{filepath.Join(src, "dir "+name), filepath.Join(src, name)}
+				sort.Strings(expMatches)
+				if !reflect.DeepEqual(expMatches, matches) {
+					t.Fatalf("expected '%v', got '%v'", expMatches, matches)
+				}
+			}
+
+			// nothing is left in the working directory of the main user
+			entries, err := os.ReadDir(wd)
+			if err != nil {
+				t.Fatalf("error reading working directory: %v", err)
+			}
+			if len(entries) != 0 {
+				t.Fatalf("expected empty working directory, got %d entries", len(entries))
+			}
+			testNotPwned(t, wd)
+		})
+	}
+}
+
+// helper function to check that no command was injected, creating a file named pwned in dir
+func testNotPwned(t *testing.T, dir string) {
+	t.Helper()
+
+	_, err := os.Stat(filepath.Join(dir, "pwned"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected no injected command, found %s", filepath.Join(dir, "pwned"))
+	}
+}
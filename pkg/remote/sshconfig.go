@@ -0,0 +1,331 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maximum depth of nested Include directives, as in ssh
+const maxSSHConfigIncludeDepth = 16
+
+// a Host block of an OpenSSH client configuration
+type sshConfigBlock struct {
+	patterns []string
+	params   map[string]string
+}
+
+// ServersFromSSHConfig parses an OpenSSH client configuration and returns a Server for every host alias
+// HostName, Port, User, IdentityFile, ProxyJump, ConnectTimeout, ServerAliveInterval and ServerAliveCountMax
+// are taken into account,
+// for each of them the first value obtained from the matching Host blocks is used
+// ProxyJump hosts are mapped to gateways, jump hosts without an alias of their own are added as servers
+// files of Include directives are read in place, relative paths being in ~/.ssh as with ssh
+func ServersFromSSHConfig(r io.Reader) ([]Server, error) {
+	blocks, err := parseSSHConfig(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// collect the aliases, patterns with wildcards or negations are not hosts
+	var aliases []string
+	known := make(map[string]bool)
+	for _, block := range blocks {
+		for _, pattern := range block.patterns {
+			if strings.ContainsAny(pattern, "*?!") || known[pattern] {
+				continue
+			}
+			known[pattern] = true
+			aliases = append(aliases, pattern)
+		}
+	}
+
+	var servers []Server
+	added := make(map[string]bool)
+	for _, alias := range aliases {
+		server, err := sshConfigServer(blocks, alias, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		server.Name = alias
+
+		// each host of the jump list is reached through the previous one
+		gateway := ""
+		jumps := sshConfigParam(blocks, alias, "proxyjump")
+		if jumps != "" && jumps != "none" {
+			jumpList := strings.Split(jumps, ",")
+			for i := range jumpList {
+				jumpList[i] = strings.TrimSpace(jumpList[i])
+			}
+			for i, jump := range jumpList {
+				name := strings.Join(jumpList[:i+1], ",")
+				// a single alias is used as is, along with its own gateways
+				if i == 0 && known[jump] {
+					gateway = jump
+					continue
+				}
+				if !known[name] && !added[name] {
+					jumpServer, err := sshConfigJumpServer(blocks, jump)
+					if err != nil {
+						return nil, fmt.Errorf("error parsing ProxyJump of host %s: %v", alias, err)
+					}
+					jumpServer.Name = name
+					jumpServer.Gateway = gateway
+					servers = append(servers, jumpServer)
+					added[name] = true
+				}
+				gateway = name
+			}
+		}
+		server.Gateway = gateway
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// constructs the server of a ProxyJump host in [user@]host[:port] format
+func sshConfigJumpServer(blocks []sshConfigBlock, jump string) (Server, error) {
+	user := ""
+	if i := strings.LastIndex(jump, "@"); i >= 0 {
+		user, jump = jump[:i], jump[i+1:]
+	}
+	port := 0
+	if i := strings.LastIndex(jump, ":"); i >= 0 && !strings.HasSuffix(jump, "]") {
+		var err error
+		port, err = strconv.Atoi(jump[i+1:])
+		if err != nil {
+			return Server{}, fmt.Errorf("invalid port in %s: %v", jump, err)
+		}
+		jump = jump[:i]
+	}
+	jump = strings.Trim(jump, "[]")
+	return sshConfigServer(blocks, jump, user, port)
+}
+
+// constructs the server for host from the matching Host blocks
+// user and port, if set, take precedence over the configuration
+func sshConfigServer(blocks []sshConfigBlock, host, user string, port int) (Server, error) {
+	server := Server{Name: host, Addr: host, User: user, Port: port}
+
+	if hostName := sshConfigParam(blocks, host, "hostname"); hostName != "" {
+		server.Addr = strings.ReplaceAll(hostName, "%h", host)
+	}
+	if server.Port == 0 {
+		if p := sshConfigParam(blocks, host, "port"); p != "" {
+			var err error
+			server.Port, err = strconv.Atoi(p)
+			if err != nil {
+				return Server{}, fmt.Errorf("invalid port %s of host %s: %v", p, host, err)
+			}
+		}
+	}
+	if server.User == "" {
+		server.User = sshConfigParam(blocks, host, "user")
+	}
+
+	// timeouts and intervals are given in seconds
+	connectTimeout, err := sshConfigInt(blocks, host, "connecttimeout")
+	if err != nil {
+		return Server{}, err
+	}
+	server.ConnectTimeout = time.Duration(connectTimeout) * time.Second
+	aliveInterval, err := sshConfigInt(blocks, host, "serveraliveinterval")
+	if err != nil {
+		return Server{}, err
+	}
+	server.KeepaliveInterval = time.Duration(aliveInterval) * time.Second
+	server.KeepaliveCountMax, err = sshConfigInt(blocks, host, "serveralivecountmax")
+	if err != nil {
+		return Server{}, err
+	}
+	if server.User == "" {
+		// same default as ssh, the local user
+		server.User = "$USER"
+	}
+
+	// without an identity file, the keys of ssh-agent are used
+	server.AuthenticationMethod = "agent"
+	if identityFile := sshConfigParam(blocks, host, "identityfile"); identityFile != "" {
+		// the remote user is needed in the path now, so the local user it defaults to is looked up
+		replacer := strings.NewReplacer("%d", "~", "%h", server.Addr, "%r", fromEnv(server.User), "%%", "%")
+		server.AuthenticationMethod = "publickey"
+		server.KeyFile = replacer.Replace(identityFile)
+	}
+	return server, nil
+}
+
+// returns the first value of keyword for host, looking at the matching Host blocks in order
+func sshConfigParam(blocks []sshConfigBlock, host, keyword string) string {
+	for _, block := range blocks {
+		if !block.matches(host) {
+			continue
+		}
+		if value, ok := block.params[keyword]; ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// returns the first value of the numeric keyword for host, 0 if it is not set
+func sshConfigInt(blocks []sshConfigBlock, host, keyword string) (int, error) {
+	p := sshConfigParam(blocks, host, keyword)
+	if p == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(p)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %s of host %s: %v", keyword, p, host, err)
+	}
+	return n, nil
+}
+
+// checks if the patterns of the block match host
+// a matching negated pattern excludes the host
+func (block sshConfigBlock) matches(host string) bool {
+	matched := false
+	for _, pattern := range block.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		ok, _ := path.Match(strings.TrimPrefix(pattern, "!"), host)
+		if ok && negated {
+			return false
+		}
+		if ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// parses an OpenSSH client configuration into Host blocks
+// options before the first Host block apply to all hosts, Match blocks are skipped
+func parseSSHConfig(r io.Reader) ([]sshConfigBlock, error) {
+	blocks := []sshConfigBlock{{patterns: []string{"*"}, params: make(map[string]string)}}
+	return readSSHConfig(blocks, r, "ssh config", 0)
+}
+
+// adds the options of the configuration read from r to blocks and returns them
+// name identifies the configuration in errors and depth is the number of Include directives that led to it
+func readSSHConfig(blocks []sshConfigBlock, r io.Reader, name string, depth int) ([]sshConfigBlock, error) {
+	skip := false
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// keyword and arguments are separated by whitespace or an optional =
+		keyword, args := line, ""
+		if i := strings.IndexAny(line, " \t="); i >= 0 {
+			keyword, args = line[:i], strings.TrimSpace(line[i:])
+			args = strings.TrimSpace(strings.TrimPrefix(args, "="))
+		}
+		keyword = strings.ToLower(keyword)
+		if args == "" {
+			return nil, fmt.Errorf("%s line %d: missing argument for %s", name, lineNum, keyword)
+		}
+
+		switch keyword {
+		case "host":
+			blocks = append(blocks, sshConfigBlock{patterns: strings.Fields(args), params: make(map[string]string)})
+			skip = false
+		case "match":
+			skip = true
+		case "include":
+			if skip {
+				continue
+			}
+			var err error
+			blocks, err = includeSSHConfig(blocks, args, depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", name, lineNum, err)
+			}
+		default:
+			if skip {
+				continue
+			}
+			params := blocks[len(blocks)-1].params
+			if _, ok := params[keyword]; !ok {
+				params[keyword] = strings.Trim(args, `"`)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", name, err)
+	}
+	return blocks, nil
+}
+
+// adds the options of the files matching the patterns of an Include directive to blocks and returns them
+// files are read in lexical order and patterns that match no file are ignored, as with ssh
+func includeSSHConfig(blocks []sshConfigBlock, patterns string, depth int) ([]sshConfigBlock, error) {
+	if depth > maxSSHConfigIncludeDepth {
+		return nil, fmt.Errorf("too many nested Include directives")
+	}
+	current, count := blocks[len(blocks)-1], len(blocks)
+
+	for _, pattern := range strings.Fields(patterns) {
+		pattern, err := expandHome(strings.Trim(pattern, `"`))
+		if err != nil {
+			return nil, err
+		}
+		if !filepath.IsAbs(pattern) {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("error getting home directory: %v", err)
+			}
+			pattern = filepath.Join(home, ".ssh", pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Include %s: %v", pattern, err)
+		}
+		for _, file := range files {
+			blocks, err = includeSSHConfigFile(blocks, file, depth)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// options following the directive belong to the block it appears in, not to the last block of the included files
+	if len(blocks) > count {
+		blocks = append(blocks, sshConfigBlock{patterns: current.patterns, params: make(map[string]string)})
+	}
+	return blocks, nil
+}
+
+// adds the options of the included file to blocks and returns them
+func includeSSHConfigFile(blocks []sshConfigBlock, file string, depth int) ([]sshConfigBlock, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening included ssh config: %v", err)
+	}
+	defer f.Close()
+	return readSSHConfig(blocks, f, "ssh config "+file, depth)
+}
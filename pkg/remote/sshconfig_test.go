@@ -0,0 +1,200 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServersFromSSHConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		config     string
+		expServers []Server
+		expErr     error
+	}{
+		{
+			name:   "OneHost",
+			config: "Host foo\n  HostName 1.1.1.1\n  Port 2222\n  User kantonop\n  IdentityFile ~/.ssh/id_foo\n",
+			expServers: []Server{
+				{Name: "foo", Addr: "1.1.1.1", Port: 2222, User: "kantonop", AuthenticationMethod: "publickey", KeyFile: "~/.ssh/id_foo"},
+			},
+		},
+		{
+			name:   "DefaultsAndAgent",
+			config: "Host foo\n",
+			expServers: []Server{
+				{Name: "foo", Addr: "foo", User: "$USER", AuthenticationMethod: "agent"},
+			},
+		},
+		{
+			name:   "EqualsSignAndCase",
+			config: "host=foo\n  hostname = 1.1.1.1\n  USER=\"kantonop\"\n",
+			expServers: []Server{
+				{Name: "foo", Addr: "1.1.1.1", User: "kantonop", AuthenticationMethod: "agent"},
+			},
+		},
+		{
+			name:   "FirstValueWins",
+			config: "Host foo\n  User first\n  User second\nHost *\n  User third\n  Port 2222\n",
+			expServers: []Server{
+				{Name: "foo", Addr: "foo", Port: 2222, User: "first", AuthenticationMethod: "agent"},
+			},
+		},
+		{
+			name:   "GlobalAndWildcardOptions",
+			config: "User kantonop\n\nHost foo bar\n  IdentityFile %d/.ssh/id_%h\nHost *.example.com !bar.example.com\n  Port 2222\nHost foo.example.com bar.example.com\n",
+			expServers: []Server{
+				{Name: "foo", Addr: "foo", User: "kantonop", AuthenticationMethod: "publickey", KeyFile: "~/.ssh/id_foo"},
+				{Name: "bar", Addr: "bar", User: "kantonop", AuthenticationMethod: "publickey", KeyFile: "~/.ssh/id_bar"},
+				{Name: "foo.example.com", Addr: "foo.example.com", Port: 2222, User: "kantonop", AuthenticationMethod: "agent"},
+				{Name: "bar.example.com", Addr: "bar.example.com", User: "kantonop", AuthenticationMethod: "agent"},
+			},
+		},
+		{
+			name:   "MatchBlockSkipped",
+			config: "Host foo\n  User kantonop\nMatch exec \"true\"\n  User other\n",
+			expServers: []Server{
+				{Name: "foo", Addr: "foo", User: "kantonop", AuthenticationMethod: "agent"},
+			},
+		},
+		{
+			name:   "ProxyJumpAlias",
+			config: "Host foo\n  HostName 1.1.1.1\nHost bar\n  HostName 2.2.2.2\n  ProxyJump foo\nHost qux\n  HostName 3.3.3.3\n  ProxyJump bar\n",
+			expServers: []Server{
+				{Name: "foo", Addr: "1.1.1.1", User: "$USER", AuthenticationMethod: "agent"},
+				{Name: "bar", Addr: "2.2.2.2", User: "$USER", AuthenticationMethod: "agent", Gateway: "foo"},
+				{Name: "qux", Addr: "3.3.3.3", User: "$USER", AuthenticationMethod: "agent", Gateway: "bar"},
+			},
+		},
+		{
+			name:   "ProxyJumpNone",
+			config: "Host foo\n  ProxyJump none\nHost *\n  ProxyJump bar\n",
+			expServers: []Server{
+				{Name: "foo", Addr: "foo", User: "$USER", AuthenticationMethod: "agent"},
+			},
+		},
+		{
+			name:   "ProxyJumpHostSpec",
+			config: "Host foo\n  HostName 1.1.1.1\n  ProxyJump kantonop@bastion:2222\n",
+			expServers: []Server{
+				{Name: "kantonop@bastion:2222", Addr: "bastion", Port: 2222, User: "kantonop", AuthenticationMethod: "agent"},
+				{Name: "foo", Addr: "1.1.1.1", User: "$USER", AuthenticationMethod: "agent", Gateway: "kantonop@bastion:2222"},
+			},
+		},
+		{
+			name:   "ProxyJumpList",
+			config: "Host foo\n  HostName 1.1.1.1\n  ProxyJump bar, [2.2.2.2]:2222\nHost bar\n  HostName 3.3.3.3\n  User kantonop\n",
+			expServers: []Server{
+				{Name: "bar,[2.2.2.2]:2222", Addr: "2.2.2.2", Port: 2222, User: "$USER", AuthenticationMethod: "agent", Gateway: "bar"},
+				{Name: "foo", Addr: "1.1.1.1", User: "$USER", AuthenticationMethod: "agent", Gateway: "bar,[2.2.2.2]:2222"},
+				{Name: "bar", Addr: "3.3.3.3", User: "kantonop", AuthenticationMethod: "agent"},
+			},
+		},
+		{
+			name:   "TimeoutsAndKeepalives",
+			config: "Host foo\n  ConnectTimeout 10\n  ServerAliveInterval 30\n  ServerAliveCountMax 5\n",
+			expServers: []Server{
+				{
+					Name: "foo", Addr: "foo", User: "$USER", AuthenticationMethod: "agent",
+					ConnectTimeout: 10 * time.Second, KeepaliveInterval: 30 * time.Second, KeepaliveCountMax: 5,
+				},
+			},
+		},
+		{
+			name:   "InvalidServerAliveInterval",
+			config: "Host foo\n  ServerAliveInterval 30s\n",
+			expErr: fmt.Errorf("InvalidServerAliveInterval"),
+		},
+		{
+			name:   "InvalidPort",
+			config: "Host foo\n  Port twentytwo\n",
+			expErr: fmt.Errorf("InvalidPort"),
+		},
+		{
+			name:   "MissingArgument",
+			config: "Host foo\n  User\n",
+			expErr: fmt.Errorf("MissingArgument"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			out, err := ServersFromSSHConfig(strings.NewReader(testCase.config))
+			if testCase.expErr != nil {
+				if err == nil {
+					t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			if !reflect.DeepEqual(testCase.expServers, out) {
+				t.Fatalf("expected '%v', got '%v'", testCase.expServers, out)
+			}
+		})
+	}
+}
+
+func TestServersFromSSHConfigFile(t *testing.T) {
+	// relative Include paths are in ~/.ssh and %r expands to the local user if User is not set
+	home, err := filepath.Abs(filepath.Join("testdata", "sshconfig"))
+	if err != nil {
+		t.Fatalf("error getting test home directory: %v", err)
+	}
+	t.Setenv("HOME", home)
+	t.Setenv("USER", "kantonop")
+
+	file, err := os.Open(filepath.Join(home, ".ssh", "config"))
+	if err != nil {
+		t.Fatalf("error opening test ssh config: %v", err)
+	}
+	defer file.Close()
+
+	out, err := ServersFromSSHConfig(file)
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	expServers := []Server{
+		{Name: "bastion", Addr: "3.3.3.3", User: "jump", AuthenticationMethod: "agent"},
+		{Name: "bastion,admin@2.2.2.2:2222", Addr: "2.2.2.2", Port: 2222, User: "admin", AuthenticationMethod: "agent", Gateway: "bastion"},
+		{Name: "foo", Addr: "1.1.1.1", User: "$USER", AuthenticationMethod: "publickey", KeyFile: "~/.ssh/id_kantonop", Gateway: "bastion,admin@2.2.2.2:2222"},
+		{Name: "bar", Addr: "4.4.4.4", Port: 2222, User: "$USER", AuthenticationMethod: "agent"},
+		{Name: "qux", Addr: "5.5.5.5", User: "$USER", AuthenticationMethod: "agent"},
+	}
+	if !reflect.DeepEqual(expServers, out) {
+		t.Fatalf("expected '%v', got '%v'", expServers, out)
+	}
+}
+
+func TestSSHConfigIncludeLoop(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(config, []byte("Include "+config+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("error writing test ssh config: %v", err)
+	}
+	_, err = ServersFromSSHConfig(strings.NewReader("Include " + config + "\n"))
+	if err == nil || !strings.Contains(err.Error(), "too many nested Include") {
+		t.Fatalf("expected error for nested Include, got '%v'", err)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// directory in WD of the main user where uploads for BecomeUser are staged when resuming,
+// so that a partial file is found again by the next attempt
+// BecomeUser has to be able to enter WD to pick files up from it
+const resumeStagingDir = ".tiramolla-staging"
+
+// files copied with BecomeUser are staged in a private directory, mode 0700,
+// and access to them is given to the other user only, with an ACL
+// without ACLs the copy fails rather than giving access to a whole group
+// returns the command giving user read access to path and everything under it,
+// grouped so that it can be chained with other commands
+func grantReadCommand(user, path string) string {
+	msg := fmt.Sprintf("an ACL (setfacl) is required to give %s access to %s", user, path)
+	return fmt.Sprintf(`{ setfacl -R -m %s -- %s || { echo %s >&2; false; }; }`,
+		shellQuote("u:"+user+":rX"), shellQuote(path), shellQuote(msg))
+}
+
+// reports whether files of BecomeUser are copied through a staging directory,
+// which they are unless the sftp sessions of Server run as BecomeUser
+// downloads and uploads are streamed instead if BecomeTransfer is stream
+func (server Server) staging() bool {
+	return server.BecomeUser != "" && !server.sftpAsBecomeUser()
+}
+
+// creates a private directory on Server, where the main user uploads files for BecomeUser to pick up
+// if resume is set, the directory is resumeStagingDir, otherwise a new temporary directory
+func (server Server) uploadStagingDir(client *sftp.Client, resume bool) (string, error) {
+	if !resume {
+		out, err := server.runSession("mktemp -d")
+		if err != nil {
+			return "", fmt.Errorf("error creating staging directory: %v", err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	wd, err := client.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("error getting working directory: %v", err)
+	}
+	dir := filepath.Join(wd, resumeStagingDir)
+	err = client.Mkdir(dir)
+	if err != nil && !isExist(client, dir) {
+		return "", fmt.Errorf("error creating staging directory: %v", err)
+	}
+	err = client.Chmod(dir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("error creating staging directory: %v", err)
+	}
+	return dir, nil
+}
+
+// reports whether dir is an existing directory on the server of client
+func isExist(client *sftp.Client, dir string) bool {
+	info, err := client.Lstat(dir)
+	return err == nil && info.IsDir()
+}
+
+// gives BecomeUser read access to the staging directory dir of the main user
+// root needs none
+func (server Server) grantBecomeUser(dir string) error {
+	if server.BecomeUser == "root" {
+		return nil
+	}
+	_, err := server.runSession(grantReadCommand(server.BecomeUser, dir))
+	if err != nil {
+		return fmt.Errorf("error giving %s access to %s: %v", server.BecomeUser, dir, err)
+	}
+	return nil
+}
+
+// copies file to a new private directory as BecomeUser and gives the main user read access to the copy
+// returns the path of the copy, along with a function removing it, which is to be called even if the transfer fails
+func (server Server) stageAsBecomeUser(file string, recursive bool) (string, func() error, error) {
+	out, err := server.runSession("id -un")
+	if err != nil {
+		return "", nil, fmt.Errorf("error getting user name: %v", err)
+	}
+	user := strings.TrimSpace(string(out))
+
+	out, err = server.runCommand("mktemp -d")
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating staging directory: %v", err)
+	}
+	dir := strings.TrimSpace(string(out))
+	cleanup := func() error { return server.removeAsBecomeUser(dir) }
+
+	// the copy is private, whatever the permissions of the original, until access is given to the main user
+	cp := "umask 077 && cp"
+	if recursive {
+		cp += " -r"
+	}
+	_, err = server.runCommand(fmt.Sprintf("%s -- %s %s && %s", cp, shellQuote(file), shellQuote(dir), grantReadCommand(user, dir)))
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("error copying %s to %s: %v", file, dir, err)
+	}
+	return filepath.Join(dir, filepath.Base(file)), cleanup, nil
+}
@@ -0,0 +1,488 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ways to transfer files as BecomeUser
+const (
+	// files are copied by BecomeUser to a private staging directory and transferred from there over sftp
+	BecomeTransferStage = "stage"
+	// files are streamed through the standard input or output of a command run as BecomeUser,
+	// without writing them anywhere else on the server
+	BecomeTransferStream = "stream"
+	// the sftp server is run as BecomeUser, so that files are transferred over sftp as for any other user
+	BecomeTransferSFTP = "sftp"
+)
+
+// reports whether files of BecomeUser are streamed rather than staged
+func (server Server) streaming() (bool, error) {
+	if server.BecomeUser == "" {
+		return false, nil
+	}
+	switch server.BecomeTransfer {
+	case "", BecomeTransferStage, BecomeTransferSFTP:
+		return false, nil
+	case BecomeTransferStream:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown become transfer %s of server %s, should be %s, %s or %s",
+			server.BecomeTransfer, server.Name, BecomeTransferStage, BecomeTransferStream, BecomeTransferSFTP)
+	}
+}
+
+// run cmd as BecomeUser, writing stdin, if not nil, to its standard input
+// and its standard output to stdout, if not nil
+// the password is read by the become method from standard input, as a terminal would alter the data,
+// so stdin is written only after the command starts
+// errors include the standard error of the command
+// the session is closed once ctx is done
+func (server Server) runStream(ctx context.Context, cmd string, stdin io.Reader, stdout io.Writer) error {
+	becomeCmd, prompt, err := server.becomeCommand(fmt.Sprintf("printf '%%s\\n' %s; %s", shellQuote(becomeOutputMarker), cmd), true)
+	if err != nil {
+		return err
+	}
+
+	sess, err := server.client.NewSession()
+	if err != nil {
+		return fmt.Errorf("error spawning remote session: %v", err)
+	}
+	defer sess.Close()
+	in, err := sess.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	out := &markerWriter{writer: stdout, started: make(chan struct{})}
+	answerer := &promptAnswerer{
+		stdin:     in,
+		prompt:    prompt,
+		pass:      fromEnv(server.BecomePass),
+		wrongPass: func() { sess.Close() },
+		started:   out.started,
+	}
+	sess.Stdout = out
+	sess.Stderr = answerer
+
+	err = sess.Start(becomeCmd)
+	if err != nil {
+		return fmt.Errorf("error running command as %s: %v", server.BecomeUser, err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- sess.Wait() }()
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sess.Close()
+		case <-stopped:
+		}
+	}()
+
+	var inErr error
+	select {
+	case <-out.started:
+		if stdin != nil {
+			_, inErr = io.Copy(in, stdin)
+		}
+		in.Close()
+		err = <-done
+	case err = <-done:
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	if answerer.rejected() {
+		return fmt.Errorf("become_pass of server %s was rejected", server.Name)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(string(answerer.output())); msg != "" {
+			return fmt.Errorf("error running command as %s: %v: %s", server.BecomeUser, err, msg)
+		}
+		return fmt.Errorf("error running command as %s: %v", server.BecomeUser, err)
+	}
+	if inErr != nil {
+		return fmt.Errorf("error writing to command as %s: %v", server.BecomeUser, inErr)
+	}
+	if !out.found {
+		return fmt.Errorf("error running command as %s: no output from command", server.BecomeUser)
+	}
+	return nil
+}
+
+// markerWriter discards what is written to it up to becomeOutputMarker, e.g. banners of login shells,
+// and writes the rest to writer
+// started is closed once the marker is found
+type markerWriter struct {
+	writer  io.Writer
+	started chan struct{}
+	found   bool
+	buf     []byte
+}
+
+func (marker *markerWriter) Write(p []byte) (int, error) {
+	if marker.found {
+		return marker.writer.Write(p)
+	}
+
+	marker.buf = append(marker.buf, p...)
+	i := bytes.Index(marker.buf, []byte(becomeOutputMarker+"\n"))
+	if i < 0 {
+		return len(p), nil
+	}
+	marker.found = true
+	close(marker.started)
+	rest := marker.buf[i+len(becomeOutputMarker)+1:]
+	marker.buf = nil
+	if len(rest) > 0 {
+		_, err := marker.writer.Write(rest)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// returns the size of path, following symbolic links, and whether it is a directory, read by BecomeUser
+// if path does not exist, the error satisfies os.IsNotExist
+func (server Server) becomeStat(path string) (int64, bool, error) {
+	quoted := shellQuote(path)
+	out, err := server.runCommand(fmt.Sprintf("if [ -e %s ]; then stat -L -c '%%s %%F' -- %s; fi", quoted, quoted))
+	if err != nil {
+		return 0, false, err
+	}
+	line := strings.TrimSpace(string(out))
+	if line == "" {
+		return 0, false, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	fields := strings.SplitN(line, " ", 2)
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || len(fields) != 2 {
+		return 0, false, fmt.Errorf("unexpected attributes of %s: %s", path, line)
+	}
+	return size, fields[1] == "directory", nil
+}
+
+// returns the offset to resume a streamed transfer from,
+// where one of the source and the partial destination is the local file and the other is path of BecomeUser
+// the prefixes are compared like with resumeOffset, with the checksum on the server computed as BecomeUser
+func (server Server) streamResumeOffset(local io.ReaderAt, path string, srcSize, dstSize int64) int64 {
+	return resumeOffset(localPrefixChecksum(local), remotePrefixChecksum(server.runCommand, path), srcSize, dstSize)
+}
+
+// download file or directory of BecomeUser to dest, streaming it through the output of cat or tar
+func (server Server) streamDownload(file, dest string, options copyOptions) error {
+	size, isDir, err := server.becomeStat(file)
+	if err != nil {
+		return fmt.Errorf("error opening source file: %v", err)
+	}
+	if isDir && !options.recursive {
+		return fmt.Errorf("%s is a directory, recursive copy is required", file)
+	}
+
+	if isDir {
+		return server.streamDownloadDir(file, dest, options)
+	}
+	return server.streamDownloadFile(file, filepath.Join(dest, filepath.Base(file)), size, options)
+}
+
+// download a single file of BecomeUser of the given size to target
+func (server Server) streamDownloadFile(file, target string, size int64, options copyOptions) error {
+	// find where to continue a partial download from
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	var offset int64
+	if options.resume {
+		dstFile, err := os.Open(target)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error opening destination file: %v", err)
+		}
+		if err == nil {
+			defer dstFile.Close()
+			dstInfo, err := dstFile.Stat()
+			if err != nil {
+				return fmt.Errorf("error reading destination file: %v", err)
+			}
+			offset = server.streamResumeOffset(dstFile, file, size, dstInfo.Size())
+		}
+		if offset > 0 {
+			flags = os.O_WRONLY
+		}
+	}
+
+	// create the destination file
+	dstFile, err := os.OpenFile(target, flags, 0666)
+	if err != nil {
+		return fmt.Errorf("error creating destination file: %v", err)
+	}
+	defer dstFile.Close()
+	_, err = dstFile.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("error seeking destination file: %v", err)
+	}
+
+	tracker := newProgressTracker(options.progress, file, size, offset)
+	cmd := fmt.Sprintf("cat -- %s", shellQuote(file))
+	if offset > 0 {
+		cmd = fmt.Sprintf("tail -c +%d -- %s", offset+1, shellQuote(file))
+	}
+	err = server.runStream(options.ctx, cmd, nil, &progressWriter{ctx: options.ctx, writer: dstFile, tracker: tracker})
+	if err != nil {
+		if options.ctx.Err() != nil && !options.resume {
+			dstFile.Close()
+			os.Remove(target)
+		}
+		return fmt.Errorf("error downloading %s: %v", file, err)
+	}
+	return nil
+}
+
+// download the directory tree rooted at dir of BecomeUser to dest, archived by tar
+// symbolic links and special files are skipped
+func (server Server) streamDownloadDir(dir, dest string, options copyOptions) error {
+	reader, writer := io.Pipe()
+	extracted := make(chan error, 1)
+	go func() {
+		err := extractTar(reader, dest, filepath.Dir(dir), options)
+		// the rest of the archive is drained, so that tar is not blocked
+		if err == nil {
+			_, err = io.Copy(io.Discard, reader)
+		}
+		reader.CloseWithError(err)
+		extracted <- err
+	}()
+
+	// the base name is prefixed with ./ so that it is not taken for an option of tar
+	cmd := fmt.Sprintf("cd -- %s && tar -cf - %s", shellQuote(filepath.Dir(dir)), shellQuote("./"+filepath.Base(dir)))
+	err := server.runStream(options.ctx, cmd, nil, writer)
+	writer.CloseWithError(err)
+	if extractErr := <-extracted; extractErr != nil {
+		return extractErr
+	}
+	if err != nil {
+		return fmt.Errorf("error downloading %s: %v", dir, err)
+	}
+	return nil
+}
+
+// extract the directories and regular files of the tar archive read from r to dest
+// progress is reported for the files of the archive under the remote directory parent
+func extractTar(r io.Reader, dest, parent string, options copyOptions) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading archive: %v", err)
+		}
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if name == "." || name == ".." || filepath.IsAbs(name) || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("unexpected path %s in archive", header.Name)
+		}
+		target := filepath.Join(dest, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+			if err != nil {
+				return fmt.Errorf("error creating destination directory %s: %v", target, err)
+			}
+		case tar.TypeReg:
+			dstFile, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+			if err != nil {
+				return fmt.Errorf("error creating destination file: %v", err)
+			}
+			tracker := newProgressTracker(options.progress, filepath.Join(parent, name), header.Size, 0)
+			_, err = io.Copy(&progressWriter{ctx: options.ctx, writer: dstFile, tracker: tracker}, archive)
+			dstFile.Close()
+			if err != nil {
+				if options.ctx.Err() != nil {
+					os.Remove(target)
+				}
+				return fmt.Errorf("error writing to file: %v", err)
+			}
+		}
+	}
+}
+
+// upload the local file or directory to dest as BecomeUser, streaming it through the input of cat or tar
+func (server Server) streamUpload(file, dest string, info os.FileInfo, options copyOptions) error {
+	if info.IsDir() {
+		return server.streamUploadDir(file, dest, options)
+	}
+	return server.streamUploadFile(file, filepath.Join(dest, filepath.Base(file)), info, options)
+}
+
+// upload a single file to target as BecomeUser
+func (server Server) streamUploadFile(file, target string, info os.FileInfo, options copyOptions) error {
+	srcFile, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("error opening source file: %v", err)
+	}
+	defer srcFile.Close()
+
+	// find where to continue a partial upload from
+	var offset int64
+	if options.resume {
+		dstSize, _, err := server.becomeStat(target)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error reading destination file: %v", err)
+		}
+		offset = server.streamResumeOffset(srcFile, target, info.Size(), dstSize)
+	}
+	_, err = srcFile.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("error seeking source file: %v", err)
+	}
+
+	tracker := newProgressTracker(options.progress, file, info.Size(), offset)
+	cmd := fmt.Sprintf("cat > %s", shellQuote(target))
+	if offset > 0 {
+		cmd = fmt.Sprintf("cat >> %s", shellQuote(target))
+	}
+	err = server.runStream(options.ctx, cmd, &progressReader{ctx: options.ctx, reader: srcFile, size: info.Size() - offset, tracker: tracker}, nil)
+	if err != nil {
+		err = fmt.Errorf("error uploading %s: %v", file, err)
+		if options.ctx.Err() != nil && !options.resume {
+			err = withLeftover(err, server.removeLeftover(options.ctx, target, func() error {
+				return server.removeAsBecomeUser(target)
+			}))
+		}
+		return err
+	}
+
+	if options.preserve {
+		return server.applyAsBecomeUser(target, localMetadata(info))
+	}
+	return nil
+}
+
+// sets the metadata of path as BecomeUser
+// the owner is set only if BecomeUser is root
+func (server Server) applyAsBecomeUser(path string, meta fileMetadata) error {
+	quoted := shellQuote(path)
+	cmd := fmt.Sprintf("chmod %o -- %s && touch -a -d @%d -- %s && touch -m -d @%d -- %s",
+		meta.mode, quoted, meta.atime.Unix(), quoted, meta.mtime.Unix(), quoted)
+	if server.BecomeUser == "root" && meta.owned {
+		cmd = fmt.Sprintf("chown %d:%d -- %s && %s", meta.uid, meta.gid, quoted, cmd)
+	}
+	_, err := server.runCommand(cmd)
+	if err != nil {
+		return fmt.Errorf("error preserving attributes of %s: %v", path, err)
+	}
+	return nil
+}
+
+// upload the local directory tree rooted at dir to dest as BecomeUser, archived by tar
+// symbolic links and special files are skipped
+func (server Server) streamUploadDir(dir, dest string, options copyOptions) error {
+	reader, writer := io.Pipe()
+	archived := make(chan error, 1)
+	go func() {
+		err := writeTar(writer, dir, options)
+		writer.CloseWithError(err)
+		archived <- err
+	}()
+
+	// modes, times and owners of the archive are kept only if preserving
+	flags := "-m --no-same-owner --no-same-permissions"
+	if options.preserve {
+		flags = "-p"
+	}
+	err := server.runStream(options.ctx, fmt.Sprintf("tar -x %s -f - -C %s", flags, shellQuote(dest)), reader, nil)
+	// the archive is not read any further if tar fails
+	reader.Close()
+	if archiveErr := <-archived; archiveErr != nil && archiveErr != io.ErrClosedPipe {
+		return archiveErr
+	}
+	if err != nil {
+		return fmt.Errorf("error uploading %s: %v", dir, err)
+	}
+	return nil
+}
+
+// write the directories and regular files of the local directory tree rooted at dir
+// as a tar archive to w, named after the base name of dir
+func writeTar(w io.Writer, dir string, options copyOptions) error {
+	archive := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking source directory: %v", err)
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("error reading source file: %v", err)
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return fmt.Errorf("error archiving %s: %v", path, err)
+		}
+		header.Name = filepath.ToSlash(filepath.Join(filepath.Base(dir), rel))
+		if entry.IsDir() {
+			header.Name += "/"
+		}
+		// access times are only kept by PAX archives
+		header.Format = tar.FormatPAX
+		err = archive.WriteHeader(header)
+		if err != nil {
+			return fmt.Errorf("error archiving %s: %v", path, err)
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		srcFile, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("error opening source file: %v", err)
+		}
+		defer srcFile.Close()
+		tracker := newProgressTracker(options.progress, path, info.Size(), 0)
+		_, err = io.Copy(archive, &progressReader{ctx: options.ctx, reader: srcFile, size: info.Size(), tracker: tracker})
+		if err != nil {
+			return fmt.Errorf("error archiving %s: %v", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
@@ -0,0 +1,300 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	testCases := []struct {
+		name       string
+		method     string
+		becomePass string
+		upload     bool
+		files      map[string]string
+		destFiles  map[string]string
+		source     string
+		opts       []CopyOption
+		expFiles   map[string]string
+		expErr     error
+		expErrText string
+	}{
+		{
+			name:     "DownloadFile",
+			files:    map[string]string{"foo.txt": "foo"},
+			source:   "foo.txt",
+			expFiles: map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:     "UploadFile",
+			upload:   true,
+			files:    map[string]string{"foo.txt": "foo"},
+			source:   "foo.txt",
+			expFiles: map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:     "DownloadLargeFile",
+			files:    map[string]string{"foo.bin": strings.Repeat("foo\x00\r\n\x03bar", 100000)},
+			source:   "foo.bin",
+			opts:     []CopyOption{WithProgress(func(Progress) {}), WithVerify("")},
+			expFiles: map[string]string{"foo.bin": strings.Repeat("foo\x00\r\n\x03bar", 100000)},
+		},
+		{
+			name:     "UploadLargeFile",
+			upload:   true,
+			files:    map[string]string{"foo.bin": strings.Repeat("foo\x00\r\n\x03bar", 100000)},
+			source:   "foo.bin",
+			opts:     []CopyOption{WithProgress(func(Progress) {}), WithVerify("")},
+			expFiles: map[string]string{"foo.bin": strings.Repeat("foo\x00\r\n\x03bar", 100000)},
+		},
+		{
+			name:   "DownloadDirectory",
+			files:  map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux", "foo/empty/": ""},
+			source: "foo",
+			opts:   []CopyOption{WithRecursive(), WithVerify("")},
+			expFiles: map[string]string{
+				"foo/bar.txt":      "bar",
+				"foo/qux/quux.txt": "quux",
+				"foo/empty/":       "",
+			},
+		},
+		{
+			name:   "UploadDirectory",
+			upload: true,
+			files:  map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux", "foo/empty/": ""},
+			source: "foo",
+			opts:   []CopyOption{WithRecursive(), WithVerify("")},
+			expFiles: map[string]string{
+				"foo/bar.txt":      "bar",
+				"foo/qux/quux.txt": "quux",
+				"foo/empty/":       "",
+			},
+		},
+		{
+			name:   "DownloadDirectoryNotRecursive",
+			files:  map[string]string{"foo/bar.txt": "bar"},
+			source: "foo",
+			expErr: fmt.Errorf("DownloadDirectoryNotRecursive"),
+		},
+		{
+			name:      "DownloadResumePartialFile",
+			files:     map[string]string{"foo.txt": "foobar"},
+			destFiles: map[string]string{"foo.txt": "foo"},
+			source:    "foo.txt",
+			opts:      []CopyOption{WithResume()},
+			expFiles:  map[string]string{"foo.txt": "foobar"},
+		},
+		{
+			name:      "UploadResumePartialFile",
+			upload:    true,
+			files:     map[string]string{"foo.txt": "foobar"},
+			destFiles: map[string]string{"foo.txt": "foo"},
+			source:    "foo.txt",
+			opts:      []CopyOption{WithResume()},
+			expFiles:  map[string]string{"foo.txt": "foobar"},
+		},
+		{
+			name:      "UploadResumeMismatchingFile",
+			upload:    true,
+			files:     map[string]string{"foo.txt": "foobar"},
+			destFiles: map[string]string{"foo.txt": "bar"},
+			source:    "foo.txt",
+			opts:      []CopyOption{WithResume()},
+			expFiles:  map[string]string{"foo.txt": "foobar"},
+		},
+		{
+			name:       "DownloadWithPassword",
+			method:     BecomeMethodSudo,
+			becomePass: "secret",
+			files:      map[string]string{"foo.txt": "foo"},
+			source:     "foo.txt",
+			expFiles:   map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:       "UploadWithPassword",
+			method:     BecomeMethodSudoSu,
+			becomePass: "secret",
+			upload:     true,
+			files:      map[string]string{"foo.txt": "foo"},
+			source:     "foo.txt",
+			expFiles:   map[string]string{"foo.txt": "foo"},
+		},
+		{
+			name:       "PasswordWithoutStdin",
+			method:     BecomeMethodSu,
+			becomePass: "secret",
+			files:      map[string]string{"foo.txt": "foo"},
+			source:     "foo.txt",
+			expErr:     fmt.Errorf("PasswordWithoutStdin"),
+			expErrText: "without a terminal",
+		},
+		{
+			name:       "MissingSource",
+			source:     "foo.txt",
+			expErr:     fmt.Errorf("MissingSource"),
+			expErrText: "does not exist",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newBecomeTestServer(t, "app", testCase.becomePass)
+			server.BecomeMethod = testCase.method
+			server.BecomeTransfer = BecomeTransferStream
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatalf("error getting working directory: %v", err)
+			}
+			src, dest := t.TempDir(), t.TempDir()
+			testTreeCreator(t, src, testCase.files)
+			testTreeCreator(t, dest, testCase.destFiles)
+
+			if testCase.upload {
+				err = server.Upload(filepath.Join(src, testCase.source), dest, testCase.opts...)
+			} else {
+				err = server.Download(filepath.Join(src, testCase.source), dest, testCase.opts...)
+			}
+			if testCase.expErr != nil {
+				if err == nil {
+					t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+				}
+				if !strings.Contains(strings.ToLower(err.Error()), testCase.expErrText) {
+					t.Fatalf("expected error containing '%s', got '%v'", testCase.expErrText, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			testTreeChecker(t, dest, testCase.expFiles)
+
+			// nothing is staged
+			entries, err := os.ReadDir(wd)
+			if err != nil {
+				t.Fatalf("error reading working directory: %v", err)
+			}
+			if len(entries) != 0 {
+				t.Fatalf("expected empty working directory, got %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestBecomeTransferContext(t *testing.T) {
+	testCases := []struct {
+		name     string
+		transfer string
+		upload   bool
+	}{
+		{name: "StreamDownload", transfer: BecomeTransferStream},
+		{name: "StreamUpload", transfer: BecomeTransferStream, upload: true},
+		{name: "StageDownload", transfer: BecomeTransferStage},
+		{name: "StageUpload", transfer: BecomeTransferStage, upload: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newBecomeTestServer(t, "app", "")
+			server.BecomeTransfer = testCase.transfer
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatalf("error getting working directory: %v", err)
+			}
+			src, dest := t.TempDir(), t.TempDir()
+			testTreeCreator(t, src, map[string]string{"foo.txt": strings.Repeat("foobar", 1000000)})
+
+			// the transfer is cancelled once it has started
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			opt := WithProgress(func(p Progress) {
+				if p.Transferred > 0 {
+					cancel()
+				}
+			})
+			if testCase.upload {
+				err = server.UploadContext(ctx, filepath.Join(src, "foo.txt"), dest, opt)
+			} else {
+				err = server.DownloadContext(ctx, filepath.Join(src, "foo.txt"), dest, opt)
+			}
+			if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+				t.Fatalf("expected error '%v', got '%v'", context.Canceled, err)
+			}
+
+			// neither the partial file nor any staged copy is left
+			testTreeChecker(t, dest, map[string]string{})
+			entries, err := os.ReadDir(wd)
+			if err != nil {
+				t.Fatalf("error reading working directory: %v", err)
+			}
+			if len(entries) != 0 {
+				t.Fatalf("expected empty working directory, got %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestStreamUnknownTransfer(t *testing.T) {
+	server := newBecomeTestServer(t, "app", "")
+	server.BecomeTransfer = "pipe"
+	src := t.TempDir()
+	testTreeCreator(t, src, map[string]string{"foo.txt": "foo"})
+
+	err := server.Upload(filepath.Join(src, "foo.txt"), t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "unknown become transfer") {
+		t.Fatalf("expected unknown become transfer error, got '%v'", err)
+	}
+}
+
+func TestMarkerWriter(t *testing.T) {
+	testCases := []struct {
+		name     string
+		writes   []string
+		expOut   string
+		expFound bool
+	}{
+		{name: "NoOutput", writes: nil, expOut: "", expFound: false},
+		{name: "Banner", writes: []string{"welcome\n" + becomeOutputMarker + "\nfoo"}, expOut: "foo", expFound: true},
+		{name: "SplitMarker", writes: []string{"welcome\n--- tiramolla", " become output ---", "\nfoo", "bar"}, expOut: "foobar", expFound: true},
+		{name: "MarkerInData", writes: []string{becomeOutputMarker + "\n", becomeOutputMarker + "\n"}, expOut: becomeOutputMarker + "\n", expFound: true},
+		{name: "MissingMarker", writes: []string{"foo", "bar"}, expOut: "", expFound: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var out bytes.Buffer
+			marker := &markerWriter{writer: &out, started: make(chan struct{})}
+			for _, write := range testCase.writes {
+				n, err := marker.Write([]byte(write))
+				if err != nil || n != len(write) {
+					t.Fatalf("expected %d bytes written, got %d, '%v'", len(write), n, err)
+				}
+			}
+			if out.String() != testCase.expOut {
+				t.Fatalf("expected output '%q', got '%q'", testCase.expOut, out.String())
+			}
+			if marker.found != testCase.expFound {
+				t.Fatalf("expected found %t, got %t", testCase.expFound, marker.found)
+			}
+		})
+	}
+}
@@ -0,0 +1,451 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// the test binary stands in for sftp-server, which is not installed everywhere,
+// serving sftp on its standard input and output if TEST_SFTP_SERVER is set
+func TestMain(m *testing.M) {
+	if os.Getenv("TEST_SFTP_SERVER") != "" {
+		serveTestSFTP(struct {
+			io.Reader
+			io.WriteCloser
+		}{os.Stdin, os.Stdout})
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// helper function to write a script running the test binary as sftp-server
+// returns the path of the script
+func testSFTPServer(t *testing.T) string {
+	t.Helper()
+
+	bin, err := os.Executable()
+	if err != nil {
+		t.Fatalf("error getting test binary: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "sftp-server")
+	err = os.WriteFile(path, []byte("#!/bin/sh\nTEST_SFTP_SERVER=1 exec '"+bin+"'\n"), 0755)
+	if err != nil {
+		t.Fatalf("error writing fake sftp-server: %v", err)
+	}
+	return path
+}
+
+// helper function to start an in-process ssh server listening on localhost
+// the server is stopped when the test finishes
+// returns a Server with the address and port of the ssh server set
+// and a known hosts file trusting the host key of the ssh server
+func newTestSSHServer(t *testing.T, config *ssh.ServerConfig) Server {
+	t.Helper()
+	return newTestSSHServerWithOptions(t, config, testServerOptions{})
+}
+
+// testServerOptions customizes the in-process ssh server
+type testServerOptions struct {
+	// serves the sftp subsystem, with the sftp server of the local filesystem if nil
+	serveSFTP func(io.ReadWriteCloser)
+	// environment of the commands run by the server, in addition to the one of the test
+	env []string
+	// counts the connections and forwards of the server, if set
+	stats *testServerStats
+	// handles the global requests of every connection, discarding them if nil
+	handleRequests func(<-chan *ssh.Request)
+}
+
+// testServerStats counts the open connections to the in-process ssh server
+// and the direct-tcpip channels forwarded by it
+type testServerStats struct {
+	open     int32
+	forwards int32
+}
+
+// returns the number of open connections
+func (stats *testServerStats) openConns() int {
+	return int(atomic.LoadInt32(&stats.open))
+}
+
+// returns the number of forwarded channels
+func (stats *testServerStats) forwarded() int {
+	return int(atomic.LoadInt32(&stats.forwards))
+}
+
+// same as newTestSSHServer, customized by options
+func newTestSSHServerWithOptions(t *testing.T, config *ssh.ServerConfig, options testServerOptions) Server {
+	t.Helper()
+	if options.serveSFTP == nil {
+		options.serveSFTP = serveTestSFTP
+	}
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("error creating host key signer: %v", err)
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSHConn(conn, config, options)
+		}
+	}()
+
+	// trust the host key of the server
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, signer.PublicKey())
+	err = os.WriteFile(knownHosts, []byte(line+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("error writing known hosts file: %v", err)
+	}
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	return Server{Addr: host, Port: portNum, KnownHosts: knownHosts}
+}
+
+// serves a single connection to the in-process ssh server
+func serveTestSSHConn(conn net.Conn, config *ssh.ServerConfig, options testServerOptions) {
+	defer conn.Close()
+	if options.stats != nil {
+		atomic.AddInt32(&options.stats.open, 1)
+		defer atomic.AddInt32(&options.stats.open, -1)
+	}
+
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+	if options.handleRequests != nil {
+		go options.handleRequests(reqs)
+	} else {
+		go ssh.DiscardRequests(reqs)
+	}
+
+	for newChan := range chans {
+		if newChan.ChannelType() == "direct-tcpip" {
+			go serveTestForward(newChan, options)
+			continue
+		}
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "not supported by test server")
+			continue
+		}
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go serveTestSession(channel, requests, options)
+	}
+}
+
+// serves a direct-tcpip channel of the in-process ssh server, forwarding it to the requested address
+func serveTestForward(newChan ssh.NewChannel, options testServerOptions) {
+	var payload struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if ssh.Unmarshal(newChan.ExtraData(), &payload) != nil {
+		newChan.Reject(ssh.ConnectionFailed, "invalid direct-tcpip payload")
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+	channel, requests, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+	if options.stats != nil {
+		atomic.AddInt32(&options.stats.forwards, 1)
+	}
+
+	// the forward ends when either side is done
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn, channel)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(channel, conn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// serves a session of the in-process ssh server
+// the sftp subsystem and commands, run locally with sh, are supported
+func serveTestSession(channel ssh.Channel, requests <-chan *ssh.Request, options testServerOptions) {
+	defer channel.Close()
+
+	// with a pty, standard error is combined with the output
+	pty := false
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			pty = true
+			req.Reply(true, nil)
+		case "subsystem":
+			var payload struct{ Name string }
+			if ssh.Unmarshal(req.Payload, &payload) != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			options.serveSFTP(channel)
+			return
+		case "exec":
+			var payload struct{ Command string }
+			if ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+
+			cmd := exec.Command("sh", "-c", payload.Command)
+			cmd.Env = append(os.Environ(), options.env...)
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			if pty {
+				cmd.Stderr = channel
+			}
+			// unlike with Stdin, the command is not waited on until the client closes its input
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stdin, channel)
+				stdin.Close()
+			}()
+			status := uint32(0)
+			if err := cmd.Run(); err != nil {
+				status = 1
+				if exitErr, ok := err.(*exec.ExitError); ok {
+					status = uint32(exitErr.ExitCode())
+				}
+			}
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// serves the sftp subsystem with the sftp server of the local filesystem
+func serveTestSFTP(channel io.ReadWriteCloser) {
+	server, err := sftp.NewServer(channel)
+	if err != nil {
+		return
+	}
+	server.Serve()
+	server.Close()
+}
+
+// returns a function serving sftp like serveTestSFTP, which stops reading and writing once limit bytes
+// have gone either way, like a stalled connection, until the test finishes
+func stallingTestSFTP(t *testing.T, limit int64) func(io.ReadWriteCloser) {
+	stalled := make(chan struct{})
+	t.Cleanup(func() { close(stalled) })
+	return func(channel io.ReadWriteCloser) {
+		serveTestSFTP(&stallingConn{ReadWriteCloser: channel, limit: limit, stalled: stalled})
+	}
+}
+
+// stallingConn blocks once limit bytes have been read from and written to it, until stalled is closed
+type stallingConn struct {
+	io.ReadWriteCloser
+	limit   int64
+	done    int64
+	stalled chan struct{}
+}
+
+func (conn *stallingConn) Read(p []byte) (int, error) {
+	if atomic.LoadInt64(&conn.done) >= conn.limit {
+		<-conn.stalled
+		return 0, io.EOF
+	}
+	n, err := conn.ReadWriteCloser.Read(p)
+	atomic.AddInt64(&conn.done, int64(n))
+	return n, err
+}
+
+func (conn *stallingConn) Write(p []byte) (int, error) {
+	if atomic.LoadInt64(&conn.done) >= conn.limit {
+		<-conn.stalled
+		return 0, io.ErrClosedPipe
+	}
+	n, err := conn.ReadWriteCloser.Write(p)
+	atomic.AddInt64(&conn.done, int64(n))
+	return n, err
+}
+
+// helper function to start an in-process ssh server and connect to it
+// the client is closed when the test finishes
+func newConnectedTestServer(t *testing.T) Server {
+	t.Helper()
+
+	server := newTestSSHServer(t, &ssh.ServerConfig{NoClientAuth: true})
+	server.Name = "foo"
+	server.AuthenticationMethod = "password"
+	err := server.Connect()
+	if err != nil {
+		t.Fatalf("error connecting to test server: %v", err)
+	}
+	t.Cleanup(func() { server.CloseClient() })
+	return server
+}
+
+// fake privilege escalation command for tests, installed as sudo, su, doas, pbrun and dzdo
+// it runs its last argument with sh as the current user, with TEST_AS_BECOME_USER set,
+// failing unless TEST_BECOME_USER is one of its arguments
+// if TEST_BECOME_PASS is set, it asks for it with the prompt set by -p or "Password: ", up to three times,
+// on standard error if -S is set, as sudo does to read it from standard input
+const testBecomeScript = `#!/bin/sh
+prompt="Password: "
+found=
+noninteractive=
+stdin=
+prev=
+for arg; do
+	[ "$prev" = -p ] && prompt=$arg
+	[ "$arg" = -n ] && noninteractive=1
+	[ "$arg" = -S ] && stdin=1
+	[ "$arg" = "$TEST_BECOME_USER" ] && found=1
+	prev=$arg
+	last=$arg
+done
+[ -n "$found" ] || { echo "$0: unknown user" >&2; exit 1; }
+if [ -n "$TEST_BECOME_PASS" ]; then
+	[ -z "$noninteractive" ] || { echo "$0: a password is required" >&2; exit 1; }
+	[ -z "$stdin" ] || exec 3>&1 1>&2
+	tries=0
+	while :; do
+		printf '%s' "$prompt"
+		read -r pass || exit 1
+		echo
+		[ "$pass" = "$TEST_BECOME_PASS" ] && break
+		echo "Sorry, try again."
+		tries=$((tries + 1))
+		[ $tries -lt 3 ] || exit 1
+	done
+	[ -z "$stdin" ] || exec 1>&3 3>&-
+fi
+TEST_AS_BECOME_USER=1 exec sh -c "$last"
+`
+
+// fake setfacl for tests, as the users of the tests do not exist
+// it accepts entries for TEST_BECOME_USER and the current user only
+// like the mask of a real ACL entry, it adds read access to the group bits of the modes
+const testSetfaclScript = `#!/bin/sh
+user=
+for arg; do
+	case "$arg" in
+	u:*:rX) user=${arg#u:}; user=${user%:rX} ;;
+	esac
+	path=$arg
+done
+[ "$user" = "$TEST_BECOME_USER" ] || [ "$user" = "$(id -un)" ] || { echo "$0: invalid user $user" >&2; exit 1; }
+chmod -R g+rX -- "$path"
+`
+
+// helper function to start an in-process ssh server with BecomeUser and BecomePass set and connect to it
+// the fake privilege escalation commands of testBecomeScript on the PATH of the server
+// expect becomeUser and becomePass, along with the fake setfacl of testSetfaclScript
+// the working directory is changed to a temporary directory, which serves as the WD of the main user
+func newBecomeTestServer(t *testing.T, becomeUser, becomePass string) Server {
+	t.Helper()
+
+	bin := t.TempDir()
+	for _, name := range []string{"sudo", "su", "doas", "pbrun", "dzdo"} {
+		err := os.WriteFile(filepath.Join(bin, name), []byte(testBecomeScript), 0755)
+		if err != nil {
+			t.Fatalf("error writing fake %s: %v", name, err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(bin, "setfacl"), []byte(testSetfaclScript), 0755)
+	if err != nil {
+		t.Fatalf("error writing fake setfacl: %v", err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("error getting working directory: %v", err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatalf("error changing working directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	server := newTestSSHServerWithOptions(t, &ssh.ServerConfig{NoClientAuth: true}, testServerOptions{
+		env: []string{
+			"PATH=" + bin + ":" + os.Getenv("PATH"),
+			"TEST_BECOME_USER=" + becomeUser,
+			"TEST_BECOME_PASS=" + becomePass,
+		},
+	})
+	server.Name = "foo"
+	server.AuthenticationMethod = "password"
+	server.BecomeUser = becomeUser
+	server.BecomePass = becomePass
+	err = server.Connect()
+	if err != nil {
+		t.Fatalf("error connecting to test server: %v", err)
+	}
+	t.Cleanup(func() { server.CloseClient() })
+	return server
+}
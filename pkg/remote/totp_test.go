@@ -0,0 +1,63 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// test vectors of RFC 6238 appendix B, truncated to 6 digits
+	// the seed is the ASCII string "12345678901234567890" base32 encoded
+	seed := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	testCases := []struct {
+		name   string
+		seed   string
+		time   int64
+		expOut string
+		expErr error
+	}{
+		{name: "Time59", seed: seed, time: 59, expOut: "287082"},
+		{name: "Time1111111109", seed: seed, time: 1111111109, expOut: "081804"},
+		{name: "Time1111111111", seed: seed, time: 1111111111, expOut: "050471"},
+		{name: "Time1234567890", seed: seed, time: 1234567890, expOut: "005924"},
+		{name: "Time2000000000", seed: seed, time: 2000000000, expOut: "279037"},
+		{name: "Time20000000000", seed: seed, time: 20000000000, expOut: "353130"},
+		{name: "LowercaseGroupedSeed", seed: "gezd gnbv gy3t qojq gezd gnbv gy3t qojq", time: 59, expOut: "287082"},
+		{name: "InvalidSeed", seed: "not-base32!", time: 59, expErr: fmt.Errorf("InvalidSeed")},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			out, err := totp(testCase.seed, time.Unix(testCase.time, 0))
+			if testCase.expErr != nil {
+				if err == nil {
+					t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			if testCase.expOut != out {
+				t.Fatalf("expected '%s', got '%s'", testCase.expOut, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Validate checks the configuration of Server on its own
+// returns an error for every problem found, each naming the server
+func (server Server) Validate() []error {
+	var errs []error
+
+	if server.Addr == "" {
+		errs = append(errs, fmt.Errorf("server %s has no addr", server.Name))
+	}
+	if server.Port < 0 || server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port %d of server %s is out of range 1-65535", server.Port, server.Name))
+	}
+
+	if server.MultiplexIdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("multiplex_idle_timeout of server %s is negative", server.Name))
+	}
+	if server.ConnectTimeout < 0 {
+		errs = append(errs, fmt.Errorf("connect_timeout of server %s is negative", server.Name))
+	}
+	if server.KeepaliveInterval < 0 {
+		errs = append(errs, fmt.Errorf("keepalive_interval of server %s is negative", server.Name))
+	}
+	if server.KeepaliveCountMax < 0 {
+		errs = append(errs, fmt.Errorf("keepalive_count_max of server %s is negative", server.Name))
+	}
+
+	if strings.TrimSpace(server.AuthenticationMethod) == "" {
+		errs = append(errs, fmt.Errorf("server %s has no authentication_method", server.Name))
+	} else {
+		for _, method := range strings.Split(server.AuthenticationMethod, ",") {
+			switch strings.TrimSpace(method) {
+			case "password", "publickey", "agent", "keyboard-interactive":
+			default:
+				errs = append(errs, fmt.Errorf("authentication method %s of server %s is not supported", strings.TrimSpace(method), server.Name))
+			}
+		}
+	}
+
+	// fields read with fromEnv
+	type field struct{ name, value string }
+	fields := []field{
+		{"user", server.User},
+		{"pass", server.Pass},
+		{"key_file", server.KeyFile},
+		{"passphrase", server.Passphrase},
+		{"agent_socket", server.AgentSocket},
+		{"known_hosts", server.KnownHosts},
+		{"become_pass", server.BecomePass},
+	}
+	for _, challenge := range server.Challenges {
+		fields = append(fields,
+			field{"answer of challenge " + challenge.Prompt, challenge.Answer},
+			field{"totp_seed of challenge " + challenge.Prompt, challenge.TOTPSeed})
+	}
+	for _, field := range fields {
+		if !strings.HasPrefix(field.value, "$") {
+			continue
+		}
+		name := strings.TrimPrefix(field.value, "$")
+		if _, ok := os.LookupEnv(name); !ok {
+			errs = append(errs, fmt.Errorf("%s of server %s refers to unset environment variable %s", field.name, server.Name, name))
+		}
+	}
+
+	return errs
+}
+
+// ValidateGateways checks the gateways of servers, keyed by their name
+// returns an error for every unknown gateway and every loop of gateways, each naming a server
+func ValidateGateways(servers map[string]ServerInterface) []error {
+	var errs []error
+
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// loops are reported once, from the first of their servers in name order,
+	// and not from the servers leading to them
+	inLoop := make(map[string]bool)
+	for _, name := range names {
+		server, ok := servers[name].(*Server)
+		if !ok {
+			continue
+		}
+		if server.Gateway != "" && servers[server.Gateway] == nil {
+			errs = append(errs, fmt.Errorf("server %s, gateway of %s, is not known", server.Gateway, server.Name))
+			continue
+		}
+		if inLoop[name] {
+			continue
+		}
+		loop, err := server.gatewayLoop(servers)
+		if err != nil && loop[0] == name {
+			for _, looping := range loop {
+				inLoop[looping] = true
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// follows the gateways of Server
+// if they loop, returns the names of the servers in the loop, starting from the one the loop returns to,
+// along with an error describing it
+func (server *Server) gatewayLoop(servers map[string]ServerInterface) ([]string, error) {
+	visited := map[string]int{server.Name: 0}
+	path := []string{server.Name}
+	curServer := server
+
+	for curServer.Gateway != "" {
+		if i, ok := visited[curServer.Gateway]; ok {
+			loop := path[i:]
+			return loop, fmt.Errorf("gateways of server %s loop: %s -> %s", loop[0], strings.Join(loop, " -> "), loop[0])
+		}
+		gatewayServer, ok := servers[curServer.Gateway].(*Server)
+		if !ok {
+			return nil, nil
+		}
+		visited[curServer.Gateway] = len(path)
+		path = append(path, curServer.Gateway)
+		curServer = gatewayServer
+	}
+	return nil, nil
+}
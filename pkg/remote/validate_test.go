@@ -0,0 +1,185 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		server  Server
+		env     map[string]string
+		expErrs []string
+	}{
+		{
+			name:   "Valid",
+			server: Server{Name: "foo", Addr: "1.1.1.1", Port: 2222, AuthenticationMethod: "publickey, agent", User: "$TEST_USER"},
+			env:    map[string]string{"TEST_USER": "kantonop"},
+		},
+		{
+			name:    "NoAddr",
+			server:  Server{Name: "foo", AuthenticationMethod: "agent"},
+			expErrs: []string{"server foo has no addr"},
+		},
+		{
+			name:    "PortOutOfRange",
+			server:  Server{Name: "foo", Addr: "1.1.1.1", Port: 65536, AuthenticationMethod: "agent"},
+			expErrs: []string{"port 65536 of server foo is out of range 1-65535"},
+		},
+		{
+			name:    "NegativePort",
+			server:  Server{Name: "foo", Addr: "1.1.1.1", Port: -1, AuthenticationMethod: "agent"},
+			expErrs: []string{"port -1 of server foo is out of range 1-65535"},
+		},
+		{
+			name:    "NegativeIdleTimeout",
+			server:  Server{Name: "foo", Addr: "1.1.1.1", AuthenticationMethod: "agent", Multiplex: true, MultiplexIdleTimeout: -time.Second},
+			expErrs: []string{"multiplex_idle_timeout of server foo is negative"},
+		},
+		{
+			name:   "NegativeTimeoutAndKeepalives",
+			server: Server{Name: "foo", Addr: "1.1.1.1", AuthenticationMethod: "agent", ConnectTimeout: -time.Second, KeepaliveInterval: -time.Second, KeepaliveCountMax: -1},
+			expErrs: []string{
+				"connect_timeout of server foo is negative",
+				"keepalive_interval of server foo is negative",
+				"keepalive_count_max of server foo is negative",
+			},
+		},
+		{
+			name:    "NoAuthenticationMethod",
+			server:  Server{Name: "foo", Addr: "1.1.1.1"},
+			expErrs: []string{"server foo has no authentication_method"},
+		},
+		{
+			name:   "UnknownAuthenticationMethods",
+			server: Server{Name: "foo", Addr: "1.1.1.1", AuthenticationMethod: "agent,hostbased, gssapi"},
+			expErrs: []string{
+				"authentication method hostbased of server foo is not supported",
+				"authentication method gssapi of server foo is not supported",
+			},
+		},
+		{
+			name: "UnsetEnv",
+			server: Server{Name: "foo", Addr: "1.1.1.1", AuthenticationMethod: "password", User: "$TEST_USER", Pass: "$TEST_UNSET_PASS",
+				BecomePass: "$TEST_UNSET_BECOME_PASS", Challenges: []Challenge{{Prompt: "code", TOTPSeed: "$TEST_UNSET_SEED"}}},
+			env: map[string]string{"TEST_USER": ""},
+			expErrs: []string{
+				"pass of server foo refers to unset environment variable TEST_UNSET_PASS",
+				"become_pass of server foo refers to unset environment variable TEST_UNSET_BECOME_PASS",
+				"totp_seed of challenge code of server foo refers to unset environment variable TEST_UNSET_SEED",
+			},
+		},
+		{
+			name:   "SeveralProblems",
+			server: Server{Name: "foo", Port: 70000, AuthenticationMethod: "foo"},
+			expErrs: []string{
+				"server foo has no addr",
+				"port 70000 of server foo is out of range 1-65535",
+				"authentication method foo of server foo is not supported",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for key, val := range testCase.env {
+				t.Setenv(key, val)
+			}
+			testErrs(t, testCase.expErrs, testCase.server.Validate())
+		})
+	}
+}
+
+func TestValidateGateways(t *testing.T) {
+	testCases := []struct {
+		name    string
+		servers []Server
+		expErrs []string
+	}{
+		{
+			name:    "Chain",
+			servers: []Server{{Name: "foo", Gateway: "bar"}, {Name: "bar", Gateway: "qux"}, {Name: "qux"}},
+		},
+		{
+			name:    "UnknownGateway",
+			servers: []Server{{Name: "foo", Gateway: "bar"}},
+			expErrs: []string{"server bar, gateway of foo, is not known"},
+		},
+		{
+			name:    "Loop",
+			servers: []Server{{Name: "foo", Gateway: "bar"}, {Name: "bar", Gateway: "foo"}},
+			expErrs: []string{"gateways of server bar loop: bar -> foo -> bar"},
+		},
+		{
+			name:    "SelfGateway",
+			servers: []Server{{Name: "foo", Gateway: "foo"}},
+			expErrs: []string{"gateways of server foo loop: foo -> foo"},
+		},
+		{
+			name: "ChainIntoLoop",
+			servers: []Server{
+				{Name: "aaa", Gateway: "foo"},
+				{Name: "foo", Gateway: "qux"},
+				{Name: "qux", Gateway: "zzz"},
+				{Name: "zzz", Gateway: "qux"},
+			},
+			expErrs: []string{"gateways of server qux loop: qux -> zzz -> qux"},
+		},
+		{
+			name: "TwoLoops",
+			servers: []Server{
+				{Name: "foo", Gateway: "bar"},
+				{Name: "bar", Gateway: "foo"},
+				{Name: "qux", Gateway: "zzz"},
+				{Name: "zzz", Gateway: "qux"},
+				{Name: "baz", Gateway: "unknown"},
+			},
+			expErrs: []string{
+				"gateways of server bar loop: bar -> foo -> bar",
+				"server unknown, gateway of baz, is not known",
+				"gateways of server qux loop: qux -> zzz -> qux",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			servers := make(map[string]ServerInterface)
+			for _, val := range testCase.servers {
+				server := val
+				servers[server.Name] = &server
+			}
+			testErrs(t, testCase.expErrs, ValidateGateways(servers))
+		})
+	}
+}
+
+// helper function to compare errors with their expected messages
+func testErrs(t *testing.T, expErrs []string, errs []error) {
+	t.Helper()
+
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	if !reflect.DeepEqual(expErrs, msgs) {
+		t.Fatalf("expected '%v', got '%v'", expErrs, msgs)
+	}
+}
@@ -0,0 +1,389 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// DefaultChecksum is the hash algorithm used to verify transfers if none is set
+const DefaultChecksum = "sha256"
+
+// hash algorithms supported for verification
+var checksums = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// WithVerify compares the checksum of every copied file with its source once the copy completes
+// algorithm is one of md5, sha1, sha256 and sha512, DefaultChecksum if empty
+// a destination file that does not match its source is removed
+func WithVerify(algorithm string) CopyOption {
+	return func(options *copyOptions) {
+		if algorithm == "" {
+			algorithm = DefaultChecksum
+		}
+		options.verify = algorithm
+	}
+}
+
+// checks that the checksum algorithm of the options is supported
+func validateChecksum(algorithm string) error {
+	if _, ok := checksums[algorithm]; algorithm != "" && !ok {
+		var supported []string
+		for name := range checksums {
+			supported = append(supported, name)
+		}
+		sort.Strings(supported)
+		return fmt.Errorf("unsupported checksum %s, should be one of %s", algorithm, strings.Join(supported, ", "))
+	}
+	return nil
+}
+
+// verifies the upload of the local file or directory to the remote path
+// mismatching files are removed from Server
+func (server Server) verifyUpload(client *sftp.Client, file, remotePath, algorithm string) error {
+	return walkLocalFiles(file, func(rel string) error {
+		localFile := filepath.Join(file, rel)
+		remoteFile := filepath.Join(remotePath, rel)
+		err := server.verifyFile(client, localFile, remoteFile, algorithm)
+		if err == errChecksumMismatch {
+			if server.BecomeUser != "" {
+				server.removeAsBecomeUser(remoteFile)
+			} else {
+				client.Remove(remoteFile)
+			}
+			return fmt.Errorf("checksum of %s does not match %s, removed it from server %s", remoteFile, localFile, server.Name)
+		}
+		return err
+	})
+}
+
+// verifies the download of the remote file or directory to the local path
+// the files to verify are found by walking the remote source, so that other files at the local path are not checked
+// mismatching files are removed locally
+func (server Server) verifyDownload(client *sftp.Client, remotePath, file, algorithm string) error {
+	paths, err := server.remoteFiles(client, remotePath)
+	if err != nil {
+		return err
+	}
+	for _, rel := range paths {
+		localFile := filepath.Join(file, rel)
+		remoteFile := filepath.Join(remotePath, rel)
+		err := server.verifyFile(client, localFile, remoteFile, algorithm)
+		if err == errChecksumMismatch {
+			os.Remove(localFile)
+			return fmt.Errorf("checksum of %s does not match %s of server %s, removed it", localFile, remoteFile, server.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returned when the checksums of a local and a remote file differ
+var errChecksumMismatch = fmt.Errorf("checksum mismatch")
+
+// compares the checksums of a local and a remote file
+// returns errChecksumMismatch if they differ
+func (server Server) verifyFile(client *sftp.Client, localFile, remoteFile, algorithm string) error {
+	localSum, err := localChecksum(localFile, algorithm)
+	if err != nil {
+		return err
+	}
+	remoteSum, err := server.remoteChecksum(client, remoteFile, algorithm)
+	if err != nil {
+		return err
+	}
+	if localSum != remoteSum {
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+// calls fn with the path of every regular file under root, relative to root
+// the path is empty if root is a file itself
+func walkLocalFiles(root string, fn func(rel string) error) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking %s: %v", path, err)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		return fn(rel)
+	})
+}
+
+// returns the path of every regular file under root on Server, relative to root
+// the path is empty if root is a file itself
+// files of BecomeUser are listed by BecomeUser, as the main user may not have access to them
+func (server Server) remoteFiles(client *sftp.Client, root string) ([]string, error) {
+	var paths []string
+	if server.BecomeUser != "" && !server.sftpAsBecomeUser() {
+		// the base name is prefixed with ./ so that it is not taken for an option of find
+		base := filepath.Base(root)
+		cmd := fmt.Sprintf("cd -- %s && find %s -type f", shellQuote(filepath.Dir(root)), shellQuote("./"+base))
+		out, err := server.runCommand(cmd)
+		if err != nil {
+			return nil, fmt.Errorf("error walking %s: %v", root, err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			rel, err := filepath.Rel(base, filepath.Clean(line))
+			// lines of file names with newlines are not under root and are skipped
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			if rel == "." {
+				rel = ""
+			}
+			paths = append(paths, rel)
+		}
+		return paths, nil
+	}
+
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, fmt.Errorf("error walking %s: %v", walker.Path(), err)
+		}
+		if !walker.Stat().Mode().IsRegular() {
+			continue
+		}
+		rel, err := filepath.Rel(root, walker.Path())
+		if err != nil {
+			return nil, err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		paths = append(paths, rel)
+	}
+	return paths, nil
+}
+
+// computes the hex encoded checksum of a local file
+func localChecksum(file, algorithm string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("error opening %s for verification: %v", file, err)
+	}
+	defer f.Close()
+
+	h := checksums[algorithm]()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s for verification: %v", file, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// computes the hex encoded checksum of a file on Server
+// the sftp check-file extension is used if the server supports it,
+// otherwise the checksum utility of the server, e.g. sha256sum, is run as BecomeUser if set
+func (server Server) remoteChecksum(client *sftp.Client, file, algorithm string) (string, error) {
+	// the sftp server runs as the main user, which may not be able to read files of BecomeUser
+	if _, ok := client.HasExtension("check-file"); ok && server.BecomeUser == "" {
+		sum, err := server.checkFile(file, algorithm)
+		if err == nil {
+			return sum, nil
+		}
+	}
+
+	out, err := server.runCommand(fmt.Sprintf("%ssum -- %s", algorithm, shellQuote(file)))
+	if err != nil {
+		return "", fmt.Errorf("error computing %s checksum of %s on server %s: %v", algorithm, file, server.Name, err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("no %s checksum of %s returned by server %s", algorithm, file, server.Name)
+	}
+	// the checksum is prefixed with a backslash if the file name has to be escaped
+	return strings.ToLower(strings.TrimPrefix(fields[0], "\\")), nil
+}
+
+// sftp packet types used by the check-file extension
+const (
+	sftpInit          = 1
+	sftpVersion       = 2
+	sftpStatus        = 101
+	sftpExtended      = 200
+	sftpExtendedReply = 201
+)
+
+// computes the checksum of a file on Server with the check-file-name request of the sftp check-file extension
+// the sftp client does not support extended requests, so a separate sftp session is used
+func (server Server) checkFile(file, algorithm string) (string, error) {
+	sess, err := server.client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("error spawning remote session: %v", err)
+	}
+	defer sess.Close()
+	w, err := sess.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	r, err := sess.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	err = sess.RequestSubsystem("sftp")
+	if err != nil {
+		return "", fmt.Errorf("error requesting sftp subsystem: %v", err)
+	}
+
+	// version 3 is the one supported by the sftp client as well
+	init := new(bytes.Buffer)
+	binary.Write(init, binary.BigEndian, uint32(3))
+	err = writeSFTPPacket(w, sftpInit, init.Bytes())
+	if err != nil {
+		return "", err
+	}
+	typ, _, err := readSFTPPacket(r)
+	if err != nil {
+		return "", err
+	}
+	if typ != sftpVersion {
+		return "", fmt.Errorf("unexpected sftp packet type %d instead of version", typ)
+	}
+
+	// check the whole file as a single block
+	req := new(bytes.Buffer)
+	binary.Write(req, binary.BigEndian, uint32(1))
+	writeSFTPString(req, "check-file-name")
+	writeSFTPString(req, file)
+	writeSFTPString(req, algorithm)
+	binary.Write(req, binary.BigEndian, uint64(0))
+	binary.Write(req, binary.BigEndian, uint64(0))
+	binary.Write(req, binary.BigEndian, uint32(0))
+	err = writeSFTPPacket(w, sftpExtended, req.Bytes())
+	if err != nil {
+		return "", err
+	}
+	typ, payload, err := readSFTPPacket(r)
+	if err != nil {
+		return "", err
+	}
+	if typ == sftpStatus {
+		return "", fmt.Errorf("check-file of %s failed", file)
+	}
+	if typ != sftpExtendedReply {
+		return "", fmt.Errorf("unexpected sftp packet type %d instead of extended reply", typ)
+	}
+
+	// reply is the request id, "check-file", the algorithm used and the hash
+	reply := bytes.NewReader(payload)
+	var id uint32
+	err = binary.Read(reply, binary.BigEndian, &id)
+	if err != nil {
+		return "", fmt.Errorf("malformed check-file reply: %v", err)
+	}
+	for _, expected := range []string{"check-file", algorithm} {
+		s, err := readSFTPString(reply)
+		if err != nil {
+			return "", fmt.Errorf("malformed check-file reply: %v", err)
+		}
+		if s != expected {
+			return "", fmt.Errorf("unexpected %s in check-file reply instead of %s", s, expected)
+		}
+	}
+	sum, err := io.ReadAll(reply)
+	if err != nil {
+		return "", err
+	}
+	if len(sum) != checksums[algorithm]().Size() {
+		return "", fmt.Errorf("unexpected length %d of %s checksum in check-file reply", len(sum), algorithm)
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// writes an sftp packet of typ with payload
+func writeSFTPPacket(w io.Writer, typ byte, payload []byte) error {
+	packet := new(bytes.Buffer)
+	binary.Write(packet, binary.BigEndian, uint32(len(payload)+1))
+	packet.WriteByte(typ)
+	packet.Write(payload)
+	_, err := w.Write(packet.Bytes())
+	if err != nil {
+		return fmt.Errorf("error writing sftp packet: %v", err)
+	}
+	return nil
+}
+
+// reads an sftp packet, returning its type and payload
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	var length uint32
+	err := binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading sftp packet: %v", err)
+	}
+	if length == 0 || length > 1<<20 {
+		return 0, nil, fmt.Errorf("invalid sftp packet length %d", length)
+	}
+	packet := make([]byte, length)
+	_, err = io.ReadFull(r, packet)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading sftp packet: %v", err)
+	}
+	return packet[0], packet[1:], nil
+}
+
+// writes a length prefixed string of an sftp packet
+func writeSFTPString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+// reads a length prefixed string of an sftp packet
+func readSFTPString(r io.Reader) (string, error) {
+	var length uint32
+	err := binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return "", err
+	}
+	if length > 1<<16 {
+		return "", fmt.Errorf("invalid string length %d", length)
+	}
+	s := make([]byte, length)
+	_, err = io.ReadFull(r, s)
+	return string(s), err
+}
@@ -0,0 +1,225 @@
+/*
+Copyright © 2022 Kostas Antonopoulos kost.antonopoulos@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package remote
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestVerifyMismatch(t *testing.T) {
+	testCases := []struct {
+		name       string
+		upload     bool
+		localFile  string
+		remoteFile string
+		expErr     error
+	}{
+		{
+			name:       "UploadMatch",
+			upload:     true,
+			localFile:  "foo",
+			remoteFile: "foo",
+			expErr:     nil,
+		},
+		{
+			name:       "UploadMismatch",
+			upload:     true,
+			localFile:  "foo",
+			remoteFile: "bar",
+			expErr:     fmt.Errorf("UploadMismatch"),
+		},
+		{
+			name:       "DownloadMatch",
+			localFile:  "foo",
+			remoteFile: "foo",
+			expErr:     nil,
+		},
+		{
+			name:       "DownloadMismatch",
+			localFile:  "foo",
+			remoteFile: "bar",
+			expErr:     fmt.Errorf("DownloadMismatch"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newConnectedTestServer(t)
+			client, err := sftp.NewClient(server.client)
+			if err != nil {
+				t.Fatalf("error creating sftp client: %v", err)
+			}
+			defer client.Close()
+
+			local, remote := t.TempDir(), t.TempDir()
+			testTreeCreator(t, local, map[string]string{"foo.txt": testCase.localFile})
+			testTreeCreator(t, remote, map[string]string{"foo.txt": testCase.remoteFile})
+			localFile, remoteFile := filepath.Join(local, "foo.txt"), filepath.Join(remote, "foo.txt")
+
+			// the destination is removed on mismatch
+			dest := localFile
+			if testCase.upload {
+				dest = remoteFile
+				err = server.verifyUpload(client, localFile, remoteFile, DefaultChecksum)
+			} else {
+				err = server.verifyDownload(client, remoteFile, localFile, DefaultChecksum)
+			}
+			_, statErr := os.Stat(dest)
+			if testCase.expErr != nil {
+				if err == nil {
+					t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+				}
+				if !os.IsNotExist(statErr) {
+					t.Fatalf("expected mismatching %s to be removed, got '%v'", dest, statErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected error '%v', got '%v'", testCase.expErr, err)
+			}
+			if statErr != nil {
+				t.Fatalf("expected %s to be kept, got '%v'", dest, statErr)
+			}
+		})
+	}
+}
+
+func TestVerifyDownloadCopiedFiles(t *testing.T) {
+	for name, becomeUser := range map[string]string{"MainUser": "", "BecomeUser": "app"} {
+		becomeUser := becomeUser
+		t.Run(name, func(t *testing.T) {
+			server := newConnectedTestServer(t)
+			if becomeUser != "" {
+				server = newBecomeTestServer(t, becomeUser, "")
+			}
+			client, err := sftp.NewClient(server.client)
+			if err != nil {
+				t.Fatalf("error creating sftp client: %v", err)
+			}
+			defer client.Close()
+
+			// the local directory holds files that were not copied, which are not verified
+			local, remote := t.TempDir(), t.TempDir()
+			testTreeCreator(t, remote, map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux"})
+			testTreeCreator(t, local, map[string]string{"foo/bar.txt": "bar", "foo/qux/quux.txt": "quux", "foo/other.txt": "other"})
+			err = server.verifyDownload(client, filepath.Join(remote, "foo"), filepath.Join(local, "foo"), DefaultChecksum)
+			if err != nil {
+				t.Fatalf("expected error '<nil>', got '%v'", err)
+			}
+
+			// every copied file is verified
+			err = os.WriteFile(filepath.Join(local, "foo", "qux", "quux.txt"), []byte("corrupt"), 0644)
+			if err != nil {
+				t.Fatalf("error writing test file: %v", err)
+			}
+			err = server.verifyDownload(client, filepath.Join(remote, "foo"), filepath.Join(local, "foo"), DefaultChecksum)
+			if err == nil {
+				t.Fatalf("expected error for mismatching file, got '%v'", err)
+			}
+			testTreeChecker(t, local, map[string]string{"foo/bar.txt": "bar", "foo/other.txt": "other"})
+			_, err = os.Stat(filepath.Join(local, "foo", "qux", "quux.txt"))
+			if !os.IsNotExist(err) {
+				t.Fatalf("expected mismatching file to be removed, got '%v'", err)
+			}
+		})
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "foo.txt")
+	err := os.WriteFile(file, []byte("foo"), 0644)
+	if err != nil {
+		t.Fatalf("error writing test file: %v", err)
+	}
+	expSum := sha256.Sum256([]byte("foo"))
+
+	server := newTestSSHServerWithOptions(t, &ssh.ServerConfig{NoClientAuth: true}, testServerOptions{serveSFTP: serveTestCheckFile})
+	server.Name = "foo"
+	server.AuthenticationMethod = "password"
+	err = server.Connect()
+	if err != nil {
+		t.Fatalf("error connecting to test server: %v", err)
+	}
+	defer server.CloseClient()
+
+	sum, err := server.checkFile(file, "sha256")
+	if err != nil {
+		t.Fatalf("expected error '<nil>', got '%v'", err)
+	}
+	if sum != hex.EncodeToString(expSum[:]) {
+		t.Fatalf("expected checksum '%x', got '%s'", expSum, sum)
+	}
+
+	// the server only supports sha256
+	_, err = server.checkFile(file, "md5")
+	if err == nil {
+		t.Fatalf("expected error for unsupported algorithm, got '%v'", err)
+	}
+}
+
+// serves a minimal sftp subsystem that only answers check-file-name requests with sha256
+func serveTestCheckFile(channel io.ReadWriteCloser) {
+	defer channel.Close()
+
+	typ, _, err := readSFTPPacket(channel)
+	if err != nil || typ != sftpInit {
+		return
+	}
+	version := new(bytes.Buffer)
+	binary.Write(version, binary.BigEndian, uint32(3))
+	writeSFTPString(version, "check-file")
+	writeSFTPString(version, "sha256")
+	writeSFTPPacket(channel, sftpVersion, version.Bytes())
+
+	typ, payload, err := readSFTPPacket(channel)
+	if err != nil || typ != sftpExtended {
+		return
+	}
+	req := bytes.NewReader(payload)
+	var id uint32
+	binary.Read(req, binary.BigEndian, &id)
+	name, _ := readSFTPString(req)
+	file, _ := readSFTPString(req)
+	algorithms, _ := readSFTPString(req)
+
+	reply := new(bytes.Buffer)
+	binary.Write(reply, binary.BigEndian, id)
+	content, err := os.ReadFile(file)
+	if name != "check-file-name" || algorithms != "sha256" || err != nil {
+		// failure status with no message
+		binary.Write(reply, binary.BigEndian, uint32(4))
+		writeSFTPString(reply, "")
+		writeSFTPString(reply, "")
+		writeSFTPPacket(channel, sftpStatus, reply.Bytes())
+		return
+	}
+	sum := sha256.Sum256(content)
+	writeSFTPString(reply, "check-file")
+	writeSFTPString(reply, "sha256")
+	reply.Write(sum[:])
+	writeSFTPPacket(channel, sftpExtendedReply, reply.Bytes())
+}